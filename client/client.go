@@ -2,10 +2,17 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -13,30 +20,176 @@ var (
 	ErrTaskNotReady = errors.New("task not ready")
 )
 
+// defaultRateLimitRetries is RateLimitRetries of new clients.
+const defaultRateLimitRetries = 3
+
 type Client struct {
 	apiKey string
 	apiURL string
+	// Compress sends payloads and results gzip compressed. Large payloads
+	// and results are received gzip compressed and decompressed by the HTTP
+	// client anyway.
+	Compress bool
+	// RateLimitRetries is how many times a call rate limited with 429 is
+	// sent again after the Retry-After delay. Calls streaming a reader are
+	// not sent again.
+	RateLimitRetries int
+
+	httpClient *http.Client
+	tokenMutex sync.RWMutex
+	token      string
+}
+
+// SetToken makes the client authenticate with the bearer token instead of
+// the API key. It is safe to replace the token while the client is used.
+func (c *Client) SetToken(token string) {
+	c.tokenMutex.Lock()
+	c.token = token
+	c.tokenMutex.Unlock()
 }
 
-func New(apiURL string, apikey string) *Client {
-	return &Client{
-		apiURL: apiURL,
-		apiKey: apikey,
+func (c *Client) authorize(req *http.Request) {
+	c.tokenMutex.RLock()
+	token := c.token
+	c.tokenMutex.RUnlock()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return
 	}
+	req.Header.Set("X-API-KEY", c.apiKey)
 }
 
-func (c *Client) AddTask(queue string, timeoutSeconds int, payload []byte) (taskID string, err error) {
-	req, err := http.NewRequest("POST",
-		c.apiURL+"/task?queue="+queue+"&timeout="+strconv.Itoa(timeoutSeconds),
-		bytes.NewBuffer(payload))
+// TokenRequest is the claims of a token to mint.
+type TokenRequest struct {
+	Subject string
+	// enqueue, consume, read-results or admin
+	Roles []string
+	// queue names and prefixes ending with "*", empty for all queues
+	Queues []string
+	// queues and tasks of the token are in the tenant namespace
+	Tenant string
+	// one hour if zero
+	TTL time.Duration
+}
+
+// MintToken returns a token signed by the server, the client must have the
+// admin role.
+func (c *Client) MintToken(request TokenRequest) (string, error) {
+	body := struct {
+		Subject string
+		Roles   []string
+		Queues  []string
+		Tenant  string
+		TTL     string `json:",omitempty"`
+	}{Subject: request.Subject, Roles: request.Roles, Queues: request.Queues, Tenant: request.Tenant}
+	if request.TTL != 0 {
+		body.TTL = request.TTL.String()
+	}
+	data, err := json.Marshal(body)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("X-API-KEY", c.apiKey)
-	resp, err := http.DefaultClient.Do(req)
+	req, err := http.NewRequest("POST", c.apiURL+"/admin/token", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	c.authorize(req)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+	token, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// Option configures the client.
+type Option func(c *Client)
+
+// WithTLSConfig makes the client use the TLS config, for example with the
+// server CA in RootCAs and the client certificate in Certificates, see
+// LoadTLSConfig.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) {
+		c.httpClient = &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   config,
+			ForceAttemptHTTP2: true,
+		}}
+	}
+}
+
+// LoadTLSConfig returns the TLS config trusting the CA certificates of the
+// caFile, system ones if it is empty, and with the client certificate of
+// certFile and keyFile if they are set.
+func LoadTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func New(apiURL string, apikey string, options ...Option) *Client {
+	c := &Client{
+		apiURL:           apiURL,
+		apiKey:           apikey,
+		httpClient:       http.DefaultClient,
+		RateLimitRetries: defaultRateLimitRetries,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+func (c *Client) AddTask(queue string, timeoutSeconds int, payload []byte) (taskID string, err error) {
+	return c.addTask(queue, "", timeoutSeconds, func() io.Reader { return bytes.NewReader(payload) }, true)
+}
+
+// AddGroupTask adds the task to the group within the queue, workers get
+// tasks of the groups of the queue in turns.
+func (c *Client) AddGroupTask(queue string, group string, timeoutSeconds int, payload []byte) (taskID string, err error) {
+	return c.addTask(queue, group, timeoutSeconds, func() io.Reader { return bytes.NewReader(payload) }, true)
+}
+
+// AddTaskReader adds the task streaming the payload from r.
+func (c *Client) AddTaskReader(queue string, timeoutSeconds int, payload io.Reader) (taskID string, err error) {
+	return c.addTask(queue, "", timeoutSeconds, func() io.Reader { return payload }, false)
+}
+
+func (c *Client) addTask(queue string, group string, timeoutSeconds int, payload func() io.Reader, repeatable bool) (taskID string, err error) {
+	url := c.apiURL + "/task?queue=" + queue + "&timeout=" + strconv.Itoa(timeoutSeconds)
+	if group != "" {
+		url += "&group=" + neturl.QueryEscape(group)
+	}
+	resp, err := c.do(func() (*http.Request, error) {
+		return c.newUpload(url, payload())
+	}, repeatable)
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return "", errors.New(resp.Status)
 	}
@@ -44,57 +197,71 @@ func (c *Client) AddTask(queue string, timeoutSeconds int, payload []byte) (task
 	if err != nil {
 		return "", err
 	}
-	if taskIDRaw == nil {
+	if len(taskIDRaw) == 0 {
 		return "", errors.New("task id is empty")
 	}
 	return string(taskIDRaw), nil
 }
 
 func (c *Client) WaitWorkerTask(queue string, retries int, interval time.Duration) (taskID string, payload []byte, err error) {
-	req, err := http.NewRequest("GET",
-		c.apiURL+"/task/worker?queue="+queue,
-		nil)
+	taskID, body, err := c.WaitWorkerTaskReader(queue, retries, interval)
 	if err != nil {
 		return "", nil, err
 	}
-	req.Header.Set("X-API-KEY", c.apiKey)
+	defer body.Close()
+	payload, err = ioutil.ReadAll(body)
+	if err != nil {
+		return "", nil, err
+	}
+	return taskID, payload, nil
+}
+
+// WaitWorkerTaskReader is WaitWorkerTask returning the payload as a stream,
+// the caller must close it.
+func (c *Client) WaitWorkerTaskReader(queue string, retries int, interval time.Duration) (taskID string, payload io.ReadCloser, err error) {
+	url := c.apiURL + "/task/worker?queue=" + queue
 	for retry := 0; retry < retries; retry++ {
-		resp, err := http.DefaultClient.Do(req)
+		// a new request on every poll picks up a token set meanwhile
+		resp, err := c.do(func() (*http.Request, error) { return c.newGet(url) }, true)
 		if err != nil {
 			return "", nil, err
 		}
 		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
 			if resp.StatusCode == http.StatusNotFound {
-				time.Sleep(interval)
+				time.Sleep(pollInterval(resp, interval))
 				continue
 			}
 			return "", nil, errors.New(resp.Status)
 		}
 		taskIDRaw := resp.Header.Get("X-TASK-ID")
 		if taskIDRaw == "" {
+			resp.Body.Close()
 			return "", nil, errors.New("task id is empty")
 		}
-		payload, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", nil, err
-		}
-		return string(taskIDRaw), payload, nil
+		return taskIDRaw, resp.Body, nil
 	}
 	return "", nil, ErrTaskNotReady
 }
 
 func (c *Client) SetTaskReady(taskID string, result []byte) error {
-	req, err := http.NewRequest("POST",
-		c.apiURL+"/task/ready?taskid="+taskID,
-		bytes.NewBuffer(result))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("X-API-KEY", c.apiKey)
-	resp, err := http.DefaultClient.Do(req)
+	return c.setTaskReady(taskID, func() io.Reader { return bytes.NewReader(result) }, true)
+}
+
+// SetTaskReadyReader sets the task ready streaming the result from r.
+func (c *Client) SetTaskReadyReader(taskID string, result io.Reader) error {
+	return c.setTaskReady(taskID, func() io.Reader { return result }, false)
+}
+
+func (c *Client) setTaskReady(taskID string, result func() io.Reader, repeatable bool) error {
+	url := c.apiURL + "/task/ready?taskid=" + taskID
+	resp, err := c.do(func() (*http.Request, error) {
+		return c.newUpload(url, result())
+	}, repeatable)
 	if err != nil {
 		return err
 	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return errors.New(resp.Status)
 	}
@@ -102,30 +269,121 @@ func (c *Client) SetTaskReady(taskID string, result []byte) error {
 }
 
 func (c *Client) WaitTaskReady(taskID string, retries int, interval time.Duration) ([]byte, error) {
-	req, err := http.NewRequest("GET",
-		c.apiURL+"/task/result?taskid="+taskID,
-		nil)
+	body, err := c.WaitTaskReadyReader(taskID, retries, interval)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("X-API-KEY", c.apiKey)
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// WaitTaskReadyReader is WaitTaskReady returning the result as a stream,
+// the caller must close it.
+func (c *Client) WaitTaskReadyReader(taskID string, retries int, interval time.Duration) (io.ReadCloser, error) {
+	url := c.apiURL + "/task/result?taskid=" + taskID
 	for retry := 0; retry < retries; retry++ {
-		resp, err := http.DefaultClient.Do(req)
+		// a new request on every poll picks up a token set meanwhile
+		resp, err := c.do(func() (*http.Request, error) { return c.newGet(url) }, true)
 		if err != nil {
 			return nil, err
 		}
 		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
 			if resp.StatusCode == http.StatusNotFound {
 				time.Sleep(interval)
 				continue
 			}
 			return nil, errors.New(resp.Status)
 		}
-		result, err := ioutil.ReadAll(resp.Body)
+		return resp.Body, nil
+	}
+	return nil, ErrTaskNotReady
+}
+
+// do sends the request of newRequest and, if it is repeatable, sends a new
+// one after the Retry-After delay while the server answers 429 HTTP
+// StatusTooManyRequests, up to c.RateLimitRetries times.
+func (c *Client) do(newRequest func() (*http.Request, error), repeatable bool) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.httpClient.Do(req)
 		if err != nil {
 			return nil, err
 		}
-		return result, nil
+		if resp.StatusCode != http.StatusTooManyRequests || !repeatable || retry >= c.RateLimitRetries {
+			return resp, nil
+		}
+		resp.Body.Close()
+		time.Sleep(retryAfter(resp, time.Now()))
 	}
-	return nil, ErrTaskNotReady
+}
+
+// retryAfter returns the Retry-After delay of the response in seconds or as
+// a date, one second if it is not set.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if date.Before(now) {
+			return 0
+		}
+		return date.Sub(now)
+	}
+	return time.Second
+}
+
+// pollInterval returns the X-RETRY-AFTER-MS delay of an empty queue, the
+// queue dispatches no task before it, or interval if it is not set.
+func pollInterval(resp *http.Response, interval time.Duration) time.Duration {
+	ms, err := strconv.ParseInt(resp.Header.Get("X-RETRY-AFTER-MS"), 10, 64)
+	if err != nil || ms < 0 {
+		return interval
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// newGet creates the authorized GET request.
+func (c *Client) newGet(url string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req)
+	return req, nil
+}
+
+// newUpload creates the POST request with the body, gzip compressed if
+// c.Compress is set.
+func (c *Client) newUpload(url string, body io.Reader) (*http.Request, error) {
+	if !c.Compress {
+		req, err := http.NewRequest("POST", url, body)
+		if err != nil {
+			return nil, err
+		}
+		c.authorize(req)
+		return req, nil
+	}
+	r, w := io.Pipe()
+	req, err := http.NewRequest("POST", url, r)
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req)
+	req.Header.Set("Content-Encoding", "gzip")
+	// the transport closes r when the request is done, so the writer
+	// stops on failed requests too
+	go func() {
+		gw := gzip.NewWriter(w)
+		_, err := io.Copy(gw, body)
+		if err == nil {
+			err = gw.Close()
+		}
+		w.CloseWithError(err)
+	}()
+	return req, nil
 }
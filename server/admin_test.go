@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/memory"
+	"github.com/alexio777/stq/server/backends/middleware"
+)
+
+func adminRequest(t *testing.T, method string, url string, body []byte) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-API-KEY", "d6MrLT7MwlhtaoQu2b5lWFr")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+func Test_Admin(t *testing.T) {
+	source, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceAPI := httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", source).Handler)
+	defer sourceAPI.Close()
+	target, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetAPI := httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", target).Handler)
+	defer targetAPI.Close()
+
+	t.Run("Snapshot without snapshot file", func(t *testing.T) {
+		status, _ := adminRequest(t, "POST", sourceAPI.URL+"/admin/snapshot", nil)
+		if status != http.StatusNotImplemented {
+			t.Fatalf("unexpected status code: %d", status)
+		}
+	})
+	t.Run("Export and import", func(t *testing.T) {
+		taskID, err := source.Put(context.TODO(), "queue", "", []byte("payload_123"), time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, data := adminRequest(t, "GET", sourceAPI.URL+"/admin/export", nil)
+		if status != http.StatusOK {
+			t.Fatalf("unexpected status code: %d, body: %s", status, data)
+		}
+		status, body := adminRequest(t, "POST", targetAPI.URL+"/admin/import", data)
+		if status != http.StatusOK {
+			t.Fatalf("unexpected status code: %d, body: %s", status, body)
+		}
+		if string(body) != "1" {
+			t.Fatalf("imported count is not equal: %s != %s", body, "1")
+		}
+		workerTaskID, payload, err := target.GetNotReady(context.TODO(), "queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if workerTaskID != taskID || string(payload) != "payload_123" {
+			t.Fatalf("unexpected task: %s %s", workerTaskID, payload)
+		}
+		status, _ = adminRequest(t, "POST", targetAPI.URL+"/admin/import", []byte("broken"))
+		if status != http.StatusBadRequest {
+			t.Fatalf("unexpected status code: %d", status)
+		}
+	})
+	t.Run("Concurrency", func(t *testing.T) {
+		if status, _ := adminRequest(t, "GET", sourceAPI.URL+"/admin/concurrency", nil); status != http.StatusNotImplemented {
+			t.Fatalf("unexpected status code: %d", status)
+		}
+		api := httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", middleware.Concurrency(nil)(target)).Handler)
+		defer api.Close()
+		if status, body := adminRequest(t, "POST", api.URL+"/admin/concurrency?queue=fragile&limit=3", nil); status != http.StatusOK {
+			t.Fatalf("unexpected status code: %d, body: %s", status, body)
+		}
+		status, body := adminRequest(t, "GET", api.URL+"/admin/concurrency", nil)
+		if status != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", status)
+		}
+		var limits map[string]uint64
+		if err := json.Unmarshal(body, &limits); err != nil {
+			t.Fatal(err)
+		}
+		if limits["fragile"] != 3 {
+			t.Fatalf("limit is not equal: %d != %d", limits["fragile"], 3)
+		}
+		status, body = adminRequest(t, "GET", api.URL+"/stats", nil)
+		if status != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", status)
+		}
+		var stats map[string]backends.QueueStats
+		if err := json.Unmarshal(body, &stats); err != nil {
+			t.Fatal(err)
+		}
+		if stats["fragile"].WorkLimit != 3 {
+			t.Fatalf("limit is not in stats: %+v", stats["fragile"])
+		}
+		if status, _ := adminRequest(t, "POST", api.URL+"/admin/concurrency?queue=fragile&limit=many", nil); status != http.StatusBadRequest {
+			t.Fatalf("unexpected status code: %d", status)
+		}
+	})
+	t.Run("Pause and resume", func(t *testing.T) {
+		if status, body := adminRequest(t, "POST", sourceAPI.URL+"/admin/pause?queue=paused", nil); status != http.StatusOK {
+			t.Fatalf("unexpected status code: %d, body: %s", status, body)
+		}
+		if status, body := adminRequest(t, "POST", sourceAPI.URL+"/task?queue=paused&timeout=60", []byte("payload_123")); status != http.StatusOK {
+			t.Fatalf("unexpected status code: %d, body: %s", status, body)
+		}
+		if status, _ := adminRequest(t, "GET", sourceAPI.URL+"/task/worker?queue=paused", nil); status != http.StatusNotFound {
+			t.Fatalf("unexpected status code: %d", status)
+		}
+		status, body := adminRequest(t, "GET", sourceAPI.URL+"/stats", nil)
+		if status != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", status)
+		}
+		var stats map[string]backends.QueueStats
+		if err := json.Unmarshal(body, &stats); err != nil {
+			t.Fatal(err)
+		}
+		if !stats["paused"].Paused || stats["paused"].WaitLength != 1 {
+			t.Fatalf("pause is not in stats: %+v", stats["paused"])
+		}
+		if status, body := adminRequest(t, "POST", sourceAPI.URL+"/admin/resume?queue=paused", nil); status != http.StatusOK {
+			t.Fatalf("unexpected status code: %d, body: %s", status, body)
+		}
+		status, body = adminRequest(t, "GET", sourceAPI.URL+"/task/worker?queue=paused", nil)
+		if status != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", status)
+		}
+		if string(body) != "payload_123" {
+			t.Fatalf("payload is not equal: %s != %s", body, "payload_123")
+		}
+		if status, _ := adminRequest(t, "POST", sourceAPI.URL+"/admin/pause", nil); status != http.StatusBadRequest {
+			t.Fatalf("unexpected status code: %d", status)
+		}
+	})
+	t.Run("Reencrypt without encryption", func(t *testing.T) {
+		status, _ := adminRequest(t, "POST", sourceAPI.URL+"/admin/reencrypt", nil)
+		if status != http.StatusNotImplemented {
+			t.Fatalf("unexpected status code: %d", status)
+		}
+	})
+	t.Run("Reencrypt", func(t *testing.T) {
+		oldKeys, err := middleware.NewKeys(map[string][]byte{"old": bytes.Repeat([]byte("o"), 32)}, "old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := middleware.NewKeys(map[string][]byte{
+			"old": bytes.Repeat([]byte("o"), 32),
+			"new": bytes.Repeat([]byte("n"), 32),
+		}, "new")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := middleware.Encrypt(oldKeys)(target).Put(context.TODO(), "encrypted", "", []byte("payload_456"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		api := httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", middleware.Encrypt(keys)(target)).Handler)
+		defer api.Close()
+		status, body := adminRequest(t, "POST", api.URL+"/admin/reencrypt", nil)
+		if status != http.StatusOK {
+			t.Fatalf("unexpected status code: %d, body: %s", status, body)
+		}
+		if string(body) != "1" {
+			t.Fatalf("reencrypted count is not equal: %s != %s", body, "1")
+		}
+		if status, body = adminRequest(t, "POST", api.URL+"/admin/reencrypt", nil); string(body) != "0" {
+			t.Fatalf("reencrypted count is not equal: %s != %s", body, "0")
+		}
+	})
+}
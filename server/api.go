@@ -1,12 +1,18 @@
 package main
 
 import (
-	"io/ioutil"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/export"
+	"github.com/alexio777/stq/server/backends/middleware"
+	"github.com/alexio777/stq/server/token"
 )
 
 func checkAPIKey(r *http.Request, apiKey string) bool {
@@ -16,13 +22,69 @@ func checkAPIKey(r *http.Request, apiKey string) bool {
 	return r.Header.Get("X-API-KEY") == apiKey
 }
 
-func createAPI(apiKey string, backend backends.Backend) *http.Server {
+type taskStatus struct {
+	ID    string
+	Queue string
+	State backends.TaskState
+	Error string `json:",omitempty"`
+}
+
+type compressionStats struct {
+	Algorithm string
+	middleware.CompressionStats
+	Ratio float64
+}
+
+func createAPI(apiKey string, backend backends.Backend, optionList ...apiOption) *http.Server {
+	options := &apiOptions{}
+	for _, option := range optionList {
+		option(options)
+	}
+	// authorize answers 401 HTTP StatusUnauthorized to unknown keys and 403
+	// HTTP StatusForbidden to keys without the role
+	authorize := func(rw http.ResponseWriter, r *http.Request, role string) (*grant, bool) {
+		key, ok := options.authenticate(r, apiKey)
+		if !ok {
+			http.Error(rw, "invalid API key", http.StatusUnauthorized)
+			return nil, false
+		}
+		if !key.hasRole(role) {
+			http.Error(rw, "API key has no "+role+" role", http.StatusForbidden)
+			return nil, false
+		}
+		return key, true
+	}
+	authorizeTask := func(rw http.ResponseWriter, r *http.Request, key *grant, role string, taskID string) bool {
+		ok, err := key.allowsTask(r.Context(), backend, role, taskID)
+		if errors.Is(err, backends.ErrTaskNotFound) {
+			http.Error(rw, "", http.StatusNotFound)
+			return false
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		if !ok {
+			http.Error(rw, "API key has no access to the queue", http.StatusForbidden)
+		}
+		return ok
+	}
+	// authorizeAdmin answers 403 HTTP StatusForbidden to tenant admins too
+	authorizeAdmin := func(rw http.ResponseWriter, r *http.Request) bool {
+		key, ok := authorize(rw, r, roleAdmin)
+		if ok && key.tenant != "" {
+			http.Error(rw, "API key of a tenant", http.StatusForbidden)
+			return false
+		}
+		return ok
+	}
 	mux := http.NewServeMux()
-	// POST /task?queue=queuename&timeout=seconds and payload in body
+	// POST /task?queue=queuename&timeout=seconds&group=groupname and payload
+	// in body, group is optional
 	// return task id
 	mux.HandleFunc("/task", func(rw http.ResponseWriter, r *http.Request) {
-		if !checkAPIKey(r, apiKey) {
-			http.Error(rw, "invalid API key", http.StatusUnauthorized)
+		key, ok := authorize(rw, r, roleEnqueue)
+		if !ok {
 			return
 		}
 		if r.Method != "POST" {
@@ -34,28 +96,69 @@ func createAPI(apiKey string, backend backends.Backend) *http.Server {
 			http.Error(rw, "queue is empty", http.StatusBadRequest)
 			return
 		}
+		if !key.allows(roleEnqueue, queue) {
+			http.Error(rw, "API key has no access to the queue", http.StatusForbidden)
+			return
+		}
+		if !options.allowRate(rw, key, roleEnqueue, key.backendQueue(queue)) {
+			return
+		}
 		timeout, err := strconv.Atoi(r.URL.Query().Get("timeout"))
 		if err != nil {
 			http.Error(rw, "timeout is empty", http.StatusBadRequest)
 			return
 		}
-		payload, err := ioutil.ReadAll(r.Body)
+		maxSize := options.maxBodySize
+		// the payload is limited by the tenant payload bytes left
+		tenantLimited := false
+		if options.limits != nil && key.tenant != "" {
+			left, err := options.limits.check(r.Context(), backend, key, queue)
+			if err != nil {
+				status := http.StatusInternalServerError
+				if errors.Is(err, errTenantLimit) {
+					status = http.StatusTooManyRequests
+				}
+				http.Error(rw, err.Error(), status)
+				return
+			}
+			if left > 0 && (maxSize == 0 || left < maxSize) {
+				maxSize = left
+				tenantLimited = true
+			}
+		}
+		payload, err := options.readBody(r, maxSize)
 		if err != nil {
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+			if tenantLimited && errors.Is(err, errBodyTooLarge) {
+				http.Error(rw, fmt.Sprintf("%s: payload bytes", errTenantLimit), http.StatusTooManyRequests)
+				return
+			}
+			bodyError(rw, err)
 			return
 		}
-		taskID, err := backend.Put(queue, []byte(payload), time.Second*time.Duration(timeout))
+		group := r.URL.Query().Get("group")
+		taskID, err := backend.Put(r.Context(), key.backendQueue(queue), group, []byte(payload), time.Second*time.Duration(timeout))
 		if err != nil {
+			if errors.Is(err, backends.ErrQueueFull) {
+				// producers slow down until workers take tasks
+				rw.Header().Set("Retry-After", "1")
+				http.Error(rw, err.Error(), http.StatusTooManyRequests)
+				return
+			}
+			if errors.Is(err, backends.ErrQueueStorageFull) {
+				http.Error(rw, err.Error(), http.StatusInsufficientStorage)
+				return
+			}
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		rw.Write([]byte(taskID))
 	})
 	// GET /task/worker?queue=queuename
-	// return X-TASK-ID in header and payload in body
+	// return X-TASK-ID in header and payload in body, waits for the dispatch
+	// rate of the queue, 404 with X-RETRY-AFTER-MS if the wait is too long
 	mux.HandleFunc("/task/worker", func(rw http.ResponseWriter, r *http.Request) {
-		if !checkAPIKey(r, apiKey) {
-			http.Error(rw, "invalid API key", http.StatusUnauthorized)
+		key, ok := authorize(rw, r, roleConsume)
+		if !ok {
 			return
 		}
 		if r.Method != "GET" {
@@ -67,9 +170,21 @@ func createAPI(apiKey string, backend backends.Backend) *http.Server {
 			http.Error(rw, "queue is empty", http.StatusBadRequest)
 			return
 		}
-		taskID, payload, err := backend.GetNotReady(queue)
+		if !key.allows(roleConsume, queue) {
+			http.Error(rw, "API key has no access to the queue", http.StatusForbidden)
+			return
+		}
+		if !options.allowRate(rw, key, roleConsume, key.backendQueue(queue)) {
+			return
+		}
+		taskID, payload, err := backend.GetNotReady(r.Context(), key.backendQueue(queue))
 		if err != nil {
-			if err == backends.ErrQueueNotFound {
+			if errors.Is(err, backends.ErrQueueNotFound) {
+				// workers come back when the queue may dispatch again
+				var retry *backends.RetryError
+				if errors.As(err, &retry) {
+					rw.Header().Set("X-RETRY-AFTER-MS", strconv.FormatInt(retry.RetryAfter.Milliseconds()+1, 10))
+				}
 				http.Error(rw, "", http.StatusNotFound)
 				return
 			}
@@ -77,12 +192,14 @@ func createAPI(apiKey string, backend backends.Backend) *http.Server {
 			return
 		}
 		rw.Header().Set("X-TASK-ID", taskID)
-		rw.Write(payload)
+		// the payload blob is kept until the task is done, the task may be
+		// dispatched again
+		options.writeBody(rw, r, payload)
 	})
 	// POST /task/ready taskid in query and payload in body
 	mux.HandleFunc("/task/ready", func(rw http.ResponseWriter, r *http.Request) {
-		if !checkAPIKey(r, apiKey) {
-			http.Error(rw, "invalid API key", http.StatusUnauthorized)
+		key, ok := authorize(rw, r, roleConsume)
+		if !ok {
 			return
 		}
 		if r.Method != "POST" {
@@ -94,12 +211,15 @@ func createAPI(apiKey string, backend backends.Backend) *http.Server {
 			http.Error(rw, "task id is empty", http.StatusBadRequest)
 			return
 		}
-		result, err := ioutil.ReadAll(r.Body)
+		if !authorizeTask(rw, r, key, roleConsume, taskID) {
+			return
+		}
+		result, err := options.readBody(r, options.maxBodySize)
 		if err != nil {
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+			bodyError(rw, err)
 			return
 		}
-		err = backend.TaskReady(taskID, result)
+		err = backend.TaskReady(r.Context(), taskID, result)
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
@@ -107,8 +227,8 @@ func createAPI(apiKey string, backend backends.Backend) *http.Server {
 	})
 	// GET /task/result?taskid=taskid
 	mux.HandleFunc("/task/result", func(rw http.ResponseWriter, r *http.Request) {
-		if !checkAPIKey(r, apiKey) {
-			http.Error(rw, "invalid API key", http.StatusUnauthorized)
+		key, ok := authorize(rw, r, roleResults)
+		if !ok {
 			return
 		}
 		if r.Method != "GET" {
@@ -120,39 +240,382 @@ func createAPI(apiKey string, backend backends.Backend) *http.Server {
 			http.Error(rw, "task id is empty", http.StatusBadRequest)
 			return
 		}
-		result, err := backend.GetReady(taskID)
+		if !authorizeTask(rw, r, key, roleResults, taskID) {
+			return
+		}
+		payload := options.taskPayload(r.Context(), backend, taskID)
+		result, err := backend.GetReady(r.Context(), taskID)
 		if err != nil {
-			if err == backends.ErrTaskNotFoundOrNotReady {
+			if errors.Is(err, backends.ErrTaskNotFoundOrNotReady) {
 				http.Error(rw, "", http.StatusNotFound)
 				return
 			}
-			if err == backends.ErrTaskExecutionTimeout {
+			if errors.Is(err, backends.ErrTaskExecutionTimeout) {
+				// the task is done
+				options.deleteBlob(payload)
 				http.Error(rw, "", http.StatusRequestTimeout)
 				return
 			}
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		rw.Write(result)
+		// the result is returned once, the task is done
+		defer options.deleteBlob(payload)
+		defer options.deleteBlob(result)
+		options.writeBody(rw, r, result)
+	})
+	// GET /task/status?taskid=taskid
+	// return task state in json
+	mux.HandleFunc("/task/status", func(rw http.ResponseWriter, r *http.Request) {
+		key, ok := authorize(rw, r, roleResults)
+		if !ok {
+			return
+		}
+		if r.Method != "GET" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		taskID := r.URL.Query().Get("taskid")
+		if taskID == "" {
+			http.Error(rw, "task id is empty", http.StatusBadRequest)
+			return
+		}
+		if !authorizeTask(rw, r, key, roleResults, taskID) {
+			return
+		}
+		var inspector backends.Inspector
+		if !backends.As(backend, &inspector) {
+			http.Error(rw, "backend has no task lookup", http.StatusNotImplemented)
+			return
+		}
+		task, err := inspector.Task(r.Context(), taskID)
+		if err != nil {
+			if errors.Is(err, backends.ErrTaskNotFound) {
+				http.Error(rw, "", http.StatusNotFound)
+				return
+			}
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// the task is of the tenant, authorizeTask checks it
+		queue, _ := key.clientQueue(task.Queue)
+		status := taskStatus{ID: task.ID, Queue: queue, State: task.State}
+		if task.Error != nil {
+			status.Error = task.Error.Error()
+		}
+		data, err := json.Marshal(status)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Write(data)
 	})
 	// GET /stats
-	// return stats json object
+	// return stats json object, of the tenant queues for tenants
 	mux.HandleFunc("/stats", func(rw http.ResponseWriter, r *http.Request) {
-		if !checkAPIKey(r, apiKey) {
-			http.Error(rw, "invalid API key", http.StatusUnauthorized)
+		key, ok := authorize(rw, r, roleAdmin)
+		if !ok {
 			return
 		}
 		if r.Method != "GET" {
 			rw.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		stats, err := backend.Stats()
+		stats, err := backend.Stats(r.Context())
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data, err := json.MarshalIndent(key.clientStats(stats), "", "  ")
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		rw.Write(stats)
+		rw.Write(data)
+	})
+	// GET /stats/compression
+	// return payload and result compression stats json object if the gzip
+	// middleware is on
+	if _, ok := middleware.CompressionOf(backend); ok {
+		mux.HandleFunc("/stats/compression", func(rw http.ResponseWriter, r *http.Request) {
+			if !authorizeAdmin(rw, r) {
+				return
+			}
+			if r.Method != "GET" {
+				rw.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			stats, _ := middleware.CompressionOf(backend)
+			data, err := json.MarshalIndent(compressionStats{
+				Algorithm:        "gzip",
+				CompressionStats: stats,
+				Ratio:            stats.Ratio(),
+			}, "", "  ")
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			rw.Write(data)
+		})
+	}
+	// POST /admin/snapshot
+	// save backend snapshot, 501 if the backend has no snapshots
+	mux.HandleFunc("/admin/snapshot", func(rw http.ResponseWriter, r *http.Request) {
+		if !authorizeAdmin(rw, r) {
+			return
+		}
+		if r.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var snapshotter backends.Snapshotter
+		if !backends.As(backend, &snapshotter) {
+			http.Error(rw, "backend has no snapshots", http.StatusNotImplemented)
+			return
+		}
+		if err := snapshotter.Snapshot(r.Context()); err != nil {
+			if errors.Is(err, backends.ErrSnapshotsOff) {
+				http.Error(rw, err.Error(), http.StatusNotImplemented)
+				return
+			}
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	})
+	// GET /admin/export
+	// stream all tasks in the export format
+	mux.HandleFunc("/admin/export", func(rw http.ResponseWriter, r *http.Request) {
+		if !authorizeAdmin(rw, r) {
+			return
+		}
+		if r.Method != "GET" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var exporter backends.Exporter
+		if !backends.As(backend, &exporter) {
+			http.Error(rw, "backend has no export", http.StatusNotImplemented)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+		if _, err := export.Write(r.Context(), rw, exporter); err != nil {
+			// the status is sent already, break the response
+			log.Println("export:", err)
+			panic(http.ErrAbortHandler)
+		}
+	})
+	// POST /admin/import and tasks in the export format in body
+	// return imported tasks count
+	mux.HandleFunc("/admin/import", func(rw http.ResponseWriter, r *http.Request) {
+		if !authorizeAdmin(rw, r) {
+			return
+		}
+		if r.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var importer backends.Importer
+		if !backends.As(backend, &importer) {
+			http.Error(rw, "backend has no import", http.StatusNotImplemented)
+			return
+		}
+		count, err := export.Read(r.Context(), r.Body, importer)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, export.ErrInvalidFormat) {
+				status = http.StatusBadRequest
+			}
+			if errors.Is(err, backends.ErrTaskExists) {
+				status = http.StatusConflict
+			}
+			http.Error(rw, fmt.Sprintf("imported %d: %s", count, err), status)
+			return
+		}
+		rw.Write([]byte(strconv.Itoa(count)))
+	})
+	// GET /admin/concurrency
+	// return running task limits of queues in json
+	// POST /admin/concurrency?queue=queuename&limit=N
+	// limit running tasks of the queue, zero removes the limit
+	mux.HandleFunc("/admin/concurrency", func(rw http.ResponseWriter, r *http.Request) {
+		if !authorizeAdmin(rw, r) {
+			return
+		}
+		var limiter middleware.ConcurrencyLimiter
+		if !backends.As(backend, &limiter) {
+			http.Error(rw, "concurrency limits are off", http.StatusNotImplemented)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			data, err := json.MarshalIndent(limiter.Concurrency(), "", "  ")
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			rw.Write(data)
+		case "POST":
+			queue := r.URL.Query().Get("queue")
+			if queue == "" {
+				http.Error(rw, "queue is empty", http.StatusBadRequest)
+				return
+			}
+			limit, err := strconv.ParseUint(r.URL.Query().Get("limit"), 10, 64)
+			if err != nil {
+				http.Error(rw, "limit is not a number", http.StatusBadRequest)
+				return
+			}
+			limiter.SetConcurrency(queue, limit)
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	// GET /admin/dispatch-rate
+	// return dispatch rates of queues in json
+	// POST /admin/dispatch-rate?queue=queuename&rate=10/s
+	// limit dispatches of the queue, rate 0 removes the limit
+	mux.HandleFunc("/admin/dispatch-rate", func(rw http.ResponseWriter, r *http.Request) {
+		if !authorizeAdmin(rw, r) {
+			return
+		}
+		var limiter middleware.DispatchRateLimiter
+		if !backends.As(backend, &limiter) {
+			http.Error(rw, "dispatch rate limits are off", http.StatusNotImplemented)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			data, err := json.MarshalIndent(limiter.DispatchRates(), "", "  ")
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			rw.Write(data)
+		case "POST":
+			queue := r.URL.Query().Get("queue")
+			if queue == "" {
+				http.Error(rw, "queue is empty", http.StatusBadRequest)
+				return
+			}
+			rate, err := middleware.ParseRate(r.URL.Query().Get("rate"))
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			limiter.SetDispatchRate(queue, rate)
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	setPaused := func(paused bool) http.HandlerFunc {
+		return func(rw http.ResponseWriter, r *http.Request) {
+			if !authorizeAdmin(rw, r) {
+				return
+			}
+			if r.Method != "POST" {
+				rw.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			queue := r.URL.Query().Get("queue")
+			if queue == "" {
+				http.Error(rw, "queue is empty", http.StatusBadRequest)
+				return
+			}
+			var pauser backends.Pauser
+			if !backends.As(backend, &pauser) {
+				http.Error(rw, "backend has no pause", http.StatusNotImplemented)
+				return
+			}
+			if err := pauser.SetPaused(r.Context(), queue, paused); err != nil {
+				status := http.StatusInternalServerError
+				if errors.Is(err, backends.ErrNotSupported) {
+					status = http.StatusNotImplemented
+				}
+				http.Error(rw, err.Error(), status)
+				return
+			}
+		}
+	}
+	// POST /admin/pause?queue=queuename
+	// stop dispatch of the queue, tasks are still added
+	mux.HandleFunc("/admin/pause", setPaused(true))
+	// POST /admin/resume?queue=queuename
+	// resume dispatch of the queue
+	mux.HandleFunc("/admin/resume", setPaused(false))
+	// POST /admin/reencrypt
+	// rewrite tasks encrypted with old keys, return rewritten tasks count,
+	// blobs are not rewritten
+	mux.HandleFunc("/admin/reencrypt", func(rw http.ResponseWriter, r *http.Request) {
+		if !authorizeAdmin(rw, r) {
+			return
+		}
+		if r.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var reencrypter middleware.Reencrypter
+		if !backends.As(backend, &reencrypter) {
+			http.Error(rw, "encryption is off", http.StatusNotImplemented)
+			return
+		}
+		count, err := reencrypter.Reencrypt(r.Context())
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, backends.ErrNotSupported) {
+				status = http.StatusNotImplemented
+			}
+			http.Error(rw, fmt.Sprintf("reencrypted %d: %s", count, err), status)
+			return
+		}
+		rw.Write([]byte(strconv.Itoa(count)))
 	})
+	// POST /admin/token and token request json in body
+	// return a bearer token signed with the token signing key
+	if options.tokens != nil {
+		mux.HandleFunc("/admin/token", func(rw http.ResponseWriter, r *http.Request) {
+			if !authorizeAdmin(rw, r) {
+				return
+			}
+			if r.Method != "POST" {
+				rw.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			var request tokenRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			claims, err := request.claims(time.Now())
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			signed, err := options.tokens.get().Sign(*claims)
+			if err != nil {
+				status := http.StatusInternalServerError
+				if errors.Is(err, token.ErrNoSigningKey) {
+					status = http.StatusNotImplemented
+				}
+				http.Error(rw, err.Error(), status)
+				return
+			}
+			rw.Write([]byte(signed))
+		})
+	}
+	// GET /metrics
+	// return backend metrics if the metrics middleware is on
+	if metrics := middleware.MetricsOf(backend); metrics != nil {
+		mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+			if !authorizeAdmin(rw, r) {
+				return
+			}
+			if r.Method != "GET" {
+				rw.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			metrics.ServeHTTP(rw, r)
+		})
+	}
 	server := &http.Server{Handler: mux}
 	return server
 }
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -32,6 +33,8 @@ func Test_API(t *testing.T) {
 		if err := api.Shutdown(context.TODO()); err != nil {
 			log.Println(err)
 		}
+		// drop keep-alive connections to the closed server
+		http.DefaultClient.CloseIdleConnections()
 	}()
 	t.Run("Test API flow", func(t *testing.T) {
 		// add task
@@ -147,7 +150,7 @@ func Test_API(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		var stats map[string]backends.Stats
+		var stats map[string]backends.QueueStats
 		err = json.Unmarshal(data, &stats)
 		if err != nil {
 			t.Fatal(err)
@@ -157,3 +160,25 @@ func Test_API(t *testing.T) {
 		}
 	})
 }
+
+func Test_QueueLimits(t *testing.T) {
+	backend, err := memory.New(memory.WithQueueLimit("", memory.QueueLimit{MaxLength: 1, MaxBytes: 8}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", backend).Handler)
+	defer server.Close()
+	for _, test := range []struct {
+		queue   string
+		payload string
+		status  int
+	}{
+		{"queue", "payload", http.StatusOK},
+		{"queue", "payload", http.StatusTooManyRequests},
+		{"other", "large payload", http.StatusInsufficientStorage},
+	} {
+		if status := keyRequest(t, "d6MrLT7MwlhtaoQu2b5lWFr", "POST", server.URL+"/task?queue="+test.queue+"&timeout=15", []byte(test.payload)); status != test.status {
+			t.Fatalf("status code is not equal: %d != %d", status, test.status)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/token"
+)
+
+// API key roles.
+const (
+	roleEnqueue = "enqueue"
+	roleConsume = "consume"
+	roleResults = "read-results"
+	// admin allows everything, tenant admins see the tenant stats only
+	roleAdmin = "admin"
+)
+
+// grant is what an API key allows.
+type grant struct {
+	roles map[string]bool
+	// queue names and prefixes ending with "*", nil allows all queues
+	queues []string
+	// queues of the tenant are in its namespace, see backendQueue
+	tenant string
+	// the key, token subject or certificate common name in rate limits
+	name string
+}
+
+// fullGrant is the grant of APIKEY.
+var fullGrant = &grant{roles: map[string]bool{roleAdmin: true}}
+
+func (g *grant) hasRole(role string) bool {
+	return g.roles[role] || g.roles[roleAdmin]
+}
+
+// validRole reports whether the role is known.
+func validRole(role string) bool {
+	switch role {
+	case roleEnqueue, roleConsume, roleResults, roleAdmin:
+		return true
+	}
+	return false
+}
+
+// allows reports whether the grant has the role on the queue the client
+// sees.
+func (g *grant) allows(role string, queue string) bool {
+	if !g.hasRole(role) {
+		return false
+	}
+	if g.queues == nil {
+		return true
+	}
+	for _, pattern := range g.queues {
+		if pattern == queue || strings.HasSuffix(pattern, "*") && strings.HasPrefix(queue, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsTask reports whether the grant has the role on the queue of the
+// task, tasks of other tenants are not found. The queue is looked up only
+// for grants limited to some queues or a tenant, they are refused if the
+// backend has no task lookup.
+func (g *grant) allowsTask(ctx context.Context, backend backends.Backend, role string, taskID string) (bool, error) {
+	if !g.hasRole(role) {
+		return false, nil
+	}
+	if g.queues == nil && g.tenant == "" {
+		return true, nil
+	}
+	var inspector backends.Inspector
+	if !backends.As(backend, &inspector) {
+		return false, nil
+	}
+	task, err := inspector.Task(ctx, taskID)
+	if errors.Is(err, backends.ErrTaskNotFound) {
+		// the call fails with not found anyway
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	queue, ok := g.clientQueue(task.Queue)
+	if !ok {
+		return false, backends.TaskError("task", taskID, backends.ErrTaskNotFound)
+	}
+	return g.allows(role, queue), nil
+}
+
+// apiKeys are API keys with roles loaded from a file, see loadAPIKeys.
+type apiKeys struct {
+	path   string
+	mutex  sync.RWMutex
+	grants map[string]*grant
+}
+
+func newAPIKeys(path string) (*apiKeys, error) {
+	k := &apiKeys{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reads the keys file again, the keys are kept if it fails.
+func (k *apiKeys) Reload() error {
+	grants, err := loadAPIKeys(k.path)
+	if err != nil {
+		return err
+	}
+	k.mutex.Lock()
+	k.grants = grants
+	k.mutex.Unlock()
+	return nil
+}
+
+func (k *apiKeys) lookup(key string) (*grant, bool) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	g, ok := k.grants[key]
+	return g, ok
+}
+
+// loadAPIKeys reads a key per line, the key, comma separated roles,
+// optional comma separated queues ("*" for all) and an optional tenant:
+//
+//	# key      roles                 queues            tenant
+//	producer   enqueue,read-results  orders,reports.*
+//	worker     consume               orders
+//	acme       consume               *                 acme
+//	ops        admin
+func loadAPIKeys(path string) (map[string]*grant, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	grants := make(map[string]*grant)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, fmt.Errorf("%s:%d: expected key, roles, optional queues and tenant", path, line)
+		}
+		g := &grant{roles: make(map[string]bool), name: fields[0]}
+		for _, role := range strings.Split(fields[1], ",") {
+			if !validRole(role) {
+				return nil, fmt.Errorf("%s:%d: unknown role %q", path, line, role)
+			}
+			g.roles[role] = true
+		}
+		if len(fields) >= 3 && fields[2] != "*" {
+			g.queues = strings.Split(fields[2], ",")
+		}
+		if len(fields) == 4 {
+			if !validTenant(fields[3]) {
+				return nil, fmt.Errorf("%s:%d: invalid tenant %q", path, line, fields[3])
+			}
+			g.tenant = fields[3]
+		}
+		grants[fields[0]] = g
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// tokenKeys are bearer token keys loaded from a file, see token.LoadKeys.
+type tokenKeys struct {
+	path  string
+	mutex sync.RWMutex
+	keys  *token.Keys
+}
+
+func newTokenKeys(path string) (*tokenKeys, error) {
+	k := &tokenKeys{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reads the keys file again, the keys are kept if it fails.
+func (k *tokenKeys) Reload() error {
+	keys, err := token.LoadKeys(k.path)
+	if err != nil {
+		return err
+	}
+	k.mutex.Lock()
+	k.keys = keys
+	k.mutex.Unlock()
+	return nil
+}
+
+func (k *tokenKeys) get() *token.Keys {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.keys
+}
+
+// verify returns the grant of the bearer token.
+func (k *tokenKeys) verify(bearer string) (*grant, bool) {
+	claims, err := k.get().Verify(bearer, time.Now())
+	if err != nil || claims.Tenant != "" && !validTenant(claims.Tenant) {
+		return nil, false
+	}
+	g := &grant{roles: make(map[string]bool), queues: claims.Queues, tenant: claims.Tenant, name: claims.Subject}
+	for _, role := range claims.Roles {
+		g.roles[role] = true
+	}
+	return g, true
+}
+
+// maxTokenTTL limits the lifetime of minted tokens.
+const maxTokenTTL = 24 * time.Hour
+
+// tokenRequest is the body of POST /admin/token, TTL is a duration like
+// "15m", one hour if empty.
+type tokenRequest struct {
+	Subject string
+	Roles   []string
+	Queues  []string
+	Tenant  string
+	TTL     string
+}
+
+func (t *tokenRequest) claims(now time.Time) (*token.Claims, error) {
+	if len(t.Roles) == 0 {
+		return nil, errors.New("roles are empty")
+	}
+	for _, role := range t.Roles {
+		if !validRole(role) {
+			return nil, fmt.Errorf("unknown role %q", role)
+		}
+		// admin calls are not limited to queues
+		if role == roleAdmin && len(t.Queues) > 0 {
+			return nil, errors.New("admin role can not be limited to queues")
+		}
+	}
+	if t.Tenant != "" && !validTenant(t.Tenant) {
+		return nil, fmt.Errorf("invalid tenant %q", t.Tenant)
+	}
+	ttl := time.Hour
+	if t.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(t.TTL); err != nil {
+			return nil, err
+		}
+	}
+	if ttl <= 0 || ttl > maxTokenTTL {
+		return nil, fmt.Errorf("TTL must be positive and at most %s", maxTokenTTL)
+	}
+	return &token.Claims{
+		Subject:   t.Subject,
+		Roles:     t.Roles,
+		Queues:    t.Queues,
+		Tenant:    t.Tenant,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}, nil
+}
+
+// withTokens accepts bearer tokens signed with the keys.
+func withTokens(keys *tokenKeys) apiOption {
+	return func(o *apiOptions) {
+		o.tokens = keys
+	}
+}
+
+// withAPIKeys accepts the keys besides APIKEY.
+func withAPIKeys(keys *apiKeys) apiOption {
+	return func(o *apiOptions) {
+		o.keys = keys
+	}
+}
+
+// authenticate returns the grant of the request bearer token, client
+// certificate or API key, APIKEY allows everything.
+func (o *apiOptions) authenticate(r *http.Request, apiKey string) (*grant, bool) {
+	if authorization := r.Header.Get("Authorization"); o.tokens != nil && strings.HasPrefix(authorization, "Bearer ") {
+		return o.tokens.verify(strings.TrimPrefix(authorization, "Bearer "))
+	}
+	// only verified certificates are in the chains
+	if o.certs != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if g, ok := o.certs.lookup(r.TLS.VerifiedChains[0][0].Subject.CommonName); ok {
+			return g, true
+		}
+	}
+	if o.keys == nil {
+		if !checkAPIKey(r, apiKey) {
+			return nil, false
+		}
+		return fullGrant, true
+	}
+	key := r.Header.Get("X-API-KEY")
+	if apiKey != "" && key == apiKey {
+		return fullGrant, true
+	}
+	return o.keys.lookup(key)
+}
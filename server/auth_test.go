@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/client"
+	"github.com/alexio777/stq/server/backends/memory"
+)
+
+func keyRequest(t *testing.T, key string, method string, url string, body []byte) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-API-KEY", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func Test_APIKeys(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := ioutil.WriteFile(path, []byte(`# key roles queues
+producer enqueue,read-results orders.*
+worker   consume              orders.*
+ops      admin
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := newAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", backend, withAPIKeys(keys)).Handler)
+	defer server.Close()
+
+	for _, test := range []struct {
+		name   string
+		key    string
+		method string
+		path   string
+		status int
+	}{
+		{"Unknown key", "unknown", "POST", "/task?queue=orders.1&timeout=15", http.StatusUnauthorized},
+		{"Enqueue", "producer", "POST", "/task?queue=orders.1&timeout=15", http.StatusOK},
+		{"Enqueue to other queue", "producer", "POST", "/task?queue=invoices&timeout=15", http.StatusForbidden},
+		{"Enqueue without role", "worker", "POST", "/task?queue=orders.1&timeout=15", http.StatusForbidden},
+		{"Consume without role", "producer", "GET", "/task/worker?queue=orders.1", http.StatusForbidden},
+		{"Consume", "worker", "GET", "/task/worker?queue=orders.1", http.StatusOK},
+		{"Ready", "worker", "POST", "/task/ready?taskid=1", http.StatusOK},
+		{"Status without role", "worker", "GET", "/task/status?taskid=1", http.StatusForbidden},
+		{"Status", "producer", "GET", "/task/status?taskid=1", http.StatusOK},
+		{"Result without role", "worker", "GET", "/task/result?taskid=1", http.StatusForbidden},
+		{"Result", "producer", "GET", "/task/result?taskid=1", http.StatusOK},
+		{"Stats without role", "producer", "GET", "/stats", http.StatusForbidden},
+		{"Stats", "ops", "GET", "/stats", http.StatusOK},
+		{"Stats with APIKEY", "d6MrLT7MwlhtaoQu2b5lWFr", "GET", "/stats", http.StatusOK},
+		{"Admin enqueue", "ops", "POST", "/task?queue=invoices&timeout=15", http.StatusOK},
+		{"Result of other queue", "producer", "GET", "/task/result?taskid=2", http.StatusForbidden},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if status := keyRequest(t, test.key, test.method, server.URL+test.path, nil); status != test.status {
+				t.Fatalf("status code is not equal: %d != %d", status, test.status)
+			}
+		})
+	}
+
+	t.Run("Reload", func(t *testing.T) {
+		if err := ioutil.WriteFile(path, []byte("producer enqueue\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := keys.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		if status := keyRequest(t, "producer", "POST", server.URL+"/task?queue=invoices&timeout=15", nil); status != http.StatusOK {
+			t.Fatalf("status code is not equal: %d != %d", status, http.StatusOK)
+		}
+		if status := keyRequest(t, "worker", "GET", server.URL+"/task/worker?queue=orders.1", nil); status != http.StatusUnauthorized {
+			t.Fatalf("status code is not equal: %d != %d", status, http.StatusUnauthorized)
+		}
+		if err := ioutil.WriteFile(path, []byte("producer unknown-role\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := keys.Reload(); err == nil {
+			t.Fatal("unknown role is not detected")
+		}
+		if status := keyRequest(t, "producer", "POST", server.URL+"/task?queue=invoices&timeout=15", nil); status != http.StatusOK {
+			t.Fatalf("keys are not kept: %d != %d", status, http.StatusOK)
+		}
+	})
+}
+
+func Test_Tokens(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := ioutil.WriteFile(path, []byte("key HS256 "+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("s"), 32))+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := newTokenKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", backend, withTokens(keys)).Handler)
+	defer server.Close()
+	admin := client.New(server.URL, "d6MrLT7MwlhtaoQu2b5lWFr")
+	for _, queue := range []string{"acme/orders", "other/orders"} {
+		if _, err := admin.AddTask(queue, 15, []byte("payload")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	workerToken, err := admin.MintToken(client.TokenRequest{Roles: []string{"consume"}, Tenant: "acme", TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker := client.New(server.URL, "")
+	worker.SetToken(workerToken)
+	if _, _, err := worker.WaitWorkerTask("orders", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := worker.WaitWorkerTask("orders", 1, 0); err != client.ErrTaskNotReady {
+		t.Fatalf("other tenant task is not hidden: %v", err)
+	}
+	if _, err := worker.AddTask("orders", 15, []byte("payload")); err == nil || err.Error() != "403 Forbidden" {
+		t.Fatalf("role is not checked: %v", err)
+	}
+	if _, err := worker.MintToken(client.TokenRequest{Roles: []string{"admin"}}); err == nil || err.Error() != "403 Forbidden" {
+		t.Fatalf("minting is not forbidden: %v", err)
+	}
+
+	// a token replaced while polling is sent by the next poll
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		worker.SetToken(workerToken + "x")
+	}()
+	if _, _, err := worker.WaitWorkerTask("orders", 50, 20*time.Millisecond); err == nil || err.Error() != "401 Unauthorized" {
+		t.Fatalf("replaced token is not sent: %v", err)
+	}
+	if _, _, err := worker.WaitWorkerTask("orders", 1, 0); err == nil || err.Error() != "401 Unauthorized" {
+		t.Fatalf("broken token is not detected: %v", err)
+	}
+	for _, request := range []client.TokenRequest{
+		{Roles: []string{"unknown"}},
+		{Roles: []string{"admin"}, Queues: []string{"orders"}},
+		{Roles: []string{"consume"}, Tenant: "acme/orders"},
+		{Roles: []string{"consume"}, TTL: 48 * time.Hour},
+	} {
+		if _, err := admin.MintToken(request); err == nil || err.Error() != "400 Bad Request" {
+			t.Fatalf("invalid request is not detected: %+v %v", request, err)
+		}
+	}
+}
@@ -0,0 +1,628 @@
+// Package backendtest is a conformance test suite for backends.Backend
+// implementations. A backend proves its behaviour with a single call from
+// its own tests:
+//
+//	func Test_Conformance(t *testing.T) {
+//		backendtest.Run(t, func() (backends.Backend, error) {
+//			return mybackend.New()
+//		})
+//	}
+//
+// The suite uses the Backend interface only and never looks at backend
+// internals.
+package backendtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+// Factory creates a new empty backend. Run calls it once per test case and
+// closes the returned backend when the case is done.
+type Factory func() (backends.Backend, error)
+
+// Timeout is the execution timeout used by the timeout test cases. Backends
+// with coarse timers may raise it before calling Run.
+var Timeout = 50 * time.Millisecond
+
+// Run runs the full conformance suite against backends created by factory.
+func Run(t *testing.T, factory Factory) {
+	cases := []struct {
+		name string
+		test func(t *testing.T, backend backends.Backend)
+	}{
+		{"Name", testName},
+		{"Put returns unique task ids", testPutUniqueIDs},
+		{"GetNotReady from unknown queue", testGetNotReadyUnknownQueue},
+		{"GetNotReady from drained queue", testGetNotReadyDrainedQueue},
+		{"GetNotReady returns payload", testGetNotReadyPayload},
+		{"GetNotReady keeps FIFO order", testFIFO},
+		{"Queues are independent", testQueuesIndependent},
+		{"TaskReady of unknown task", testTaskReadyUnknown},
+		{"TaskReady of waiting task", testTaskReadyWaiting},
+		{"TaskReady twice", testTaskReadyTwice},
+		{"GetReady of unknown task", testGetReadyUnknown},
+		{"GetReady of running task", testGetReadyRunning},
+		{"GetReady returns result once", testGetReadyOnce},
+		{"Empty payload and result", testEmpty},
+		{"Execution timeout", testTimeout},
+		{"TaskReady after timeout", testTaskReadyAfterTimeout},
+		{"Ready task survives its timeout", testReadySurvivesTimeout},
+		{"Stats", testStats},
+		{"Stats after timeout", testStatsTimeout},
+		{"Canceled context", testCanceledContext},
+		{"Concurrent producers and workers", testConcurrency},
+		{"Task states", testInspect},
+		{"Delete", testDelete},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			backend := open(t, factory)
+			c.test(t, backend)
+		})
+	}
+	t.Run("Export and Import", func(t *testing.T) {
+		testExportImport(t, factory)
+	})
+}
+
+// open creates a backend closed at the end of the test.
+func open(t *testing.T, factory Factory) backends.Backend {
+	t.Helper()
+	backend, err := factory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := backend.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return backend
+}
+
+func put(t *testing.T, backend backends.Backend, queue string, payload string, timeout time.Duration) string {
+	t.Helper()
+	taskID, err := backend.Put(context.Background(), queue, "", []byte(payload), timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taskID == "" {
+		t.Fatal("taskID is empty")
+	}
+	return taskID
+}
+
+func getNotReady(t *testing.T, backend backends.Backend, queue string) (string, []byte) {
+	t.Helper()
+	taskID, payload, err := backend.GetNotReady(context.Background(), queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return taskID, payload
+}
+
+func taskReady(t *testing.T, backend backends.Backend, taskID string, result string) {
+	t.Helper()
+	if err := backend.TaskReady(context.Background(), taskID, []byte(result)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectErr(t *testing.T, err error, expected error) {
+	t.Helper()
+	if !errors.Is(err, expected) {
+		t.Fatalf("error is not %v: %v", expected, err)
+	}
+}
+
+func stats(t *testing.T, backend backends.Backend) map[string]backends.QueueStats {
+	t.Helper()
+	stats, err := backend.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total backends.QueueStats
+	for _, s := range stats.Queues {
+		total.Add(s)
+	}
+	if !reflect.DeepEqual(stats.Total, total) {
+		t.Fatalf("total stats is not equal to the sum of queues: %+v != %+v", stats.Total, total)
+	}
+	return stats.Queues
+}
+
+// expectStats compares the task counts only, other stats are optional.
+func expectStats(t *testing.T, backend backends.Backend, queue string, expected backends.QueueStats) {
+	t.Helper()
+	s := stats(t, backend)[queue]
+	s = backends.QueueStats{WaitLength: s.WaitLength, WorkLength: s.WorkLength, ReadyLength: s.ReadyLength}
+	if !reflect.DeepEqual(s, expected) {
+		t.Fatalf("stats is not equal: %+v != %+v", s, expected)
+	}
+}
+
+func testName(t *testing.T, backend backends.Backend) {
+	if backend.Name() == "" {
+		t.Fatal("name is empty")
+	}
+}
+
+func testPutUniqueIDs(t *testing.T, backend backends.Backend) {
+	ids := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		taskID := put(t, backend, fmt.Sprintf("queue%d", i%3), "payload", time.Minute)
+		if ids[taskID] {
+			t.Fatalf("taskID is not unique: %s", taskID)
+		}
+		ids[taskID] = true
+	}
+}
+
+func testGetNotReadyUnknownQueue(t *testing.T, backend backends.Backend) {
+	_, _, err := backend.GetNotReady(context.Background(), "unknown")
+	expectErr(t, err, backends.ErrQueueNotFound)
+}
+
+func testGetNotReadyDrainedQueue(t *testing.T, backend backends.Backend) {
+	put(t, backend, "queue", "payload", time.Minute)
+	getNotReady(t, backend, "queue")
+	_, _, err := backend.GetNotReady(context.Background(), "queue")
+	expectErr(t, err, backends.ErrQueueNotFound)
+}
+
+func testGetNotReadyPayload(t *testing.T, backend backends.Backend) {
+	taskID := put(t, backend, "queue", "payload", time.Minute)
+	workerTaskID, payload := getNotReady(t, backend, "queue")
+	if workerTaskID != taskID {
+		t.Fatalf("taskID is not equal: %s != %s", workerTaskID, taskID)
+	}
+	if string(payload) != "payload" {
+		t.Fatalf("payload is not equal: %s != %s", payload, "payload")
+	}
+}
+
+func testFIFO(t *testing.T, backend backends.Backend) {
+	var ids []string
+	for i := 0; i < 10; i++ {
+		ids = append(ids, put(t, backend, "queue", fmt.Sprint(i), time.Minute))
+	}
+	for i, taskID := range ids {
+		workerTaskID, payload := getNotReady(t, backend, "queue")
+		if workerTaskID != taskID {
+			t.Fatalf("task %d is out of order: %s != %s", i, workerTaskID, taskID)
+		}
+		if string(payload) != fmt.Sprint(i) {
+			t.Fatalf("payload is not equal: %s != %d", payload, i)
+		}
+	}
+}
+
+func testQueuesIndependent(t *testing.T, backend backends.Backend) {
+	taskA := put(t, backend, "a", "payload_a", time.Minute)
+	taskB := put(t, backend, "b", "payload_b", time.Minute)
+	taskID, payload := getNotReady(t, backend, "b")
+	if taskID != taskB || string(payload) != "payload_b" {
+		t.Fatalf("unexpected task from queue b: %s %s", taskID, payload)
+	}
+	_, _, err := backend.GetNotReady(context.Background(), "b")
+	expectErr(t, err, backends.ErrQueueNotFound)
+	taskID, payload = getNotReady(t, backend, "a")
+	if taskID != taskA || string(payload) != "payload_a" {
+		t.Fatalf("unexpected task from queue a: %s %s", taskID, payload)
+	}
+}
+
+func testTaskReadyUnknown(t *testing.T, backend backends.Backend) {
+	expectErr(t, backend.TaskReady(context.Background(), "unknown", []byte("result")), backends.ErrTaskNotFoundOrNotReady)
+}
+
+func testTaskReadyWaiting(t *testing.T, backend backends.Backend) {
+	taskID := put(t, backend, "queue", "payload", time.Minute)
+	expectErr(t, backend.TaskReady(context.Background(), taskID, []byte("result")), backends.ErrTaskNotFoundOrNotReady)
+}
+
+func testTaskReadyTwice(t *testing.T, backend backends.Backend) {
+	put(t, backend, "queue", "payload", time.Minute)
+	taskID, _ := getNotReady(t, backend, "queue")
+	taskReady(t, backend, taskID, "result")
+	expectErr(t, backend.TaskReady(context.Background(), taskID, []byte("other")), backends.ErrTaskNotFoundOrNotReady)
+	result, err := backend.GetReady(context.Background(), taskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "result" {
+		t.Fatalf("result is not equal: %s != %s", result, "result")
+	}
+}
+
+func testGetReadyUnknown(t *testing.T, backend backends.Backend) {
+	_, err := backend.GetReady(context.Background(), "unknown")
+	expectErr(t, err, backends.ErrTaskNotFoundOrNotReady)
+}
+
+func testGetReadyRunning(t *testing.T, backend backends.Backend) {
+	taskID := put(t, backend, "queue", "payload", time.Minute)
+	_, err := backend.GetReady(context.Background(), taskID)
+	expectErr(t, err, backends.ErrTaskNotFoundOrNotReady)
+	getNotReady(t, backend, "queue")
+	_, err = backend.GetReady(context.Background(), taskID)
+	expectErr(t, err, backends.ErrTaskNotFoundOrNotReady)
+}
+
+func testGetReadyOnce(t *testing.T, backend backends.Backend) {
+	put(t, backend, "queue", "payload", time.Minute)
+	taskID, _ := getNotReady(t, backend, "queue")
+	taskReady(t, backend, taskID, "result")
+	result, err := backend.GetReady(context.Background(), taskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "result" {
+		t.Fatalf("result is not equal: %s != %s", result, "result")
+	}
+	_, err = backend.GetReady(context.Background(), taskID)
+	expectErr(t, err, backends.ErrTaskNotFoundOrNotReady)
+}
+
+func testEmpty(t *testing.T, backend backends.Backend) {
+	put(t, backend, "queue", "", time.Minute)
+	taskID, payload := getNotReady(t, backend, "queue")
+	if len(payload) != 0 {
+		t.Fatalf("payload is not empty: %s", payload)
+	}
+	taskReady(t, backend, taskID, "")
+	result, err := backend.GetReady(context.Background(), taskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 0 {
+		t.Fatalf("result is not empty: %s", result)
+	}
+}
+
+func testTimeout(t *testing.T, backend backends.Backend) {
+	put(t, backend, "queue", "payload", Timeout)
+	taskID, _ := getNotReady(t, backend, "queue")
+	time.Sleep(Timeout * 4)
+	result, err := backend.GetReady(context.Background(), taskID)
+	if result != nil {
+		t.Fatalf("result is not nil: %s", result)
+	}
+	expectErr(t, err, backends.ErrTaskExecutionTimeout)
+	_, _, err = backend.GetNotReady(context.Background(), "queue")
+	expectErr(t, err, backends.ErrQueueNotFound)
+}
+
+func testTaskReadyAfterTimeout(t *testing.T, backend backends.Backend) {
+	put(t, backend, "queue", "payload", Timeout)
+	taskID, _ := getNotReady(t, backend, "queue")
+	time.Sleep(Timeout * 4)
+	expectErr(t, backend.TaskReady(context.Background(), taskID, []byte("late")), backends.ErrTaskNotFoundOrNotReady)
+	_, err := backend.GetReady(context.Background(), taskID)
+	expectErr(t, err, backends.ErrTaskExecutionTimeout)
+}
+
+func testReadySurvivesTimeout(t *testing.T, backend backends.Backend) {
+	put(t, backend, "queue", "payload", Timeout)
+	taskID, _ := getNotReady(t, backend, "queue")
+	taskReady(t, backend, taskID, "result")
+	time.Sleep(Timeout * 4)
+	result, err := backend.GetReady(context.Background(), taskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "result" {
+		t.Fatalf("result is not equal: %s != %s", result, "result")
+	}
+}
+
+func testStats(t *testing.T, backend backends.Backend) {
+	put(t, backend, "queue", "payload", time.Minute)
+	put(t, backend, "queue", "payload", time.Minute)
+	put(t, backend, "other", "payload", time.Minute)
+	expectStats(t, backend, "queue", backends.QueueStats{WaitLength: 2})
+	expectStats(t, backend, "other", backends.QueueStats{WaitLength: 1})
+	taskID, _ := getNotReady(t, backend, "queue")
+	expectStats(t, backend, "queue", backends.QueueStats{WaitLength: 1, WorkLength: 1})
+	taskReady(t, backend, taskID, "result")
+	expectStats(t, backend, "queue", backends.QueueStats{WaitLength: 1, ReadyLength: 1})
+	if _, err := backend.GetReady(context.Background(), taskID); err != nil {
+		t.Fatal(err)
+	}
+	expectStats(t, backend, "queue", backends.QueueStats{WaitLength: 1})
+	expectStats(t, backend, "other", backends.QueueStats{WaitLength: 1})
+}
+
+func testStatsTimeout(t *testing.T, backend backends.Backend) {
+	put(t, backend, "queue", "payload", Timeout)
+	taskID, _ := getNotReady(t, backend, "queue")
+	time.Sleep(Timeout * 4)
+	expectStats(t, backend, "queue", backends.QueueStats{ReadyLength: 1})
+	_, err := backend.GetReady(context.Background(), taskID)
+	expectErr(t, err, backends.ErrTaskExecutionTimeout)
+	expectStats(t, backend, "queue", backends.QueueStats{})
+}
+
+func testCanceledContext(t *testing.T, backend backends.Backend) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := backend.Put(ctx, "queue", "", []byte("payload"), time.Minute)
+	expectErr(t, err, context.Canceled)
+	_, _, err = backend.GetNotReady(context.Background(), "queue")
+	expectErr(t, err, backends.ErrQueueNotFound)
+	taskID := put(t, backend, "queue", "payload", time.Minute)
+	_, _, err = backend.GetNotReady(ctx, "queue")
+	expectErr(t, err, context.Canceled)
+	getNotReady(t, backend, "queue")
+	err = backend.TaskReady(ctx, taskID, []byte("result"))
+	expectErr(t, err, context.Canceled)
+	taskReady(t, backend, taskID, "result")
+	_, err = backend.GetReady(ctx, taskID)
+	expectErr(t, err, context.Canceled)
+	result, err := backend.GetReady(context.Background(), taskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "result" {
+		t.Fatalf("result is not equal: %s != %s", result, "result")
+	}
+	_, err = backend.Stats(ctx)
+	expectErr(t, err, context.Canceled)
+}
+
+func testConcurrency(t *testing.T, backend backends.Backend) {
+	const (
+		producers = 8
+		workers   = 8
+		tasks     = 200
+	)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	produced := make(map[string]string)
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < tasks; i++ {
+				payload := fmt.Sprintf("%d-%d", p, i)
+				taskID, err := backend.Put(context.Background(), "queue", "", []byte(payload), time.Minute)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mutex.Lock()
+				if _, ok := produced[taskID]; ok {
+					t.Errorf("taskID is not unique: %s", taskID)
+				}
+				produced[taskID] = payload
+				mutex.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	consumed := make(map[string]bool)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				taskID, payload, err := backend.GetNotReady(context.Background(), "queue")
+				if errors.Is(err, backends.ErrQueueNotFound) {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mutex.Lock()
+				if consumed[taskID] {
+					t.Errorf("task is dispatched twice: %s", taskID)
+				}
+				consumed[taskID] = true
+				expected := produced[taskID]
+				mutex.Unlock()
+				if string(payload) != expected {
+					t.Errorf("payload is not equal: %s != %s", payload, expected)
+				}
+				if err := backend.TaskReady(context.Background(), taskID, payload); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(consumed) != len(produced) {
+		t.Fatalf("consumed tasks is not equal to produced: %d != %d", len(consumed), len(produced))
+	}
+	for taskID, payload := range produced {
+		result, err := backend.GetReady(context.Background(), taskID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, []byte(payload)) {
+			t.Fatalf("result is not equal: %s != %s", result, payload)
+		}
+	}
+	expectStats(t, backend, "queue", backends.QueueStats{})
+}
+
+// testExportImport moves tasks in every state to a new backend, it is
+// skipped for backends without export or import.
+func testExportImport(t *testing.T, factory Factory) {
+	source := open(t, factory)
+	var exporter backends.Exporter
+	var importer backends.Importer
+	if !backends.As(source, &exporter) || !backends.As(source, &importer) {
+		t.Skip("backend has no export or import")
+	}
+	running := put(t, source, "queue", "running", time.Minute)
+	waiting := []string{
+		put(t, source, "queue", "waiting_1", time.Minute),
+		put(t, source, "queue", "waiting_2", time.Minute),
+	}
+	ready := put(t, source, "other", "ready", time.Minute)
+	failed := put(t, source, "other", "failed", Timeout)
+	getNotReady(t, source, "queue")
+	getNotReady(t, source, "other")
+	taskReady(t, source, ready, "result")
+	getNotReady(t, source, "other")
+	time.Sleep(Timeout * 4)
+
+	var tasks []*backends.Task
+	states := make(map[string]backends.TaskState)
+	err := exporter.Export(context.Background(), func(task *backends.Task) error {
+		exported := *task
+		tasks = append(tasks, &exported)
+		states[task.ID] = task.State
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]backends.TaskState{
+		running:    backends.TaskRunning,
+		waiting[0]: backends.TaskWaiting,
+		waiting[1]: backends.TaskWaiting,
+		ready:      backends.TaskReady,
+		failed:     backends.TaskFailed,
+	}
+	if len(states) != len(expected) {
+		t.Fatalf("exported tasks is not equal: %v != %v", states, expected)
+	}
+	for taskID, state := range expected {
+		if states[taskID] != state {
+			t.Fatalf("task %s state is not equal: %s != %s", taskID, states[taskID], state)
+		}
+	}
+
+	target := open(t, factory)
+	if !backends.As(target, &importer) {
+		t.Fatal("new backend has no import")
+	}
+	// waiting tasks are imported in the exported order
+	for _, task := range tasks {
+		if err := importer.Import(context.Background(), task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectStats(t, target, "queue", backends.QueueStats{WaitLength: 2, WorkLength: 1})
+	expectStats(t, target, "other", backends.QueueStats{ReadyLength: 2})
+	for i, taskID := range waiting {
+		workerTaskID, payload := getNotReady(t, target, "queue")
+		if workerTaskID != taskID || string(payload) != fmt.Sprint("waiting_", i+1) {
+			t.Fatalf("unexpected waiting task: %s %s", workerTaskID, payload)
+		}
+	}
+	taskReady(t, target, running, "result")
+	for _, taskID := range []string{running, ready} {
+		result, err := target.GetReady(context.Background(), taskID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) != "result" {
+			t.Fatalf("result is not equal: %s != %s", result, "result")
+		}
+	}
+	_, err = target.GetReady(context.Background(), failed)
+	expectErr(t, err, backends.ErrTaskExecutionTimeout)
+	taskID := put(t, target, "queue", "new", time.Minute)
+	if _, ok := expected[taskID]; ok {
+		t.Fatalf("new task got the id of an imported one: %s", taskID)
+	}
+}
+
+func expectState(t *testing.T, inspector backends.Inspector, taskID string, state backends.TaskState) *backends.Task {
+	t.Helper()
+	task, err := inspector.Task(context.Background(), taskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.ID != taskID || task.State != state {
+		t.Fatalf("task is not %s %s: %s %s", taskID, state, task.ID, task.State)
+	}
+	return task
+}
+
+// testInspect is skipped for backends without task lookup.
+func testInspect(t *testing.T, backend backends.Backend) {
+	var inspector backends.Inspector
+	if !backends.As(backend, &inspector) {
+		t.Skip("backend has no task lookup")
+	}
+	_, err := inspector.Task(context.Background(), "unknown")
+	expectErr(t, err, backends.ErrTaskNotFound)
+	taskID := put(t, backend, "queue", "payload", Timeout)
+	task := expectState(t, inspector, taskID, backends.TaskWaiting)
+	if task.Queue != "queue" || string(task.Payload) != "payload" || task.Timeout != Timeout {
+		t.Fatalf("unexpected task: %+v", task)
+	}
+	getNotReady(t, backend, "queue")
+	expectState(t, inspector, taskID, backends.TaskRunning)
+	taskReady(t, backend, taskID, "result")
+	task = expectState(t, inspector, taskID, backends.TaskReady)
+	if string(task.Result) != "result" {
+		t.Fatalf("result is not equal: %s != %s", task.Result, "result")
+	}
+	put(t, backend, "queue", "payload", Timeout)
+	failed, _ := getNotReady(t, backend, "queue")
+	time.Sleep(Timeout * 4)
+	task = expectState(t, inspector, failed, backends.TaskFailed)
+	if !errors.Is(task.Error, backends.ErrTaskExecutionTimeout) {
+		t.Fatalf("task error is not timeout: %v", task.Error)
+	}
+	if _, err := backend.GetReady(context.Background(), taskID); err != nil {
+		t.Fatal(err)
+	}
+	_, err = inspector.Task(context.Background(), taskID)
+	expectErr(t, err, backends.ErrTaskNotFound)
+}
+
+// testDelete is skipped for backends without delete.
+func testDelete(t *testing.T, backend backends.Backend) {
+	var deleter backends.Deleter
+	if !backends.As(backend, &deleter) {
+		t.Skip("backend has no delete")
+	}
+	expectErr(t, deleter.Delete(context.Background(), "unknown"), backends.ErrTaskNotFound)
+	running := put(t, backend, "queue", "running", time.Minute)
+	waiting := []string{
+		put(t, backend, "queue", "waiting_1", time.Minute),
+		put(t, backend, "queue", "waiting_2", time.Minute),
+		put(t, backend, "queue", "waiting_3", time.Minute),
+	}
+	ready := put(t, backend, "queue", "ready", time.Minute)
+	getNotReady(t, backend, "queue")
+	for _, taskID := range []string{running, waiting[1]} {
+		if err := deleter.Delete(context.Background(), taskID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectErr(t, backend.TaskReady(context.Background(), running, nil), backends.ErrTaskNotFoundOrNotReady)
+	for _, taskID := range []string{waiting[0], waiting[2], ready} {
+		workerTaskID, _ := getNotReady(t, backend, "queue")
+		if workerTaskID != taskID {
+			t.Fatalf("taskID is not equal: %s != %s", workerTaskID, taskID)
+		}
+	}
+	taskReady(t, backend, ready, "result")
+	if err := deleter.Delete(context.Background(), ready); err != nil {
+		t.Fatal(err)
+	}
+	_, err := backend.GetReady(context.Background(), ready)
+	expectErr(t, err, backends.ErrTaskNotFoundOrNotReady)
+	expectErr(t, deleter.Delete(context.Background(), ready), backends.ErrTaskNotFound)
+	expectStats(t, backend, "queue", backends.QueueStats{WorkLength: 2})
+}
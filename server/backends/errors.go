@@ -0,0 +1,65 @@
+package backends
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrQueueNotFound          = errors.New("queue not found")
+	ErrTaskNotFoundOrNotReady = errors.New("task not found or not ready")
+	ErrTaskExecutionTimeout   = errors.New("task execution timeout")
+	ErrSnapshotsOff           = errors.New("snapshots are off")
+	ErrTaskExists             = errors.New("task exists")
+	ErrTaskNotFound           = errors.New("task not found")
+	ErrNotSupported           = errors.New("not supported by backend")
+	ErrQueueFull              = errors.New("queue is full")
+	ErrQueueStorageFull       = errors.New("queue storage is full")
+)
+
+// Error is an error of a backend operation on a queue or a task.
+type Error struct {
+	Op     string
+	Queue  string
+	TaskID string
+	Err    error
+}
+
+// QueueError returns an error of the operation on the queue.
+func QueueError(op string, queue string, err error) error {
+	return &Error{Op: op, Queue: queue, Err: err}
+}
+
+// TaskError returns an error of the operation on the task.
+func TaskError(op string, taskID string, err error) error {
+	return &Error{Op: op, TaskID: taskID, Err: err}
+}
+
+func (e *Error) Error() string {
+	s := e.Op
+	if e.Queue != "" {
+		s += " queue " + e.Queue
+	}
+	if e.TaskID != "" {
+		s += " task " + e.TaskID
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// RetryError is an error of a call which may succeed after RetryAfter.
+type RetryError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryError) Error() string {
+	return e.Err.Error() + ", retry after " + e.RetryAfter.String()
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,154 @@
+// Package export writes tasks of a backend to a portable file and loads
+// them into another backend.
+//
+// The file is JSON lines: a header line followed by one line per task.
+//
+//	{"Format":"stq-export","Version":1}
+//	{"State":"waiting","Queue":"queue","ID":"1","Payload":"cGF5bG9hZA==","Timeout":15000}
+//
+// Payload and Result are base64 encoded, Timeout is in milliseconds,
+// Error is the error text of failed tasks and Group the group of grouped
+// tasks. Both sides stream the tasks one by one.
+package export
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+const (
+	Format  = "stq-export"
+	Version = 1
+)
+
+var (
+	ErrInvalidFormat = errors.New("invalid export format")
+)
+
+type header struct {
+	Format  string
+	Version int
+}
+
+// Record is a task in the export format.
+type Record struct {
+	State   backends.TaskState
+	Queue   string
+	ID      string
+	Payload []byte `json:",omitempty"`
+	Result  []byte `json:",omitempty"`
+	Error   string `json:",omitempty"`
+	Timeout int64
+	Group   string `json:",omitempty"`
+}
+
+// NewRecord returns the record of the task.
+func NewRecord(task *backends.Task) Record {
+	r := Record{
+		State:   task.State,
+		Queue:   task.Queue,
+		ID:      task.ID,
+		Payload: task.Payload,
+		Result:  task.Result,
+		Timeout: task.Timeout.Milliseconds(),
+		Group:   task.Group,
+	}
+	if task.Error != nil {
+		r.Error = task.Error.Error()
+	}
+	return r
+}
+
+// Task returns the task of the record.
+func (r Record) Task() *backends.Task {
+	task := &backends.Task{
+		State:   r.State,
+		Queue:   r.Queue,
+		ID:      r.ID,
+		Payload: r.Payload,
+		Result:  r.Result,
+		Timeout: time.Duration(r.Timeout) * time.Millisecond,
+		Group:   r.Group,
+	}
+	switch r.Error {
+	case "":
+	case backends.ErrTaskExecutionTimeout.Error():
+		task.Error = backends.ErrTaskExecutionTimeout
+	default:
+		task.Error = errors.New(r.Error)
+	}
+	return task
+}
+
+// Write writes all tasks of the backend to w and returns the number of
+// written tasks.
+func Write(ctx context.Context, w io.Writer, exporter backends.Exporter) (int, error) {
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	if err := encoder.Encode(header{Format: Format, Version: Version}); err != nil {
+		return 0, err
+	}
+	count := 0
+	err := exporter.Export(ctx, func(task *backends.Task) error {
+		if err := encoder.Encode(NewRecord(task)); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, buffered.Flush()
+}
+
+// Read imports all tasks from r into the backend and returns the number of
+// imported tasks.
+func Read(ctx context.Context, r io.Reader, importer backends.Importer) (int, error) {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	var h header
+	if err := decoder.Decode(&h); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidFormat, err)
+	}
+	if h.Format != Format {
+		return 0, fmt.Errorf("%w: format %q", ErrInvalidFormat, h.Format)
+	}
+	if h.Version != Version {
+		return 0, fmt.Errorf("%w: unsupported version %d", ErrInvalidFormat, h.Version)
+	}
+	count := 0
+	for {
+		var r Record
+		err := decoder.Decode(&r)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, fmt.Errorf("%w: task %d: %s", ErrInvalidFormat, count+1, err)
+		}
+		if err := importer.Import(ctx, r.Task()); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// Copy streams all tasks from one backend to another through a pipe and
+// returns the number of copied tasks.
+func Copy(ctx context.Context, to backends.Importer, from backends.Exporter) (int, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := Write(ctx, pw, from)
+		pw.CloseWithError(err)
+	}()
+	count, err := Read(ctx, pr, to)
+	pr.CloseWithError(err)
+	return count, err
+}
@@ -0,0 +1,118 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/server/backends/memory"
+)
+
+func Test_Export(t *testing.T) {
+	ctx := context.TODO()
+	source, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"payload_1", "payload_2", "payload_3"} {
+		if _, err := source.Put(ctx, "queue", "", []byte(payload), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	taskID, _, err := source.GetNotReady(ctx, "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.TaskReady(ctx, taskID, []byte("result_1")); err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	count, err := Write(ctx, &buffer, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("exported count is not equal: %d != %d", count, 3)
+	}
+	if !strings.HasPrefix(buffer.String(), `{"Format":"stq-export","Version":1}`+"\n") {
+		t.Fatalf("unexpected header: %s", buffer.String())
+	}
+
+	target, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err = Read(ctx, &buffer, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("imported count is not equal: %d != %d", count, 3)
+	}
+	result, err := target.GetReady(ctx, taskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "result_1" {
+		t.Fatalf("result is not equal: %s != %s", result, "result_1")
+	}
+	_, payload, err := target.GetNotReady(ctx, "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != "payload_2" {
+		t.Fatalf("payload is not equal: %s != %s", payload, "payload_2")
+	}
+}
+
+func Test_Copy(t *testing.T) {
+	ctx := context.TODO()
+	source, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := source.Put(ctx, "queue", "", []byte("payload"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	target, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := Copy(ctx, target, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := target.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1000 || stats.Queues["queue"].WaitLength != 1000 {
+		t.Fatalf("tasks are not copied: %d %+v", count, stats.Queues)
+	}
+}
+
+func Test_InvalidFormat(t *testing.T) {
+	target, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{
+		"",
+		`{"Format":"other","Version":1}`,
+		`{"Format":"stq-export","Version":2}`,
+		`{"Format":"stq-export","Version":1}` + "\n{broken",
+	} {
+		if _, err := Read(context.TODO(), strings.NewReader(data), target); !errors.Is(err, ErrInvalidFormat) {
+			t.Fatalf("invalid format is not detected: %q: %v", data, err)
+		}
+	}
+	data := `{"Format":"stq-export","Version":1}` + "\n" + `{"State":"lost","Queue":"queue","ID":"1"}`
+	if _, err := Read(context.TODO(), strings.NewReader(data), target); err == nil {
+		t.Fatal("unknown state is not detected")
+	}
+}
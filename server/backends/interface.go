@@ -1,22 +1,80 @@
 package backends
 
 import (
-	"errors"
+	"context"
 	"time"
 )
 
-var (
-	ErrQueueNotFound          = errors.New("queue not found")
-	ErrTaskNotFoundOrNotReady = errors.New("task not found or not ready")
-	ErrTaskExecutionTimeout   = errors.New("task execution timeout")
-)
-
-type Stats struct {
+// QueueStats is the number of tasks of a queue in every state.
+type QueueStats struct {
 	WaitLength  uint64
 	WorkLength  uint64
 	ReadyLength uint64
+	// payload bytes of waiting tasks, blobs by their size, zero if the
+	// backend does not count them
+	WaitBytes uint64 `json:",omitempty"`
+	// tasks dropped by queue limits
+	Dropped uint64 `json:",omitempty"`
+	// limit of running tasks, zero if the queue is not limited
+	WorkLimit uint64 `json:",omitempty"`
+	// waiting tasks of groups, see Put, nil if the backend does not
+	// count them
+	WaitGroups map[string]uint64 `json:",omitempty"`
+	// dispatch of the queue is paused, see Pauser
+	Paused bool `json:",omitempty"`
+}
+
+// Add adds other stats to s, limits are not added and s is paused if other
+// is. s gets its own groups map, so the maps of other are not changed later.
+func (s *QueueStats) Add(other QueueStats) {
+	s.Paused = s.Paused || other.Paused
+	s.WaitLength += other.WaitLength
+	s.WorkLength += other.WorkLength
+	s.ReadyLength += other.ReadyLength
+	s.WaitBytes += other.WaitBytes
+	s.Dropped += other.Dropped
+	if len(other.WaitGroups) > 0 {
+		groups := make(map[string]uint64, len(s.WaitGroups)+len(other.WaitGroups))
+		for group, n := range s.WaitGroups {
+			groups[group] = n
+		}
+		for group, n := range other.WaitGroups {
+			groups[group] += n
+		}
+		s.WaitGroups = groups
+	}
 }
 
+// Stats is the stats of every queue and their total.
+type Stats struct {
+	Queues map[string]QueueStats
+	Total  QueueStats
+}
+
+// NewStats returns stats of the queues with the total computed.
+func NewStats(queues map[string]QueueStats) *Stats {
+	stats := &Stats{Queues: queues}
+	if stats.Queues == nil {
+		stats.Queues = make(map[string]QueueStats)
+	}
+	for _, queueStats := range stats.Queues {
+		stats.Total.Add(queueStats)
+	}
+	// queues are paused, not the total
+	stats.Total.Paused = false
+	return stats
+}
+
+// TaskState is the state of a task.
+type TaskState string
+
+const (
+	TaskWaiting TaskState = "waiting"
+	TaskRunning TaskState = "running"
+	TaskReady   TaskState = "ready"
+	TaskFailed  TaskState = "failed"
+)
+
 type Task struct {
 	Queue   string
 	ID      string
@@ -24,21 +82,109 @@ type Task struct {
 	Error   error
 	Result  []byte
 	Timeout time.Duration
+	// Group is the group of the task within its queue, see Put.
+	Group string
+	// State is set on exported tasks and tasks to import only.
+	State TaskState
 }
 
+// Backend stores queues and tasks. Every method except Close and Name takes
+// a context and must return its error once it is done. Errors wrap the
+// package error values and can be checked with errors.Is.
 type Backend interface {
 	// Close the backend.
 	Close() error
 	// Get the backend name.
 	Name() string
-	// Put task to queue and return task id.
-	Put(queue string, payload []byte, executionTimeout time.Duration) (taskID string, err error)
+	// Put task to the group of queue and return task id. Backends with fair
+	// scheduling, like memory, dispatch tasks of the groups of a queue in
+	// turns, so a group with many tasks does not starve the others, other
+	// backends ignore the group. Tasks without a group have an empty one.
+	Put(ctx context.Context, queue, group string, payload []byte, executionTimeout time.Duration) (taskID string, err error)
 	// Get not ready task from queue and start processing timeout.
-	GetNotReady(queue string) (taskID string, payload []byte, err error)
+	GetNotReady(ctx context.Context, queue string) (taskID string, payload []byte, err error)
 	// Get ready task by task id or task error.
-	GetReady(taskid string) (result []byte, err error)
+	GetReady(ctx context.Context, taskID string) (result []byte, err error)
 	// Task is ready.
-	TaskReady(taskid string, result []byte) error
-	// Queues stats
-	Stats() ([]byte, error)
+	TaskReady(ctx context.Context, taskID string, result []byte) error
+	// Queues stats.
+	Stats(ctx context.Context) (*Stats, error)
+}
+
+// Snapshotter is implemented by backends able to save their state on demand.
+type Snapshotter interface {
+	// Save the backend state.
+	Snapshot(ctx context.Context) error
+}
+
+// Exporter is implemented by backends able to list all their tasks.
+type Exporter interface {
+	// Call fn for every task in every state, the task must not be changed.
+	Export(ctx context.Context, fn func(task *Task) error) error
+}
+
+// Importer is implemented by backends able to add tasks in any state.
+type Importer interface {
+	// Add the task in its state keeping its id. Running tasks get their
+	// execution timeout from now.
+	Import(ctx context.Context, task *Task) error
+}
+
+// Inspector is implemented by backends able to look up a task by id.
+type Inspector interface {
+	// Get the task with its state, ErrTaskNotFound if there is no task.
+	Task(ctx context.Context, taskID string) (*Task, error)
+}
+
+// QueueCounter is implemented by backends able to return the stats of a
+// queue without collecting the stats of every queue.
+type QueueCounter interface {
+	// QueueStats returns the stats of the queue, zero if there is no queue.
+	QueueStats(ctx context.Context, queue string) (QueueStats, error)
+}
+
+// QueueStatsOf returns the stats of the queue of the backend chain by the
+// QueueCounter of the chain or by Stats if there is none.
+func QueueStatsOf(ctx context.Context, backend Backend, queue string) (QueueStats, error) {
+	var counter QueueCounter
+	if As(backend, &counter) {
+		return counter.QueueStats(ctx, queue)
+	}
+	stats, err := backend.Stats(ctx)
+	if err != nil {
+		return QueueStats{}, err
+	}
+	return stats.Queues[queue], nil
+}
+
+// TaskIDCounter is implemented by backends numbering their tasks, so a copy
+// of the backend made by import makes the same task ids.
+type TaskIDCounter interface {
+	// LastTaskID returns the number of the last task made by Put.
+	LastTaskID(ctx context.Context) (uint64, error)
+	// SetLastTaskID moves the counter forward to the number, Put does not
+	// make ids of tasks gone before.
+	SetLastTaskID(ctx context.Context, id uint64) error
+}
+
+// DropNotifier is implemented by backends deleting waiting tasks on their
+// own, like queue limits dropping the oldest tasks.
+type DropNotifier interface {
+	// OnDrop sets the function called with the id of every dropped task
+	// after it is deleted. Set it before the backend is used.
+	OnDrop(fn func(taskID string))
+}
+
+// Pauser is implemented by backends able to pause dispatch of queues.
+type Pauser interface {
+	// Pause or resume the queue. GetNotReady of a paused queue returns
+	// ErrQueueNotFound while Put still adds tasks. Paused queues have
+	// Paused set in stats.
+	SetPaused(ctx context.Context, queue string, paused bool) error
+}
+
+// Deleter is implemented by backends able to delete a task in any state.
+type Deleter interface {
+	// Delete the task, ErrTaskNotFound if there is no task.
+	Delete(ctx context.Context, taskID string) error
 }
@@ -0,0 +1,154 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/blob"
+)
+
+// Export calls fn for every task under the snapshot read lock, so other calls
+// go on meanwhile and Snapshot waits until the export is done. Tasks are
+// listed in the order they change state, waiting, running and then ready, so
+// a task changing state during the export is exported once in one of its
+// states. fn must not call the backend.
+func (m *Memory) Export(ctx context.Context, fn func(task *backends.Task) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.snapshotMutex.RLock()
+	defer m.snapshotMutex.RUnlock()
+	// ids of the exported tasks, a task may move to a map not listed yet
+	exported := make(map[string]bool)
+	var err error
+	export := func(task *backends.Task, state backends.TaskState) bool {
+		if exported[task.ID] {
+			return true
+		}
+		if err = ctx.Err(); err != nil {
+			return false
+		}
+		exported[task.ID] = true
+		copied := exportTask(task, state)
+		err = fn(&copied)
+		return err == nil
+	}
+	m.queues.Range(func(_, q interface{}) bool {
+		for _, task := range q.(*queue).list() {
+			if !export(task, backends.TaskWaiting) {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	m.work.Range(func(_, task interface{}) bool {
+		return export(task.(*backends.Task), backends.TaskRunning)
+	})
+	if err != nil {
+		return err
+	}
+	m.ready.Range(func(_, task interface{}) bool {
+		state := backends.TaskReady
+		if task.(*backends.Task).Error != nil {
+			state = backends.TaskFailed
+		}
+		return export(task.(*backends.Task), state)
+	})
+	return err
+}
+
+func exportTask(task *backends.Task, state backends.TaskState) backends.Task {
+	exported := *task
+	exported.State = state
+	return exported
+}
+
+// Import adds the task in its state. Numeric task ids move the task id
+// counter forward, so new tasks do not get ids of imported ones.
+func (m *Memory) Import(ctx context.Context, task *backends.Task) error {
+	if err := ctx.Err(); err != nil {
+		return backends.TaskError("import", task.ID, err)
+	}
+	m.snapshotMutex.RLock()
+	defer m.snapshotMutex.RUnlock()
+	if _, ok := m.waiting.Load(task.ID); ok {
+		return backends.TaskError("import", task.ID, backends.ErrTaskExists)
+	}
+	if _, ok := m.work.Load(task.ID); ok {
+		return backends.TaskError("import", task.ID, backends.ErrTaskExists)
+	}
+	if _, ok := m.ready.Load(task.ID); ok {
+		return backends.TaskError("import", task.ID, backends.ErrTaskExists)
+	}
+	if id, err := strconv.ParseUint(task.ID, 10, 64); err == nil {
+		m.moveTaskIDCounter(id)
+	}
+	imported := &backends.Task{
+		Queue:   task.Queue,
+		ID:      task.ID,
+		Payload: task.Payload,
+		Error:   task.Error,
+		Result:  task.Result,
+		Timeout: task.Timeout,
+		Group:   task.Group,
+	}
+	switch task.State {
+	case backends.TaskWaiting:
+		m.updateStats(task.Queue, func(stats *backends.QueueStats) {
+			stats.WaitLength++
+			stats.WaitBytes += blob.PayloadSize(task.Payload)
+			countGroup(stats, task.Group, true)
+		})
+		m.waiting.Store(imported.ID, imported)
+		q, _ := m.queues.LoadOrStore(task.Queue, &queue{})
+		q.(*queue).push(imported)
+	case backends.TaskRunning:
+		m.work.Store(imported.ID, imported)
+		m.updateStats(task.Queue, func(stats *backends.QueueStats) {
+			stats.WorkLength++
+		})
+		go m.expire(imported)
+	case backends.TaskReady, backends.TaskFailed:
+		if task.State == backends.TaskFailed && imported.Error == nil {
+			imported.Error = backends.ErrTaskExecutionTimeout
+		}
+		m.ready.Store(imported.ID, imported)
+		m.updateStats(task.Queue, func(stats *backends.QueueStats) {
+			stats.ReadyLength++
+		})
+	default:
+		return backends.TaskError("import", task.ID, fmt.Errorf("unknown task state %q", task.State))
+	}
+	return nil
+}
+
+// moveTaskIDCounter moves the task id counter forward to the id.
+func (m *Memory) moveTaskIDCounter(id uint64) {
+	for {
+		counter := atomic.LoadUint64(&m.taskIDCounter)
+		if id <= counter || atomic.CompareAndSwapUint64(&m.taskIDCounter, counter, id) {
+			return
+		}
+	}
+}
+
+func (m *Memory) LastTaskID(ctx context.Context) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return atomic.LoadUint64(&m.taskIDCounter), nil
+}
+
+func (m *Memory) SetLastTaskID(ctx context.Context, id uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.moveTaskIDCounter(id)
+	return nil
+}
@@ -0,0 +1,69 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/blob"
+)
+
+// Task returns a copy of the task with its state.
+func (m *Memory) Task(ctx context.Context, taskID string) (*backends.Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, backends.TaskError("task", taskID, err)
+	}
+	m.snapshotMutex.RLock()
+	defer m.snapshotMutex.RUnlock()
+	if task, ok := m.waiting.Load(taskID); ok {
+		exported := exportTask(task.(*backends.Task), backends.TaskWaiting)
+		return &exported, nil
+	}
+	if task, ok := m.work.Load(taskID); ok {
+		exported := exportTask(task.(*backends.Task), backends.TaskRunning)
+		return &exported, nil
+	}
+	if task, ok := m.ready.Load(taskID); ok {
+		state := backends.TaskReady
+		if task.(*backends.Task).Error != nil {
+			state = backends.TaskFailed
+		}
+		exported := exportTask(task.(*backends.Task), state)
+		return &exported, nil
+	}
+	return nil, backends.TaskError("task", taskID, backends.ErrTaskNotFound)
+}
+
+// Delete deletes the task in any state.
+func (m *Memory) Delete(ctx context.Context, taskID string) error {
+	if err := ctx.Err(); err != nil {
+		return backends.TaskError("delete", taskID, err)
+	}
+	m.snapshotMutex.RLock()
+	defer m.snapshotMutex.RUnlock()
+	if task, ok := m.waiting.LoadAndDelete(taskID); ok {
+		task := task.(*backends.Task)
+		q, ok := m.queues.Load(task.Queue)
+		// the task may be taken by a worker since the lookup
+		if ok && q.(*queue).remove(task) {
+			m.updateStats(task.Queue, func(stats *backends.QueueStats) {
+				stats.WaitLength--
+				stats.WaitBytes -= blob.PayloadSize(task.Payload)
+				countGroup(stats, task.Group, false)
+			})
+			return nil
+		}
+	}
+	if task, ok := m.work.LoadAndDelete(taskID); ok {
+		m.updateStats(task.(*backends.Task).Queue, func(stats *backends.QueueStats) {
+			stats.WorkLength--
+		})
+		return nil
+	}
+	if task, ok := m.ready.LoadAndDelete(taskID); ok {
+		m.updateStats(task.(*backends.Task).Queue, func(stats *backends.QueueStats) {
+			stats.ReadyLength--
+		})
+		return nil
+	}
+	return backends.TaskError("delete", taskID, backends.ErrTaskNotFound)
+}
@@ -0,0 +1,170 @@
+package memory
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/blob"
+)
+
+// Overflow is what Put does when a queue is over its limit.
+type Overflow string
+
+const (
+	// OverflowReject fails Put with ErrQueueFull or ErrQueueStorageFull.
+	OverflowReject Overflow = "reject"
+	// OverflowDropOldest drops the oldest waiting tasks of the queue.
+	OverflowDropOldest Overflow = "drop-oldest"
+	// OverflowDropNewest drops the new task, Put returns its id anyway.
+	OverflowDropNewest Overflow = "drop-newest"
+)
+
+// QueueLimit limits the waiting tasks of a queue, zero means no limit.
+// Payloads larger than MaxBytes are rejected by every overflow policy,
+// payloads offloaded to a blob store count by the blob size in their
+// references.
+type QueueLimit struct {
+	MaxLength uint64
+	MaxBytes  uint64
+	Overflow  Overflow
+}
+
+// check returns the error of the stats over the limit.
+func (l QueueLimit) check(stats backends.QueueStats) error {
+	if l.MaxLength > 0 && stats.WaitLength > l.MaxLength {
+		return backends.ErrQueueFull
+	}
+	if l.MaxBytes > 0 && stats.WaitBytes > l.MaxBytes {
+		return backends.ErrQueueStorageFull
+	}
+	return nil
+}
+
+// WithQueueLimit limits the waiting tasks of the queue, an empty queue name
+// sets the limit of queues without their own. Imported and restored tasks
+// are not limited.
+func WithQueueLimit(queue string, limit QueueLimit) Option {
+	return func(m *Memory) {
+		if m.limits == nil {
+			m.limits = make(map[string]QueueLimit)
+		}
+		if limit.Overflow == "" {
+			limit.Overflow = OverflowReject
+		}
+		m.limits[queue] = limit
+	}
+}
+
+// queueLimit returns the limit of the queue, false if it is not limited.
+func (m *Memory) queueLimit(queue string) (QueueLimit, bool) {
+	if limit, ok := m.limits[queue]; ok {
+		return limit, true
+	}
+	limit, ok := m.limits[""]
+	return limit, ok
+}
+
+// parseOverflow returns the overflow policy of the name.
+func parseOverflow(name string) (Overflow, error) {
+	switch overflow := Overflow(name); overflow {
+	case OverflowReject, OverflowDropOldest, OverflowDropNewest:
+		return overflow, nil
+	case "":
+		return OverflowReject, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// parseQueueLimit parses "queue,max_length,max_bytes,overflow" of the
+// queue_limit DSN parameter.
+func parseQueueLimit(value string) (string, QueueLimit, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) != 4 {
+		return "", QueueLimit{}, fmt.Errorf("queue limit %q: expected queue,max_length,max_bytes,overflow", value)
+	}
+	var limit QueueLimit
+	var err error
+	if limit.MaxLength, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+		return "", QueueLimit{}, fmt.Errorf("queue limit %q: %w", value, err)
+	}
+	if limit.MaxBytes, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+		return "", QueueLimit{}, fmt.Errorf("queue limit %q: %w", value, err)
+	}
+	if limit.Overflow, err = parseOverflow(fields[3]); err != nil {
+		return "", QueueLimit{}, fmt.Errorf("queue limit %q: %w", value, err)
+	}
+	return fields[0], limit, nil
+}
+
+// parseLimits returns the options of the max_length, max_bytes, overflow
+// and queue_limit DSN parameters.
+func parseLimits(config *backends.Config) ([]Option, error) {
+	var options []Option
+	params := config.Params
+	if params.Get("max_length") != "" || params.Get("max_bytes") != "" || params.Get("overflow") != "" {
+		var limit QueueLimit
+		var err error
+		if value := params.Get("max_length"); value != "" {
+			if limit.MaxLength, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return nil, fmt.Errorf("max_length: %w", err)
+			}
+		}
+		if value := params.Get("max_bytes"); value != "" {
+			if limit.MaxBytes, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return nil, fmt.Errorf("max_bytes: %w", err)
+			}
+		}
+		if limit.Overflow, err = parseOverflow(params.Get("overflow")); err != nil {
+			return nil, err
+		}
+		options = append(options, WithQueueLimit("", limit))
+	}
+	for _, value := range params["queue_limit"] {
+		queue, limit, err := parseQueueLimit(value)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, WithQueueLimit(queue, limit))
+	}
+	return options, nil
+}
+
+// dropOldest drops the oldest waiting tasks of the queue across its groups
+// while it is over the limit and returns their ids.
+func (m *Memory) dropOldest(q *queue, queueName string, limit QueueLimit) (dropped []string) {
+	for {
+		m.statsMutex.Lock()
+		over := limit.check(m.stats[queueName]) != nil
+		m.statsMutex.Unlock()
+		if !over {
+			return dropped
+		}
+		task := q.popOldest()
+		if task == nil {
+			return dropped
+		}
+		m.waiting.Delete(task.ID)
+		m.updateStats(queueName, func(stats *backends.QueueStats) {
+			stats.WaitLength--
+			stats.WaitBytes -= blob.PayloadSize(task.Payload)
+			stats.Dropped++
+			countGroup(stats, task.Group, false)
+		})
+		dropped = append(dropped, task.ID)
+	}
+}
+
+func (m *Memory) OnDrop(fn func(taskID string)) {
+	m.onDrop = fn
+}
+
+func (m *Memory) notifyDrop(taskIDs []string) {
+	if m.onDrop == nil {
+		return
+	}
+	for _, taskID := range taskIDs {
+		m.onDrop(taskID)
+	}
+}
@@ -1,34 +1,85 @@
 package memory
 
 import (
-	"encoding/json"
+	"context"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/blob"
 )
 
 type Memory struct {
 	queues sync.Map
 	work   sync.Map
 	ready  sync.Map
+	// waiting task id => task, index of the tasks in queues
+	waiting sync.Map
 
-	stats      map[string]backends.Stats
+	stats      map[string]backends.QueueStats
 	statsMutex sync.Mutex
 
 	taskIDCounter uint64
+
+	// queue name or "" for other queues => limit, nil if queues are not
+	// limited
+	limits map[string]QueueLimit
+	// called with the ids of tasks dropped by limits, nil if not set
+	onDrop func(taskID string)
+
+	// snapshot file, empty if snapshots are off
+	snapshotPath string
+	// tasks are changed under read lock, snapshot is taken under write lock
+	snapshotMutex sync.RWMutex
 }
 
-func New() (*Memory, error) {
-	return &Memory{
-		stats: make(map[string]backends.Stats),
-	}, nil
+// Option configures the memory backend.
+type Option func(m *Memory)
+
+// WithSnapshot saves the backend state to the file on Close and Snapshot
+// and loads it in New if the file exists.
+func WithSnapshot(path string) Option {
+	return func(m *Memory) {
+		m.snapshotPath = path
+	}
+}
+
+func init() {
+	backends.Register("memory", func(config *backends.Config) (backends.Backend, error) {
+		options, err := parseLimits(config)
+		if err != nil {
+			return nil, err
+		}
+		if path := config.Params.Get("snapshot"); path != "" {
+			options = append(options, WithSnapshot(path))
+		}
+		return New(options...)
+	})
 }
 
+func New(options ...Option) (*Memory, error) {
+	m := &Memory{
+		stats: make(map[string]backends.QueueStats),
+	}
+	for _, option := range options {
+		option(m)
+	}
+	if m.snapshotPath != "" {
+		if err := m.restore(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Close saves the snapshot if snapshots are on.
 func (m *Memory) Close() error {
-	return nil
+	if m.snapshotPath == "" {
+		return nil
+	}
+	return m.Snapshot(context.Background())
 }
 
 func (m *Memory) Name() string {
@@ -36,77 +87,147 @@ func (m *Memory) Name() string {
 }
 
 /*
-	task => queue pool
+	task => queue
 */
-func (m *Memory) Put(queue string, payload []byte, executionTimeout time.Duration) (taskID string, err error) {
+func (m *Memory) Put(ctx context.Context, queueName, group string, payload []byte, executionTimeout time.Duration) (taskID string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", backends.QueueError("put", queueName, err)
+	}
+	// tasks dropped by the limit are reported after the lock is released,
+	// onDrop may read the backend
+	var dropped []string
+	defer func() { m.notifyDrop(dropped) }()
+	m.snapshotMutex.RLock()
+	defer m.snapshotMutex.RUnlock()
+	size := blob.PayloadSize(payload)
+	limit, limited := m.queueLimit(queueName)
+	if limited && limit.MaxBytes > 0 && size > limit.MaxBytes {
+		return "", backends.QueueError("put", queueName, backends.ErrQueueStorageFull)
+	}
 	id := atomic.AddUint64(&m.taskIDCounter, 1)
 	taskID = strconv.FormatUint(id, 10)
-	q, ok := m.queues.Load(queue)
-	if !ok {
-		q = &sync.Pool{}
-		m.queues.Store(queue, q)
+	// count the task before it becomes visible to workers
+	var overflow error
+	m.updateStats(queueName, func(stats *backends.QueueStats) {
+		next := *stats
+		next.WaitLength++
+		next.WaitBytes += size
+		if limited && limit.Overflow != OverflowDropOldest {
+			if overflow = limit.check(next); overflow != nil {
+				if limit.Overflow == OverflowDropNewest {
+					stats.Dropped++
+				}
+				return
+			}
+		}
+		*stats = next
+		countGroup(stats, group, true)
+	})
+	if overflow != nil {
+		if limit.Overflow == OverflowDropNewest {
+			return taskID, nil
+		}
+		return "", backends.QueueError("put", queueName, overflow)
 	}
-	q.(*sync.Pool).Put(&backends.Task{
-		Queue:   queue,
+	task := &backends.Task{
+		Queue:   queueName,
 		ID:      taskID,
 		Payload: payload,
 		Timeout: executionTimeout,
-	})
-	m.updateStats(queue, func(stats *backends.Stats) {
-		stats.WaitLength++
-	})
+		Group:   group,
+	}
+	m.waiting.Store(taskID, task)
+	q, _ := m.queues.LoadOrStore(queueName, &queue{})
+	q.(*queue).push(task)
+	if limited && limit.Overflow == OverflowDropOldest {
+		dropped = m.dropOldest(q.(*queue), queueName, limit)
+	}
 	return taskID, nil
 }
 
 /*
-	queue pool => task
+	queue => task
 	task => executed map
 	timeout: delete(executed, task); task+error => ready map
 */
-func (m *Memory) GetNotReady(queue string) (taskID string, payload []byte, err error) {
-	q, ok := m.queues.Load(queue)
+func (m *Memory) GetNotReady(ctx context.Context, queueName string) (taskID string, payload []byte, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, backends.QueueError("get", queueName, err)
+	}
+	m.snapshotMutex.RLock()
+	defer m.snapshotMutex.RUnlock()
+	if m.paused(queueName) {
+		return "", nil, backends.QueueError("get", queueName, backends.ErrQueueNotFound)
+	}
+	q, ok := m.queues.Load(queueName)
 	if !ok {
-		return "", nil, backends.ErrQueueNotFound
+		return "", nil, backends.QueueError("get", queueName, backends.ErrQueueNotFound)
 	}
-	taskObject := q.(*sync.Pool).Get()
-	if taskObject == nil {
-		return "", nil, backends.ErrQueueNotFound
+	task := q.(*queue).pop()
+	if task == nil {
+		return "", nil, backends.QueueError("get", queueName, backends.ErrQueueNotFound)
 	}
-	task := taskObject.(*backends.Task)
+	m.waiting.Delete(task.ID)
 	m.work.Store(task.ID, task)
-	m.updateStats(queue, func(stats *backends.Stats) {
+	m.updateStats(queueName, func(stats *backends.QueueStats) {
 		stats.WaitLength--
+		stats.WaitBytes -= blob.PayloadSize(task.Payload)
 		stats.WorkLength++
+		countGroup(stats, task.Group, false)
 	})
-	go func() {
-		time.Sleep(task.Timeout)
-		m.work.Delete(task.ID)
-		task.Error = backends.ErrTaskExecutionTimeout
-		m.ready.Store(task.ID, task)
-	}()
+	go m.expire(task)
 	return task.ID, task.Payload, nil
 }
 
+// expire moves the running task to ready with the timeout error after its
+// execution timeout unless it is ready before.
+func (m *Memory) expire(task *backends.Task) {
+	time.Sleep(task.Timeout)
+	m.snapshotMutex.RLock()
+	defer m.snapshotMutex.RUnlock()
+	running, ok := m.work.LoadAndDelete(task.ID)
+	if !ok {
+		// already reported ready
+		return
+	}
+	if running != task {
+		// the task is deleted and imported again with its own timeout
+		m.work.Store(task.ID, running)
+		return
+	}
+	// readers may hold the running task, it is not changed
+	expired := *task
+	expired.Error = backends.ErrTaskExecutionTimeout
+	m.ready.Store(task.ID, &expired)
+	m.updateStats(task.Queue, func(stats *backends.QueueStats) {
+		stats.WorkLength--
+		stats.ReadyLength++
+	})
+}
+
 /*
 	ready map => task
 	delete(ready, task)
-	return result
+	return result or task error
 */
-func (m *Memory) GetReady(taskID string) (result []byte, err error) {
-	taskObject, ok := m.ready.Load(taskID)
+func (m *Memory) GetReady(ctx context.Context, taskID string) (result []byte, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, backends.TaskError("result", taskID, err)
+	}
+	m.snapshotMutex.RLock()
+	defer m.snapshotMutex.RUnlock()
+	taskObject, ok := m.ready.LoadAndDelete(taskID)
 	if !ok {
-		return nil, backends.ErrTaskNotFoundOrNotReady
+		return nil, backends.TaskError("result", taskID, backends.ErrTaskNotFoundOrNotReady)
 	}
 	task := taskObject.(*backends.Task)
-	if task.Error != nil {
-		return nil, task.Error
-	}
-	result = task.Result
-	m.ready.Delete(taskID)
-	m.updateStats(task.Queue, func(stats *backends.Stats) {
+	m.updateStats(task.Queue, func(stats *backends.QueueStats) {
 		stats.ReadyLength--
 	})
-	return result, nil
+	if task.Error != nil {
+		return nil, backends.TaskError("result", taskID, task.Error)
+	}
+	return task.Result, nil
 }
 
 /*
@@ -114,36 +235,85 @@ func (m *Memory) GetReady(taskID string) (result []byte, err error) {
 	delete(executed, task)
 	task => ready map
 */
-func (m *Memory) TaskReady(taskID string, result []byte) error {
-	taskObject, ok := m.work.Load(taskID)
+func (m *Memory) TaskReady(ctx context.Context, taskID string, result []byte) error {
+	if err := ctx.Err(); err != nil {
+		return backends.TaskError("ready", taskID, err)
+	}
+	m.snapshotMutex.RLock()
+	defer m.snapshotMutex.RUnlock()
+	taskObject, ok := m.work.LoadAndDelete(taskID)
 	if !ok {
-		return backends.ErrTaskNotFoundOrNotReady
+		return backends.TaskError("ready", taskID, backends.ErrTaskNotFoundOrNotReady)
 	}
-	task := taskObject.(*backends.Task)
+	// readers may hold the running task, it is not changed
+	task := *taskObject.(*backends.Task)
 	task.Result = result
-	m.work.Delete(taskID)
-	m.ready.Store(taskID, task)
-	m.updateStats(task.Queue, func(stats *backends.Stats) {
+	m.ready.Store(taskID, &task)
+	m.updateStats(task.Queue, func(stats *backends.QueueStats) {
 		stats.WorkLength--
 		stats.ReadyLength++
 	})
 	return nil
 }
 
-func (m *Memory) Stats() ([]byte, error) {
+func (m *Memory) Stats(ctx context.Context) (*backends.Stats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	m.statsMutex.Lock()
-	data, err := json.MarshalIndent(m.stats, "", "  ")
+	queues := make(map[string]backends.QueueStats, len(m.stats))
+	for queue, stats := range m.stats {
+		// the groups map is changed by later calls
+		groups := stats.WaitGroups
+		stats.WaitGroups = nil
+		stats.Add(backends.QueueStats{WaitGroups: groups})
+		queues[queue] = stats
+	}
 	m.statsMutex.Unlock()
-	return data, err
+	return backends.NewStats(queues), nil
+}
+
+func (m *Memory) QueueStats(ctx context.Context, queue string) (backends.QueueStats, error) {
+	if err := ctx.Err(); err != nil {
+		return backends.QueueStats{}, err
+	}
+	m.statsMutex.Lock()
+	defer m.statsMutex.Unlock()
+	stats := m.stats[queue]
+	// the groups map is changed by later calls
+	groups := stats.WaitGroups
+	stats.WaitGroups = nil
+	stats.Add(backends.QueueStats{WaitGroups: groups})
+	return stats, nil
 }
 
-func (m *Memory) updateStats(queue string, cb func(stats *backends.Stats)) {
+func (m *Memory) updateStats(queue string, cb func(stats *backends.QueueStats)) {
 	m.statsMutex.Lock()
 	stats, ok := m.stats[queue]
 	if !ok {
-		stats = backends.Stats{}
+		stats = backends.QueueStats{}
 	}
 	cb(&stats)
 	m.stats[queue] = stats
 	m.statsMutex.Unlock()
 }
+
+// countGroup counts the waiting task of the group in the stats, added or
+// removed. Tasks without a group are not counted.
+func countGroup(stats *backends.QueueStats, group string, added bool) {
+	if group == "" {
+		return
+	}
+	if added {
+		if stats.WaitGroups == nil {
+			stats.WaitGroups = make(map[string]uint64)
+		}
+		stats.WaitGroups[group]++
+		return
+	}
+	if stats.WaitGroups[group] <= 1 {
+		delete(stats.WaitGroups, group)
+		return
+	}
+	stats.WaitGroups[group]--
+}
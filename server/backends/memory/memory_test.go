@@ -2,13 +2,23 @@ package memory
 
 import (
 	"bytes"
-	"sync"
+	"context"
+	"errors"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/backendtest"
+	"github.com/alexio777/stq/server/blob"
 )
 
+func Test_Conformance(t *testing.T) {
+	backendtest.Run(t, func() (backends.Backend, error) {
+		return New()
+	})
+}
+
 func Test_MemoryBackend(t *testing.T) {
 	t.Run("Put", func(t *testing.T) {
 		t.Run("Put task to queue", func(t *testing.T) {
@@ -16,22 +26,21 @@ func Test_MemoryBackend(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			taskID, err := backend.Put("queue", []byte("payload"), time.Minute)
+			taskID, err := backend.Put(context.TODO(), "queue", "", []byte("payload"), time.Minute)
 			if err != nil {
 				t.Fatal(err)
 			}
 			if taskID == "" {
 				t.Fatal("taskID is empty")
 			}
-			queue, ok := backend.queues.Load("queue")
+			q, ok := backend.queues.Load("queue")
 			if !ok {
 				t.Fatal("queue not found")
 			}
-			taskObject := queue.(*sync.Pool).Get()
-			if taskObject == nil {
-				t.Fatal("taskObject is nil")
+			task := q.(*queue).pop()
+			if task == nil {
+				t.Fatal("task is nil")
 			}
-			task := taskObject.(*backends.Task)
 			if task.ID != taskID {
 				t.Fatalf("taskID is not equal: %s != %s", task.ID, taskID)
 			}
@@ -43,43 +52,39 @@ func Test_MemoryBackend(t *testing.T) {
 			t.Fatal(err)
 		}
 		t.Run("Check execution timeout", func(t *testing.T) {
-			taskID, err := backend.Put("queue", []byte("timeout"), time.Nanosecond)
+			taskID, err := backend.Put(context.TODO(), "queue", "", []byte("timeout"), time.Nanosecond)
 			if err != nil {
 				t.Fatal(err)
 			}
-			_, _, err = backend.GetNotReady("queue")
+			_, _, err = backend.GetNotReady(context.TODO(), "queue")
 			if err != nil {
 				t.Fatal(err)
 			}
 			time.Sleep(time.Millisecond)
-			task, err := backend.GetReady(taskID)
+			task, err := backend.GetReady(context.TODO(), taskID)
 			if task != nil {
 				t.Fatal("task is not nil")
 			}
-			if err != backends.ErrTaskExecutionTimeout {
+			if !errors.Is(err, backends.ErrTaskExecutionTimeout) {
 				t.Fatalf("task execution timeout is not detected: %s", err)
 			}
 			q, ok := backend.queues.Load("queue")
 			if !ok {
 				t.Fatal("queue not found")
 			}
-			taskObject := q.(*sync.Pool).Get()
-			if taskObject != nil {
-				task := taskObject.(*backends.Task)
-				if task != nil {
-					t.Fatal("task is not nil")
-				}
+			if task := q.(*queue).pop(); task != nil {
+				t.Fatal("task is not nil")
 			}
 			_, ok = backend.work.Load(taskID)
 			if ok {
 				t.Fatal("task is not deleted from inprocess")
 			}
 		})
-		taskID, err := backend.Put("queue", []byte("payload"), time.Minute)
+		taskID, err := backend.Put(context.TODO(), "queue", "", []byte("payload"), time.Minute)
 		if err != nil {
 			t.Fatal(err)
 		}
-		notready_taskID, payload, err := backend.GetNotReady("queue")
+		notready_taskID, payload, err := backend.GetNotReady(context.TODO(), "queue")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -93,26 +98,18 @@ func Test_MemoryBackend(t *testing.T) {
 		if !ok {
 			t.Fatal("queue not found")
 		}
-		taskObject := q.(*sync.Pool).Get()
-		if taskObject != nil {
-			task := taskObject.(*backends.Task)
-			if task != nil {
-				t.Fatal("task is not nil")
-			}
+		if task := q.(*queue).pop(); task != nil {
+			t.Fatal("task is not nil")
 		}
-		if err := backend.TaskReady(taskID, []byte("done")); err != nil {
+		if err := backend.TaskReady(context.TODO(), taskID, []byte("done")); err != nil {
 			t.Fatal(err)
 		}
 		q, ok = backend.queues.Load("queue")
 		if !ok {
 			t.Fatal("queue not found")
 		}
-		taskObject = q.(*sync.Pool).Get()
-		if taskObject != nil {
-			task := taskObject.(*backends.Task)
-			if task != nil {
-				t.Fatal("task is not nil")
-			}
+		if task := q.(*queue).pop(); task != nil {
+			t.Fatal("task is not nil")
 		}
 		_, ok = backend.work.Load(taskID)
 		if ok {
@@ -131,7 +128,7 @@ func Test_MemoryBackend(t *testing.T) {
 		if !bytes.Equal(task.(*backends.Task).Result, []byte("done")) {
 			t.Fatalf("task result is not equal: %s != %s", string(task.(*backends.Task).Result), "done")
 		}
-		result, err := backend.GetReady(taskID)
+		result, err := backend.GetReady(context.TODO(), taskID)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -143,4 +140,209 @@ func Test_MemoryBackend(t *testing.T) {
 			t.Fatalf("task is not empty: %s", task.(*backends.Task).ID)
 		}
 	})
+	t.Run("QueueStats", func(t *testing.T) {
+		backend, err := New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, queue := range []string{"queue", "queue", "other"} {
+			if _, err := backend.Put(context.TODO(), queue, "", []byte("payload"), time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := backend.GetNotReady(context.TODO(), "queue"); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := backends.QueueStatsOf(context.TODO(), backend, "queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.WaitLength != 1 || stats.WorkLength != 1 {
+			t.Fatalf("stats are not equal: %d/%d != 1/1", stats.WaitLength, stats.WorkLength)
+		}
+		stats, err = backends.QueueStatsOf(context.TODO(), backend, "missing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.WaitLength != 0 || stats.WorkLength != 0 {
+			t.Fatalf("stats are not equal: %d/%d != 0/0", stats.WaitLength, stats.WorkLength)
+		}
+	})
+}
+
+func Test_QueueLimits(t *testing.T) {
+	ctx := context.TODO()
+	put := func(backend *Memory, queue string, payload string) (string, error) {
+		return backend.Put(ctx, queue, "", []byte(payload), time.Minute)
+	}
+	t.Run("Reject", func(t *testing.T) {
+		backend, err := New(WithQueueLimit("", QueueLimit{MaxLength: 2, MaxBytes: 10}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, payload := range []string{"1", "2"} {
+			if _, err := put(backend, "queue", payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := put(backend, "queue", "3"); !errors.Is(err, backends.ErrQueueFull) {
+			t.Fatalf("full queue is not detected: %v", err)
+		}
+		if _, err := put(backend, "other", "payload_1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := put(backend, "other", "payload_2"); !errors.Is(err, backends.ErrQueueStorageFull) {
+			t.Fatalf("full queue storage is not detected: %v", err)
+		}
+		if _, err := put(backend, "empty", "large payload"); !errors.Is(err, backends.ErrQueueStorageFull) {
+			t.Fatalf("large payload is not detected: %v", err)
+		}
+		// a blob counts by its size, not by the size of the reference
+		if _, err := backend.Put(ctx, "blob", "", blob.Reference("id", 11), time.Minute); !errors.Is(err, backends.ErrQueueStorageFull) {
+			t.Fatalf("large blob is not detected: %v", err)
+		}
+		if _, _, err := backend.GetNotReady(ctx, "queue"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := put(backend, "queue", "3"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("Drop oldest", func(t *testing.T) {
+		backend, err := New(WithQueueLimit("queue", QueueLimit{MaxLength: 2, Overflow: OverflowDropOldest}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, payload := range []string{"1", "2", "3"} {
+			if _, err := put(backend, "queue", payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stats, err := backend.Stats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(stats.Queues["queue"], backends.QueueStats{WaitLength: 2, WaitBytes: 2, Dropped: 1}) {
+			t.Fatalf("unexpected queue stats: %+v", stats.Queues["queue"])
+		}
+		if _, payload, err := backend.GetNotReady(ctx, "queue"); err != nil || string(payload) != "2" {
+			t.Fatalf("payload is not equal: %s != %s (%v)", payload, "2", err)
+		}
+		if _, err := backend.Task(ctx, "1"); !errors.Is(err, backends.ErrTaskNotFound) {
+			t.Fatalf("dropped task is found: %v", err)
+		}
+	})
+	t.Run("Drop oldest of groups", func(t *testing.T) {
+		backend, err := New(WithQueueLimit("queue", QueueLimit{MaxLength: 3, Overflow: OverflowDropOldest}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, task := range [][2]string{{"a", "a1"}, {"a", "a2"}, {"b", "b1"}, {"b", "b2"}, {"c", "c1"}} {
+			if _, err := backend.Put(ctx, "queue", task[0], []byte(task[1]), time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}
+		payloads := make(map[string]bool)
+		for i := 0; i < 3; i++ {
+			_, payload, err := backend.GetNotReady(ctx, "queue")
+			if err != nil {
+				t.Fatal(err)
+			}
+			payloads[string(payload)] = true
+		}
+		if !reflect.DeepEqual(payloads, map[string]bool{"b1": true, "b2": true, "c1": true}) {
+			t.Fatalf("payloads are not equal: %v != [b1 b2 c1]", payloads)
+		}
+	})
+	t.Run("Drop newest", func(t *testing.T) {
+		backend, err := New(WithQueueLimit("queue", QueueLimit{MaxLength: 1, Overflow: OverflowDropNewest}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := put(backend, "queue", "1"); err != nil {
+			t.Fatal(err)
+		}
+		taskID, err := put(backend, "queue", "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := backend.Task(ctx, taskID); !errors.Is(err, backends.ErrTaskNotFound) {
+			t.Fatalf("dropped task is found: %v", err)
+		}
+		stats, err := backend.Stats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(stats.Queues["queue"], backends.QueueStats{WaitLength: 1, WaitBytes: 1, Dropped: 1}) {
+			t.Fatalf("unexpected queue stats: %+v", stats.Queues["queue"])
+		}
+	})
+	t.Run("DSN", func(t *testing.T) {
+		backend, err := backends.Open("memory://?max_length=1&overflow=drop-newest&queue_limit=orders,2,0,reject")
+		if err != nil {
+			t.Fatal(err)
+		}
+		memory := backend.(*Memory)
+		if limit, _ := memory.queueLimit("other"); limit != (QueueLimit{MaxLength: 1, Overflow: OverflowDropNewest}) {
+			t.Fatalf("unexpected limit: %+v", limit)
+		}
+		if limit, _ := memory.queueLimit("orders"); limit != (QueueLimit{MaxLength: 2, Overflow: OverflowReject}) {
+			t.Fatalf("unexpected limit: %+v", limit)
+		}
+		if _, err := backends.Open("memory://?overflow=unknown"); err == nil {
+			t.Fatal("unknown overflow policy is not detected")
+		}
+	})
+}
+
+func Test_Groups(t *testing.T) {
+	ctx := context.TODO()
+	backend, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(group string, payload string) {
+		if _, err := backend.Put(ctx, "queue", group, []byte(payload), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("a", "a1")
+	put("a", "a2")
+	put("a", "a3")
+	put("b", "b1")
+	put("", "n1")
+	stats, err := backend.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stats.Queues["queue"].WaitGroups, map[string]uint64{"a": 3, "b": 1}) {
+		t.Fatalf("unexpected wait groups: %v", stats.Queues["queue"].WaitGroups)
+	}
+	var payloads []string
+	for i := 0; i < 3; i++ {
+		_, payload, err := backend.GetNotReady(ctx, "queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, string(payload))
+	}
+	put("c", "c1")
+	for i := 0; i < 3; i++ {
+		_, payload, err := backend.GetNotReady(ctx, "queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, string(payload))
+	}
+	expected := []string{"a1", "b1", "n1", "a2", "c1", "a3"}
+	if !reflect.DeepEqual(payloads, expected) {
+		t.Fatalf("payloads are not equal: %v != %v", payloads, expected)
+	}
+	stats, err = backend.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Queues["queue"].WaitGroups) != 0 {
+		t.Fatalf("unexpected wait groups: %v", stats.Queues["queue"].WaitGroups)
+	}
 }
@@ -0,0 +1,40 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+// SetPaused pauses or resumes dispatch of the queue, paused queues are saved
+// in snapshots.
+func (m *Memory) SetPaused(ctx context.Context, queue string, paused bool) error {
+	if err := ctx.Err(); err != nil {
+		return backends.QueueError("pause", queue, err)
+	}
+	m.snapshotMutex.RLock()
+	defer m.snapshotMutex.RUnlock()
+	m.updateStats(queue, func(stats *backends.QueueStats) {
+		stats.Paused = paused
+	})
+	return nil
+}
+
+func (m *Memory) paused(queue string) bool {
+	m.statsMutex.Lock()
+	defer m.statsMutex.Unlock()
+	return m.stats[queue].Paused
+}
+
+// pausedQueues returns the names of the paused queues.
+func (m *Memory) pausedQueues() []string {
+	m.statsMutex.Lock()
+	defer m.statsMutex.Unlock()
+	var queues []string
+	for queue, stats := range m.stats {
+		if stats.Paused {
+			queues = append(queues, queue)
+		}
+	}
+	return queues
+}
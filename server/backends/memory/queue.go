@@ -0,0 +1,145 @@
+package memory
+
+import (
+	"sync"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+// queue is a FIFO list of waiting tasks per group. pop takes tasks of the
+// groups in turns, tasks without a group are a group too.
+type queue struct {
+	mutex  sync.Mutex
+	groups map[string][]*backends.Task
+	// groups with tasks in turn order
+	order []string
+	// index in order of the group to pop next
+	next int
+}
+
+func (q *queue) push(task *backends.Task) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.groups == nil {
+		q.groups = make(map[string][]*backends.Task)
+	}
+	tasks, ok := q.groups[task.Group]
+	if !ok {
+		// the new group gets its turn after the groups waiting already
+		q.order = append(q.order, "")
+		copy(q.order[q.next+1:], q.order[q.next:])
+		q.order[q.next] = task.Group
+		q.next++
+		if q.next == len(q.order) {
+			q.next = 0
+		}
+	}
+	q.groups[task.Group] = append(tasks, task)
+}
+
+func (q *queue) pop() *backends.Task {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.order) == 0 {
+		return nil
+	}
+	group := q.order[q.next]
+	tasks := q.groups[group]
+	task := tasks[0]
+	tasks[0] = nil
+	if len(tasks) == 1 {
+		q.removeGroup(q.next)
+	} else {
+		q.groups[group] = tasks[1:]
+		q.next = (q.next + 1) % len(q.order)
+	}
+	return task
+}
+
+// popOldest removes and returns the task with the lowest id of all groups,
+// the first put one, the turns of the groups do not change. Ids are kept by
+// export and import, so a copy of the queue drops the same tasks.
+func (q *queue) popOldest() *backends.Task {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.order) == 0 {
+		return nil
+	}
+	oldest := 0
+	for i, group := range q.order {
+		if lessTaskID(q.groups[group][0].ID, q.groups[q.order[oldest]][0].ID) {
+			oldest = i
+		}
+	}
+	group := q.order[oldest]
+	tasks := q.groups[group]
+	task := tasks[0]
+	tasks[0] = nil
+	if len(tasks) == 1 {
+		q.removeGroup(oldest)
+	} else {
+		q.groups[group] = tasks[1:]
+	}
+	return task
+}
+
+// removeGroup removes the empty group at index i of order, the next group
+// takes its turn.
+func (q *queue) removeGroup(i int) {
+	delete(q.groups, q.order[i])
+	q.order = append(q.order[:i], q.order[i+1:]...)
+	if i < q.next {
+		q.next--
+	}
+	if q.next >= len(q.order) {
+		q.next = 0
+	}
+}
+
+func (q *queue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	n := 0
+	for _, tasks := range q.groups {
+		n += len(tasks)
+	}
+	return n
+}
+
+// list returns a copy of the waiting tasks, the groups in turn order with
+// their tasks in FIFO order.
+func (q *queue) list() []*backends.Task {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var tasks []*backends.Task
+	for i := range q.order {
+		group := q.order[(q.next+i)%len(q.order)]
+		tasks = append(tasks, q.groups[group]...)
+	}
+	return tasks
+}
+
+// remove removes the task from the queue and returns false if there is no
+// such task.
+func (q *queue) remove(task *backends.Task) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	tasks := q.groups[task.Group]
+	for i, t := range tasks {
+		if t != task {
+			continue
+		}
+		if len(tasks) == 1 {
+			for j, group := range q.order {
+				if group == task.Group {
+					q.removeGroup(j)
+					break
+				}
+			}
+			return true
+		}
+		q.groups[task.Group] = append(tasks[:i], tasks[i+1:]...)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/blob"
+)
+
+const snapshotVersion = 1
+
+// snapshot is the state of the backend saved to the snapshot file.
+type snapshot struct {
+	Version       int
+	TaskIDCounter uint64
+	// waiting tasks by queue in FIFO order
+	Queues map[string][]snapshotTask
+	// running tasks are waiting again after restore
+	Running []snapshotTask
+	Ready   []snapshotTask
+	// queues with paused dispatch
+	Paused []string `json:",omitempty"`
+}
+
+type snapshotTask struct {
+	Queue   string
+	ID      string
+	Payload []byte
+	Result  []byte
+	Error   string
+	Timeout time.Duration
+	Group   string `json:",omitempty"`
+}
+
+func newSnapshotTask(task *backends.Task) snapshotTask {
+	s := snapshotTask{
+		Queue:   task.Queue,
+		ID:      task.ID,
+		Payload: task.Payload,
+		Result:  task.Result,
+		Timeout: task.Timeout,
+		Group:   task.Group,
+	}
+	if task.Error != nil {
+		s.Error = task.Error.Error()
+	}
+	return s
+}
+
+func (s snapshotTask) task() *backends.Task {
+	task := &backends.Task{
+		Queue:   s.Queue,
+		ID:      s.ID,
+		Payload: s.Payload,
+		Result:  s.Result,
+		Timeout: s.Timeout,
+		Group:   s.Group,
+	}
+	switch s.Error {
+	case "":
+	case backends.ErrTaskExecutionTimeout.Error():
+		task.Error = backends.ErrTaskExecutionTimeout
+	default:
+		task.Error = errors.New(s.Error)
+	}
+	return task
+}
+
+// Snapshot saves the state of all queues, running tasks, ready results,
+// paused queues and the task id counter to the snapshot file. Calls are
+// blocked while the state is copied.
+func (m *Memory) Snapshot(ctx context.Context) error {
+	if m.snapshotPath == "" {
+		return backends.ErrSnapshotsOff
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.snapshotMutex.Lock()
+	s := m.snapshot()
+	m.snapshotMutex.Unlock()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	// write a new file and replace the old one, so a crash while writing
+	// does not break the previous snapshot
+	f, err := ioutil.TempFile(filepath.Dir(m.snapshotPath), filepath.Base(m.snapshotPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), m.snapshotPath)
+}
+
+func (m *Memory) snapshot() *snapshot {
+	s := &snapshot{
+		Version:       snapshotVersion,
+		TaskIDCounter: atomic.LoadUint64(&m.taskIDCounter),
+		Queues:        make(map[string][]snapshotTask),
+		Paused:        m.pausedQueues(),
+	}
+	m.queues.Range(func(name, q interface{}) bool {
+		for _, task := range q.(*queue).list() {
+			s.Queues[name.(string)] = append(s.Queues[name.(string)], newSnapshotTask(task))
+		}
+		return true
+	})
+	m.work.Range(func(_, task interface{}) bool {
+		s.Running = append(s.Running, newSnapshotTask(task.(*backends.Task)))
+		return true
+	})
+	m.ready.Range(func(_, task interface{}) bool {
+		s.Ready = append(s.Ready, newSnapshotTask(task.(*backends.Task)))
+		return true
+	})
+	return s
+}
+
+// restore loads the snapshot file if it exists. Running tasks are put back
+// to the head of their queues.
+func (m *Memory) restore() error {
+	data, err := ioutil.ReadFile(m.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("snapshot %s: %w", m.snapshotPath, err)
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("snapshot %s: unsupported version %d", m.snapshotPath, s.Version)
+	}
+	m.taskIDCounter = s.TaskIDCounter
+	// running tasks were taken from queues before the waiting ones
+	sort.Slice(s.Running, func(i, j int) bool {
+		return lessTaskID(s.Running[i].ID, s.Running[j].ID)
+	})
+	waiting := make(map[string][]snapshotTask)
+	for _, task := range s.Running {
+		waiting[task.Queue] = append(waiting[task.Queue], task)
+	}
+	for name, tasks := range s.Queues {
+		waiting[name] = append(waiting[name], tasks...)
+	}
+	for name, tasks := range waiting {
+		q := &queue{}
+		var size uint64
+		for _, task := range tasks {
+			restored := task.task()
+			m.waiting.Store(restored.ID, restored)
+			q.push(restored)
+			size += blob.PayloadSize(restored.Payload)
+		}
+		m.queues.Store(name, q)
+		m.updateStats(name, func(stats *backends.QueueStats) {
+			stats.WaitLength += uint64(len(tasks))
+			stats.WaitBytes += size
+			for _, task := range tasks {
+				countGroup(stats, task.Group, true)
+			}
+		})
+	}
+	for _, name := range s.Paused {
+		m.updateStats(name, func(stats *backends.QueueStats) {
+			stats.Paused = true
+		})
+	}
+	for _, task := range s.Ready {
+		m.ready.Store(task.ID, task.task())
+		m.updateStats(task.Queue, func(stats *backends.QueueStats) {
+			stats.ReadyLength++
+		})
+	}
+	return nil
+}
+
+// lessTaskID compares numeric task ids.
+func lessTaskID(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
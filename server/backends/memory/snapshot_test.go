@@ -0,0 +1,142 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/backendtest"
+)
+
+func Test_SnapshotConformance(t *testing.T) {
+	dir := t.TempDir()
+	n := 0
+	backendtest.Run(t, func() (backends.Backend, error) {
+		n++
+		return New(WithSnapshot(filepath.Join(dir, fmt.Sprint(n))))
+	})
+}
+
+func Test_Snapshot(t *testing.T) {
+	ctx := context.TODO()
+	path := filepath.Join(t.TempDir(), "memory.snapshot")
+	backend, err := New(WithSnapshot(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		if _, err := backend.Put(ctx, "queue", "", []byte(fmt.Sprint("payload_", i)), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := backend.Put(ctx, "timeout", "", []byte("payload_5"), time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	// 1 is ready, 2 is running, 3 and 4 are waiting, 5 is timed out
+	if _, _, err := backend.GetNotReady(ctx, "queue"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.TaskReady(ctx, "1", []byte("result_1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := backend.GetNotReady(ctx, "queue"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := backend.GetNotReady(ctx, "timeout"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.SetPaused(ctx, "queue", true); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := backend.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := New(WithSnapshot(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := restored.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stats.Queues["queue"], backends.QueueStats{WaitLength: 3, ReadyLength: 1, WaitBytes: 27, Paused: true}) {
+		t.Fatalf("unexpected queue stats: %+v", stats.Queues["queue"])
+	}
+	if !reflect.DeepEqual(stats.Queues["timeout"], backends.QueueStats{ReadyLength: 1}) {
+		t.Fatalf("unexpected timeout stats: %+v", stats.Queues["timeout"])
+	}
+	if _, _, err := restored.GetNotReady(ctx, "queue"); !errors.Is(err, backends.ErrQueueNotFound) {
+		t.Fatalf("pause is not restored: %v", err)
+	}
+	if err := restored.SetPaused(ctx, "queue", false); err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= 4; i++ {
+		taskID, payload, err := restored.GetNotReady(ctx, "queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if taskID != fmt.Sprint(i) || string(payload) != fmt.Sprint("payload_", i) {
+			t.Fatalf("unexpected task: %s %s", taskID, payload)
+		}
+	}
+	result, err := restored.GetReady(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "result_1" {
+		t.Fatalf("result is not equal: %s != %s", result, "result_1")
+	}
+	if _, err := restored.GetReady(ctx, "5"); !errors.Is(err, backends.ErrTaskExecutionTimeout) {
+		t.Fatalf("timeout is not restored: %v", err)
+	}
+	taskID, err := restored.Put(ctx, "queue", "", nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taskID != "6" {
+		t.Fatalf("task id counter is not restored: %s", taskID)
+	}
+}
+
+func Test_SnapshotsOff(t *testing.T) {
+	backend, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Snapshot(context.TODO()); err != backends.ErrSnapshotsOff {
+		t.Fatalf("snapshot without file is not detected: %v", err)
+	}
+}
+
+func Test_SnapshotDSN(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memory.snapshot")
+	backend, err := backends.Open("memory://?snapshot=" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Put(context.TODO(), "queue", "", []byte("payload"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var snapshotter backends.Snapshotter
+	if !backends.As(backend, &snapshotter) {
+		t.Fatal("memory backend is not a snapshotter")
+	}
+	if err := snapshotter.Snapshot(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := New(WithSnapshot(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, payload, err := restored.GetNotReady(context.TODO(), "queue"); err != nil || string(payload) != "payload" {
+		t.Fatalf("task is not restored: %s %v", payload, err)
+	}
+}
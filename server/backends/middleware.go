@@ -0,0 +1,57 @@
+package backends
+
+import (
+	"reflect"
+)
+
+// Middleware wraps a backend with a cross-cutting layer like logging or
+// metrics. Wrappers embed the wrapped Backend, so methods they do not
+// intercept are passed through, and implement Wrapper.
+type Middleware func(Backend) Backend
+
+// Wrapper is a backend wrapping another one.
+type Wrapper interface {
+	// Get the wrapped backend.
+	Unwrap() Backend
+}
+
+// Chain wraps the backend with the middlewares. The first middleware is the
+// outermost layer and sees calls first.
+func Chain(backend Backend, middlewares ...Middleware) Backend {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		backend = middlewares[i](backend)
+	}
+	return backend
+}
+
+// Unwrap returns the backend wrapped by the backend or nil.
+func Unwrap(backend Backend) Backend {
+	wrapper, ok := backend.(Wrapper)
+	if !ok {
+		return nil
+	}
+	return wrapper.Unwrap()
+}
+
+// As finds the first backend in the chain of wrappers that implements the
+// interface target points to, sets target to it and returns true. Optional
+// backend features like snapshots are looked up with it:
+//
+//	var snapshotter backends.Snapshotter
+//	if backends.As(backend, &snapshotter) {
+//		err = snapshotter.Snapshot(ctx)
+//	}
+func As(backend Backend, target interface{}) bool {
+	value := reflect.ValueOf(target)
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Interface {
+		panic("backends: As target must be a non-nil pointer to an interface")
+	}
+	targetType := value.Elem().Type()
+	for ; backend != nil; backend = Unwrap(backend) {
+		if reflect.TypeOf(backend).Implements(targetType) {
+			value.Elem().Set(reflect.ValueOf(backend))
+			return true
+		}
+	}
+	return false
+}
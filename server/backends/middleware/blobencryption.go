@@ -0,0 +1,252 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/blob"
+)
+
+// encryptBlobMagic marks encrypted blobs.
+var encryptBlobMagic = []byte("\x00stq-aes-blob\x00")
+
+// blobChunkSize is the size of the plaintext chunks of encrypted blobs.
+const blobChunkSize = 64 << 10
+
+var errInvalidBlob = errors.New("invalid encrypted blob")
+
+// KeysOf returns the keys of an encryption layer of the backend chain,
+// false if there is none.
+func KeysOf(backend backends.Backend) (*Keys, bool) {
+	for ; backend != nil; backend = backends.Unwrap(backend) {
+		if e, ok := backend.(*encrypt); ok {
+			return e.keys, true
+		}
+	}
+	return nil, false
+}
+
+// EncryptBlobs returns the store keeping blobs encrypted with the keys like
+// Encrypt keeps payloads and results. Blobs are sealed in chunks, so they
+// are streamed and a truncated blob fails to read. Blobs stored without
+// encryption are read as is.
+//
+//	magic, key id length, key id, nonce, sealed data key, sealed chunks
+//
+// The data key is made for every blob, chunk nonces count chunks from zero
+// and the last chunk is shorter than blobChunkSize, empty if need be.
+func EncryptBlobs(store blob.Store, keys *Keys) blob.Store {
+	return &encryptedBlobs{store: store, keys: keys}
+}
+
+type encryptedBlobs struct {
+	store blob.Store
+	keys  *Keys
+}
+
+func (b *encryptedBlobs) Put(ctx context.Context, r io.Reader) (string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	keyAEAD := b.keys.aeads[b.keys.current]
+	header := append([]byte(nil), encryptBlobMagic...)
+	header = append(header, byte(len(b.keys.current)))
+	header = append(header, b.keys.current...)
+	if header, err = appendSealed(header, keyAEAD, dataKey, []byte(b.keys.current)); err != nil {
+		return "", err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(sealChunks(pw, header, dataAEAD, r))
+	}()
+	id, err := b.store.Put(ctx, pr)
+	// stop sealing if the store failed
+	pr.CloseWithError(errors.New("blob store is done"))
+	return id, err
+}
+
+// sealChunks writes the header and the content of r sealed in chunks to w.
+func sealChunks(w io.Writer, header []byte, aead cipher.AEAD, r io.Reader) error {
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	chunk := make([]byte, blobChunkSize)
+	sealed := make([]byte, 0, blobChunkSize+aead.Overhead())
+	for n := uint64(0); ; n++ {
+		size, err := io.ReadFull(r, chunk)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		sealed = aead.Seal(sealed[:0], chunkNonce(aead, n), chunk[:size], chunkAD(last))
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func chunkNonce(aead cipher.AEAD, n uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+// chunkAD marks the last chunk, so a blob cut at a chunk end does not open.
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func (b *encryptedBlobs) Get(ctx context.Context, id string) (io.ReadCloser, int64, error) {
+	content, size, err := b.store.Get(ctx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	r := bufio.NewReader(content)
+	magic, err := r.Peek(len(encryptBlobMagic))
+	if !bytes.Equal(magic, encryptBlobMagic) {
+		if err != nil && err != io.EOF {
+			content.Close()
+			return nil, 0, err
+		}
+		return readCloser{Reader: r, Closer: content}, size, nil
+	}
+	dataAEAD, headerSize, err := b.openHeader(r)
+	if err != nil {
+		content.Close()
+		return nil, 0, fmt.Errorf("blob %s: %w", id, err)
+	}
+	plainSize, ok := plainBlobSize(size-headerSize, dataAEAD.Overhead())
+	if !ok {
+		content.Close()
+		return nil, 0, fmt.Errorf("blob %s: %w", id, errInvalidBlob)
+	}
+	return readCloser{Reader: &chunkReader{r: r, aead: dataAEAD}, Closer: content}, plainSize, nil
+}
+
+// openHeader reads the header of the encrypted blob and returns the AEAD of
+// its data key with the header size.
+func (b *encryptedBlobs) openHeader(r io.Reader) (cipher.AEAD, int64, error) {
+	prefix := make([]byte, len(encryptBlobMagic)+1)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, 0, errInvalidBlob
+	}
+	keyID := make([]byte, prefix[len(prefix)-1])
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, 0, errInvalidBlob
+	}
+	keyAEAD, ok := b.keys.aeads[string(keyID)]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	sealedKey := make([]byte, keyAEAD.NonceSize()+dataKeySize+keyAEAD.Overhead())
+	if _, err := io.ReadFull(r, sealedKey); err != nil {
+		return nil, 0, errInvalidBlob
+	}
+	dataKey, err := keyAEAD.Open(nil, sealedKey[:keyAEAD.NonceSize()], sealedKey[keyAEAD.NonceSize():], keyID)
+	if err != nil {
+		return nil, 0, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	return dataAEAD, int64(len(prefix) + len(keyID) + len(sealedKey)), nil
+}
+
+// plainBlobSize returns the content size of sealed chunks of the size.
+func plainBlobSize(size int64, overhead int) (int64, bool) {
+	sealedChunk := int64(blobChunkSize + overhead)
+	chunks := size / sealedChunk
+	last := size % sealedChunk
+	if size < 0 || last < int64(overhead) {
+		return 0, false
+	}
+	return chunks*blobChunkSize + last - int64(overhead), true
+}
+
+// chunkReader opens the sealed chunks read from r.
+type chunkReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	n     uint64
+	chunk []byte
+	buf   []byte
+	done  bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+// next opens the next chunk, a short one is the last.
+func (c *chunkReader) next() error {
+	if c.buf == nil {
+		c.buf = make([]byte, blobChunkSize+c.aead.Overhead())
+	}
+	size, err := io.ReadFull(c.r, c.buf)
+	last := err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		if err == io.EOF {
+			// the last chunk is missing
+			return errInvalidBlob
+		}
+		return err
+	}
+	chunk, err := c.aead.Open(c.buf[:0], chunkNonce(c.aead, c.n), c.buf[:size], chunkAD(last))
+	if err != nil {
+		return errInvalidBlob
+	}
+	c.n++
+	c.chunk = chunk
+	c.done = last
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (b *encryptedBlobs) Delete(ctx context.Context, id string) error {
+	return b.store.Delete(ctx, id)
+}
+
+// Blobs lists the blobs of the store, ErrNotSupported if it can not list
+// them.
+func (b *encryptedBlobs) Blobs(ctx context.Context, fn func(id string, stored time.Time) error) error {
+	lister, ok := b.store.(blob.Lister)
+	if !ok {
+		return backends.ErrNotSupported
+	}
+	return lister.Blobs(ctx, fn)
+}
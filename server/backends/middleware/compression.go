@@ -0,0 +1,220 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/blob"
+)
+
+// gzipMagic marks compressed payloads and results.
+var gzipMagic = []byte("\x00stq-gzip\x00")
+
+// Compression configures the payload compression.
+type Compression struct {
+	// gzip compression level, zero means gzip.DefaultCompression.
+	Level int
+	// Payloads and results shorter than MinSize are stored as is.
+	MinSize int
+}
+
+// Compress stores payloads and results gzip compressed.
+func Compress(compression Compression) backends.Middleware {
+	if compression.Level == 0 {
+		compression.Level = gzip.DefaultCompression
+	}
+	return func(backend backends.Backend) backends.Backend {
+		return &compress{Backend: backend, compression: compression}
+	}
+}
+
+// CompressionStats counts payload and result bytes written through the
+// compression layer before and after compression.
+type CompressionStats struct {
+	RawBytes    uint64
+	StoredBytes uint64
+}
+
+// Ratio returns raw to stored bytes ratio, 1 if nothing is written yet.
+func (s CompressionStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.RawBytes) / float64(s.StoredBytes)
+}
+
+// CompressionOf returns the stats of a compression layer of the backend
+// chain, false if there is none.
+func CompressionOf(backend backends.Backend) (CompressionStats, bool) {
+	for ; backend != nil; backend = backends.Unwrap(backend) {
+		if c, ok := backend.(*compress); ok {
+			return CompressionStats{
+				RawBytes:    atomic.LoadUint64(&c.rawBytes),
+				StoredBytes: atomic.LoadUint64(&c.storedBytes),
+			}, true
+		}
+	}
+	return CompressionStats{}, false
+}
+
+type compress struct {
+	// accessed atomically, first to be 64-bit aligned
+	rawBytes    uint64
+	storedBytes uint64
+	backends.Backend
+	compression Compression
+}
+
+func (c *compress) Unwrap() backends.Backend {
+	return c.Backend
+}
+
+func (c *compress) encode(data []byte) ([]byte, error) {
+	encoded, err := c.gzip(data)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&c.rawBytes, uint64(len(data)))
+	atomic.AddUint64(&c.storedBytes, uint64(len(encoded)))
+	return encoded, nil
+}
+
+func (c *compress) gzip(data []byte) ([]byte, error) {
+	// data looking like compressed one is compressed whatever its size
+	if len(data) < c.compression.MinSize && !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	// references stay readable, so the backend counts the blob size of the
+	// payload
+	if _, ok := blob.ReferenceSize(data); ok {
+		return data, nil
+	}
+	var buffer bytes.Buffer
+	buffer.Write(gzipMagic)
+	w, err := gzip.NewWriterLevel(&buffer, c.compression.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func decode(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data[len(gzipMagic):]))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (c *compress) Put(ctx context.Context, queue, group string, payload []byte, executionTimeout time.Duration) (string, error) {
+	payload, err := c.encode(payload)
+	if err != nil {
+		return "", backends.QueueError("put", queue, err)
+	}
+	return c.Backend.Put(ctx, queue, group, payload, executionTimeout)
+}
+
+func (c *compress) GetNotReady(ctx context.Context, queue string) (string, []byte, error) {
+	taskID, payload, err := c.Backend.GetNotReady(ctx, queue)
+	if err != nil {
+		return "", nil, err
+	}
+	payload, err = decode(payload)
+	if err != nil {
+		return "", nil, backends.TaskError("get", taskID, err)
+	}
+	return taskID, payload, nil
+}
+
+func (c *compress) GetReady(ctx context.Context, taskID string) ([]byte, error) {
+	result, err := c.Backend.GetReady(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	result, err = decode(result)
+	if err != nil {
+		return nil, backends.TaskError("result", taskID, err)
+	}
+	return result, nil
+}
+
+func (c *compress) TaskReady(ctx context.Context, taskID string, result []byte) error {
+	result, err := c.encode(result)
+	if err != nil {
+		return backends.TaskError("ready", taskID, err)
+	}
+	return c.Backend.TaskReady(ctx, taskID, result)
+}
+
+// Export exports tasks of the wrapped backend with payloads and results
+// decompressed.
+func (c *compress) Export(ctx context.Context, fn func(task *backends.Task) error) error {
+	var exporter backends.Exporter
+	if !backends.As(c.Backend, &exporter) {
+		return backends.ErrNotSupported
+	}
+	return exporter.Export(ctx, func(task *backends.Task) error {
+		decoded := *task
+		var err error
+		if decoded.Payload, err = decode(task.Payload); err != nil {
+			return backends.TaskError("export", task.ID, err)
+		}
+		if decoded.Result, err = decode(task.Result); err != nil {
+			return backends.TaskError("export", task.ID, err)
+		}
+		return fn(&decoded)
+	})
+}
+
+// Import imports the task to the wrapped backend with payload and result
+// compressed.
+func (c *compress) Import(ctx context.Context, task *backends.Task) error {
+	var importer backends.Importer
+	if !backends.As(c.Backend, &importer) {
+		return backends.ErrNotSupported
+	}
+	encoded := *task
+	var err error
+	if encoded.Payload, err = c.encode(task.Payload); err != nil {
+		return backends.TaskError("import", task.ID, err)
+	}
+	if encoded.Result, err = c.encode(task.Result); err != nil {
+		return backends.TaskError("import", task.ID, err)
+	}
+	return importer.Import(ctx, &encoded)
+}
+
+// Task returns the task of the wrapped backend with payload and result
+// decompressed.
+func (c *compress) Task(ctx context.Context, taskID string) (*backends.Task, error) {
+	var inspector backends.Inspector
+	if !backends.As(c.Backend, &inspector) {
+		return nil, backends.ErrNotSupported
+	}
+	task, err := inspector.Task(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	if task.Payload, err = decode(task.Payload); err != nil {
+		return nil, backends.TaskError("task", taskID, err)
+	}
+	if task.Result, err = decode(task.Result); err != nil {
+		return nil, backends.TaskError("task", taskID, err)
+	}
+	return task, nil
+}
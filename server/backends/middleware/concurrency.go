@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+// ConcurrencyLimiter is implemented by the concurrency layer.
+type ConcurrencyLimiter interface {
+	// SetConcurrency limits the running tasks of the queue, zero removes
+	// the limit.
+	SetConcurrency(queue string, limit uint64)
+	// Concurrency returns the limits of the queues.
+	Concurrency() map[string]uint64
+}
+
+// Concurrency limits the running tasks of queues across all workers: while
+// a queue has limit running tasks GetNotReady returns ErrQueueNotFound as if
+// the queue was empty. Running tasks are counted by the backend stats of the
+// queue, see QueueStatsOf, so tasks timed out by the backend free their
+// slots too. Limited queues get WorkLimit in stats. Limits are not
+// persisted.
+func Concurrency(limits map[string]uint64) backends.Middleware {
+	return func(backend backends.Backend) backends.Backend {
+		c := &concurrency{Backend: backend, queues: make(map[string]*queueConcurrency)}
+		for queue, limit := range limits {
+			c.SetConcurrency(queue, limit)
+		}
+		return c
+	}
+}
+
+// queueConcurrency is the limit of a queue.
+type queueConcurrency struct {
+	// held while a task is dispatched, so the count does not change
+	// between the check and the dispatch
+	mutex sync.Mutex
+	limit uint64
+}
+
+type concurrency struct {
+	backends.Backend
+	mutex  sync.RWMutex
+	queues map[string]*queueConcurrency
+}
+
+func (c *concurrency) Unwrap() backends.Backend {
+	return c.Backend
+}
+
+func (c *concurrency) SetConcurrency(queue string, limit uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if limit == 0 {
+		delete(c.queues, queue)
+		return
+	}
+	if q, ok := c.queues[queue]; ok {
+		q.limit = limit
+		return
+	}
+	c.queues[queue] = &queueConcurrency{limit: limit}
+}
+
+func (c *concurrency) Concurrency() map[string]uint64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	limits := make(map[string]uint64, len(c.queues))
+	for queue, q := range c.queues {
+		limits[queue] = q.limit
+	}
+	return limits
+}
+
+func (c *concurrency) GetNotReady(ctx context.Context, queue string) (string, []byte, error) {
+	c.mutex.RLock()
+	q, ok := c.queues[queue]
+	var limit uint64
+	if ok {
+		limit = q.limit
+	}
+	c.mutex.RUnlock()
+	if !ok {
+		return c.Backend.GetNotReady(ctx, queue)
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	stats, err := backends.QueueStatsOf(ctx, c.Backend, queue)
+	if err != nil {
+		return "", nil, backends.QueueError("get", queue, err)
+	}
+	if stats.WorkLength >= limit {
+		return "", nil, backends.QueueError("get", queue, backends.ErrQueueNotFound)
+	}
+	return c.Backend.GetNotReady(ctx, queue)
+}
+
+func (c *concurrency) QueueStats(ctx context.Context, queue string) (backends.QueueStats, error) {
+	stats, err := backends.QueueStatsOf(ctx, c.Backend, queue)
+	if err != nil {
+		return backends.QueueStats{}, err
+	}
+	c.mutex.RLock()
+	if q, ok := c.queues[queue]; ok {
+		stats.WorkLimit = q.limit
+	}
+	c.mutex.RUnlock()
+	return stats, nil
+}
+
+func (c *concurrency) Stats(ctx context.Context) (*backends.Stats, error) {
+	stats, err := c.Backend.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for queue, limit := range c.Concurrency() {
+		queueStats := stats.Queues[queue]
+		queueStats.WorkLimit = limit
+		stats.Queues[queue] = queueStats
+	}
+	return stats, nil
+}
+
+// parseConcurrency parses "queue:limit" values of the limit parameter.
+func parseConcurrency(values []string) (map[string]uint64, error) {
+	limits := make(map[string]uint64)
+	for _, value := range values {
+		i := strings.LastIndex(value, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("limit %q: expected queue:limit", value)
+		}
+		limit, err := strconv.ParseUint(value[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("limit %q: %w", value, err)
+		}
+		limits[value[:i]] = limit
+	}
+	return limits, nil
+}
@@ -0,0 +1,211 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+// Rate is a number of tasks per period.
+type Rate struct {
+	Tasks uint64
+	Per   time.Duration
+}
+
+var ratePeriods = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+// ParseRate parses a rate like "10/s", "100/m" or "1000/h", "0" is no rate.
+func ParseRate(s string) (Rate, error) {
+	if s == "0" {
+		return Rate{}, nil
+	}
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return Rate{}, fmt.Errorf("rate %q: expected tasks/period", s)
+	}
+	tasks, err := strconv.ParseUint(s[:i], 10, 64)
+	if err != nil {
+		return Rate{}, fmt.Errorf("rate %q: %w", s, err)
+	}
+	per, ok := ratePeriods[s[i+1:]]
+	if !ok {
+		return Rate{}, fmt.Errorf("rate %q: period is not s, m or h", s)
+	}
+	return Rate{Tasks: tasks, Per: per}, nil
+}
+
+func (r Rate) String() string {
+	if r.Tasks == 0 {
+		return "0"
+	}
+	for name, per := range ratePeriods {
+		if per == r.Per {
+			return strconv.FormatUint(r.Tasks, 10) + "/" + name
+		}
+	}
+	return strconv.FormatUint(r.Tasks, 10) + "/" + r.Per.String()
+}
+
+func (r Rate) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// interval is the time between dispatches.
+func (r Rate) interval() time.Duration {
+	return r.Per / time.Duration(r.Tasks)
+}
+
+// DispatchRateLimiter is implemented by the dispatch rate layer.
+type DispatchRateLimiter interface {
+	// SetDispatchRate limits the dispatches of the queue, a zero rate
+	// removes the limit.
+	SetDispatchRate(queue string, rate Rate)
+	// DispatchRates returns the rates of the queues.
+	DispatchRates() map[string]Rate
+}
+
+// maxDispatchWait is the longest GetNotReady waits for the next dispatch.
+const maxDispatchWait = 30 * time.Second
+
+// DispatchRate limits how often GetNotReady dispatches tasks of queues. The
+// tasks are spaced evenly, a queue of "60/m" dispatches a task a second at
+// most, so no period gets more than its tasks and one. GetNotReady waits for
+// the next dispatch until the context is done. If the next dispatch is
+// further than maxDispatchWait or the context deadline it returns a
+// RetryError of ErrQueueNotFound with the time left. Empty polls do not take
+// from the rate.
+func DispatchRate(rates map[string]Rate) backends.Middleware {
+	return func(backend backends.Backend) backends.Backend {
+		d := &dispatchRate{Backend: backend, queues: make(map[string]*queueRate)}
+		for queue, rate := range rates {
+			d.SetDispatchRate(queue, rate)
+		}
+		return d
+	}
+}
+
+// queueRate is the rate of a queue.
+type queueRate struct {
+	// held while a task is dispatched
+	mutex sync.Mutex
+	rate  Rate
+	// the time the next task may be dispatched
+	next time.Time
+	// closed to wake the waiters when the rate changes
+	wake chan struct{}
+}
+
+// changed wakes the waiters of the queue, q.mutex is held.
+func (q *queueRate) changed() {
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+type dispatchRate struct {
+	backends.Backend
+	mutex  sync.RWMutex
+	queues map[string]*queueRate
+}
+
+func (d *dispatchRate) Unwrap() backends.Backend {
+	return d.Backend
+}
+
+func (d *dispatchRate) SetDispatchRate(queue string, rate Rate) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if q, ok := d.queues[queue]; ok {
+		q.mutex.Lock()
+		q.rate = rate
+		// the next dispatch follows the new rate
+		if rate.Tasks != 0 && time.Until(q.next) > rate.interval() {
+			q.next = time.Now().Add(rate.interval())
+		}
+		q.changed()
+		q.mutex.Unlock()
+	}
+	if rate.Tasks == 0 {
+		delete(d.queues, queue)
+		return
+	}
+	if _, ok := d.queues[queue]; !ok {
+		d.queues[queue] = &queueRate{rate: rate, wake: make(chan struct{})}
+	}
+}
+
+func (d *dispatchRate) DispatchRates() map[string]Rate {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	rates := make(map[string]Rate, len(d.queues))
+	for queue, q := range d.queues {
+		q.mutex.Lock()
+		rates[queue] = q.rate
+		q.mutex.Unlock()
+	}
+	return rates
+}
+
+func (d *dispatchRate) GetNotReady(ctx context.Context, queue string) (string, []byte, error) {
+	for {
+		d.mutex.RLock()
+		q, ok := d.queues[queue]
+		d.mutex.RUnlock()
+		if !ok {
+			return d.Backend.GetNotReady(ctx, queue)
+		}
+		q.mutex.Lock()
+		now := time.Now()
+		if !now.Before(q.next) {
+			taskID, payload, err := d.Backend.GetNotReady(ctx, queue)
+			if err == nil {
+				q.next = now.Add(q.rate.interval())
+			}
+			q.mutex.Unlock()
+			return taskID, payload, err
+		}
+		wait, wake := q.next.Sub(now), q.wake
+		q.mutex.Unlock()
+		deadline, ok := ctx.Deadline()
+		if wait > maxDispatchWait || ok && deadline.Before(now.Add(wait)) {
+			return "", nil, backends.QueueError("get", queue, &backends.RetryError{
+				Err:        backends.ErrQueueNotFound,
+				RetryAfter: wait,
+			})
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return "", nil, backends.QueueError("get", queue, ctx.Err())
+		}
+	}
+}
+
+// parseDispatchRates parses "queue:rate" values of the limit parameter.
+func parseDispatchRates(values []string) (map[string]Rate, error) {
+	rates := make(map[string]Rate)
+	for _, value := range values {
+		i := strings.LastIndex(value, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("limit %q: expected queue:rate", value)
+		}
+		rate, err := ParseRate(value[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		rates[value[:i]] = rate
+	}
+	return rates, nil
+}
@@ -0,0 +1,420 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/blob"
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown encryption key")
+	ErrNoKeys     = errors.New("no encryption keys")
+)
+
+// encryptMagic marks encrypted payloads and results.
+var encryptMagic = []byte("\x00stq-aes\x00")
+
+// dataKeySize is the size of the AES-256 key made for every payload and
+// result.
+const dataKeySize = 32
+
+// Keys are the AES key encryption keys by id. The current key encrypts new
+// payloads and results, all keys decrypt them.
+type Keys struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeys creates keys of 16, 24 or 32 bytes (AES-128, AES-192, AES-256)
+// by id with the current key id.
+func NewKeys(keys map[string][]byte, current string) (*Keys, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, current)
+	}
+	k := &Keys{current: current, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+// LoadKeys reads keys from the file with a key per line, the key id and the
+// base64 key separated by a space:
+//
+//	# comment
+//	2023-01 q3Jv0MZSzYzqKfqeHy0pmE1hLrQOnKXlWXqzJPTYz5Q=
+//	2023-07 Wv3pPp4H1GjLkMQQq8C7Fh0OKr3dDXr5Zb5PQv/j2TY=
+//
+// The last key is the current one.
+func LoadKeys(path string) (*Keys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := make(map[string][]byte)
+	var current string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key id and key", path, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		keys[fields[0]] = key
+		current = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewKeys(keys, current)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the data with a new data key and the data key with the
+// current key (envelope encryption):
+//
+//	magic, key id length, key id, nonce, sealed data key, nonce, sealed data
+func (k *Keys) seal(data []byte) ([]byte, error) {
+	// there is nothing to protect in empty data, nil results stay nil
+	if len(data) == 0 {
+		return data, nil
+	}
+	// blobs are encrypted by EncryptBlobs, references stay readable, so the
+	// backend counts the blob size of the payload
+	if _, ok := blob.ReferenceSize(data); ok {
+		return data, nil
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	keyAEAD := k.aeads[k.current]
+	sealed := make([]byte, 0, len(encryptMagic)+1+len(k.current)+
+		keyAEAD.NonceSize()+dataKeySize+keyAEAD.Overhead()+
+		dataAEAD.NonceSize()+len(data)+dataAEAD.Overhead())
+	sealed = append(sealed, encryptMagic...)
+	sealed = append(sealed, byte(len(k.current)))
+	sealed = append(sealed, k.current...)
+	if sealed, err = appendSealed(sealed, keyAEAD, dataKey, []byte(k.current)); err != nil {
+		return nil, err
+	}
+	return appendSealed(sealed, dataAEAD, data, nil)
+}
+
+func appendSealed(dst []byte, aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, plaintext, additionalData), nil
+}
+
+// keyID returns the id of the key the data is encrypted with, false if the
+// data is not encrypted.
+func keyID(data []byte) (string, []byte, bool) {
+	if !bytes.HasPrefix(data, encryptMagic) {
+		return "", nil, false
+	}
+	data = data[len(encryptMagic):]
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return "", nil, false
+	}
+	return string(data[1 : 1+data[0]]), data[1+data[0]:], true
+}
+
+// open decrypts the data, data which is not encrypted is returned as is.
+func (k *Keys) open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptMagic) {
+		return data, nil
+	}
+	id, rest, ok := keyID(data)
+	if !ok {
+		return nil, errors.New("invalid encrypted data")
+	}
+	keyAEAD, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	sealedKeySize := keyAEAD.NonceSize() + dataKeySize + keyAEAD.Overhead()
+	if len(rest) < sealedKeySize {
+		return nil, errors.New("invalid encrypted data")
+	}
+	dataKey, err := keyAEAD.Open(nil, rest[:keyAEAD.NonceSize()], rest[keyAEAD.NonceSize():sealedKeySize], []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	rest = rest[sealedKeySize:]
+	if len(rest) < dataAEAD.NonceSize() {
+		return nil, errors.New("invalid encrypted data")
+	}
+	return dataAEAD.Open(nil, rest[:dataAEAD.NonceSize()], rest[dataAEAD.NonceSize():], nil)
+}
+
+// stale reports whether the data is encrypted with other than the current
+// key.
+func (k *Keys) stale(data []byte) bool {
+	id, _, ok := keyID(data)
+	return ok && id != k.current
+}
+
+// reseal encrypts the data with the current key.
+func (k *Keys) reseal(data []byte) ([]byte, error) {
+	if !k.stale(data) {
+		return data, nil
+	}
+	data, err := k.open(data)
+	if err != nil {
+		return nil, err
+	}
+	return k.seal(data)
+}
+
+// Reencrypter is implemented by the encryption layer.
+type Reencrypter interface {
+	// Reencrypt rewrites tasks encrypted with old keys with the current key
+	// and returns the number of rewritten tasks. Blobs are not rewritten.
+	Reencrypt(ctx context.Context) (int, error)
+}
+
+// Encrypt stores payloads and results AES-GCM encrypted with the keys. It
+// should be the innermost layer, below gzip.
+func Encrypt(keys *Keys) backends.Middleware {
+	return func(backend backends.Backend) backends.Backend {
+		return &encrypt{Backend: backend, keys: keys}
+	}
+}
+
+type encrypt struct {
+	backends.Backend
+	keys *Keys
+	// calls hold the read lock, Reencrypt holds the write lock
+	mutex sync.RWMutex
+}
+
+func (e *encrypt) Unwrap() backends.Backend {
+	return e.Backend
+}
+
+func (e *encrypt) Put(ctx context.Context, queue, group string, payload []byte, executionTimeout time.Duration) (string, error) {
+	payload, err := e.keys.seal(payload)
+	if err != nil {
+		return "", backends.QueueError("put", queue, err)
+	}
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.Backend.Put(ctx, queue, group, payload, executionTimeout)
+}
+
+func (e *encrypt) GetNotReady(ctx context.Context, queue string) (string, []byte, error) {
+	e.mutex.RLock()
+	taskID, payload, err := e.Backend.GetNotReady(ctx, queue)
+	e.mutex.RUnlock()
+	if err != nil {
+		return "", nil, err
+	}
+	payload, err = e.keys.open(payload)
+	if err != nil {
+		return "", nil, backends.TaskError("get", taskID, err)
+	}
+	return taskID, payload, nil
+}
+
+func (e *encrypt) GetReady(ctx context.Context, taskID string) ([]byte, error) {
+	e.mutex.RLock()
+	result, err := e.Backend.GetReady(ctx, taskID)
+	e.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	result, err = e.keys.open(result)
+	if err != nil {
+		return nil, backends.TaskError("result", taskID, err)
+	}
+	return result, nil
+}
+
+func (e *encrypt) TaskReady(ctx context.Context, taskID string, result []byte) error {
+	result, err := e.keys.seal(result)
+	if err != nil {
+		return backends.TaskError("ready", taskID, err)
+	}
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.Backend.TaskReady(ctx, taskID, result)
+}
+
+// Export exports tasks of the wrapped backend with payloads and results
+// decrypted.
+func (e *encrypt) Export(ctx context.Context, fn func(task *backends.Task) error) error {
+	var exporter backends.Exporter
+	if !backends.As(e.Backend, &exporter) {
+		return backends.ErrNotSupported
+	}
+	return exporter.Export(ctx, func(task *backends.Task) error {
+		decrypted := *task
+		var err error
+		if decrypted.Payload, err = e.keys.open(task.Payload); err != nil {
+			return backends.TaskError("export", task.ID, err)
+		}
+		if decrypted.Result, err = e.keys.open(task.Result); err != nil {
+			return backends.TaskError("export", task.ID, err)
+		}
+		return fn(&decrypted)
+	})
+}
+
+// Import imports the task to the wrapped backend with payload and result
+// encrypted.
+func (e *encrypt) Import(ctx context.Context, task *backends.Task) error {
+	var importer backends.Importer
+	if !backends.As(e.Backend, &importer) {
+		return backends.ErrNotSupported
+	}
+	encrypted := *task
+	var err error
+	if encrypted.Payload, err = e.keys.seal(task.Payload); err != nil {
+		return backends.TaskError("import", task.ID, err)
+	}
+	if encrypted.Result, err = e.keys.seal(task.Result); err != nil {
+		return backends.TaskError("import", task.ID, err)
+	}
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return importer.Import(ctx, &encrypted)
+}
+
+// Task returns the task of the wrapped backend with payload and result
+// decrypted.
+func (e *encrypt) Task(ctx context.Context, taskID string) (*backends.Task, error) {
+	var inspector backends.Inspector
+	if !backends.As(e.Backend, &inspector) {
+		return nil, backends.ErrNotSupported
+	}
+	task, err := inspector.Task(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	if task.Payload, err = e.keys.open(task.Payload); err != nil {
+		return nil, backends.TaskError("task", taskID, err)
+	}
+	if task.Result, err = e.keys.open(task.Result); err != nil {
+		return nil, backends.TaskError("task", taskID, err)
+	}
+	return task, nil
+}
+
+// Reencrypt rewrites tasks encrypted with old keys by deleting and importing
+// them, the wrapped backend must support export, import, lookup and delete.
+// All waiting tasks of a queue with a stale task are rewritten to keep the
+// queue order. Rewritten running tasks get their execution timeout from
+// now. Calls wait until Reencrypt is done.
+func (e *encrypt) Reencrypt(ctx context.Context) (int, error) {
+	var exporter backends.Exporter
+	var importer backends.Importer
+	var inspector backends.Inspector
+	var deleter backends.Deleter
+	if !backends.As(e.Backend, &exporter) || !backends.As(e.Backend, &importer) ||
+		!backends.As(e.Backend, &inspector) || !backends.As(e.Backend, &deleter) {
+		return 0, backends.ErrNotSupported
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	type listed struct {
+		id    string
+		queue string
+		state backends.TaskState
+		stale bool
+	}
+	var tasks []listed
+	staleQueues := make(map[string]bool)
+	err := exporter.Export(ctx, func(task *backends.Task) error {
+		stale := e.keys.stale(task.Payload) || e.keys.stale(task.Result)
+		if stale && task.State == backends.TaskWaiting {
+			staleQueues[task.Queue] = true
+		}
+		tasks = append(tasks, listed{id: task.ID, queue: task.Queue, state: task.State, stale: stale})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, listed := range tasks {
+		if !listed.stale && !(listed.state == backends.TaskWaiting && staleQueues[listed.queue]) {
+			continue
+		}
+		// running tasks may time out since the export
+		task, err := inspector.Task(ctx, listed.id)
+		if errors.Is(err, backends.ErrTaskNotFound) {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		if task.Payload, err = e.keys.reseal(task.Payload); err != nil {
+			return count, backends.TaskError("import", task.ID, err)
+		}
+		if task.Result, err = e.keys.reseal(task.Result); err != nil {
+			return count, backends.TaskError("import", task.ID, err)
+		}
+		if err := deleter.Delete(ctx, task.ID); err != nil {
+			if errors.Is(err, backends.ErrTaskNotFound) {
+				continue
+			}
+			return count, err
+		}
+		// the task is deleted already, a canceled call must not lose it
+		if err := importer.Import(context.Background(), task); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+var (
+	ErrInjectedFault = errors.New("injected fault")
+)
+
+// Faults configures the fault injection.
+type Faults struct {
+	// Probability of a call to fail with ErrInjectedFault, from 0 to 1.
+	ErrorRate float64
+	// Latency added to every call.
+	Latency time.Duration
+	// Operations to inject faults into: put, get, result, ready, stats.
+	// Empty means all operations.
+	Ops []string
+	// Seed of the random generator, zero means the current time.
+	Seed int64
+}
+
+// FaultInjection makes backend calls slow and fail at random.
+func FaultInjection(faults Faults) backends.Middleware {
+	seed := faults.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	ops := make(map[string]bool)
+	for _, op := range faults.Ops {
+		ops[op] = true
+	}
+	return func(backend backends.Backend) backends.Backend {
+		return &fault{
+			Backend: backend,
+			faults:  faults,
+			ops:     ops,
+			rand:    rand.New(rand.NewSource(seed)),
+		}
+	}
+}
+
+type fault struct {
+	backends.Backend
+	faults Faults
+	ops    map[string]bool
+
+	rand      *rand.Rand
+	randMutex sync.Mutex
+}
+
+func (f *fault) Unwrap() backends.Backend {
+	return f.Backend
+}
+
+// inject delays the call and returns the injected error if any.
+func (f *fault) inject(ctx context.Context, op string) error {
+	if len(f.ops) > 0 && !f.ops[op] {
+		return nil
+	}
+	if f.faults.Latency > 0 {
+		timer := time.NewTimer(f.faults.Latency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	f.randMutex.Lock()
+	fail := f.rand.Float64() < f.faults.ErrorRate
+	f.randMutex.Unlock()
+	if fail {
+		return ErrInjectedFault
+	}
+	return nil
+}
+
+func (f *fault) Put(ctx context.Context, queue, group string, payload []byte, executionTimeout time.Duration) (string, error) {
+	if err := f.inject(ctx, "put"); err != nil {
+		return "", backends.QueueError("put", queue, err)
+	}
+	return f.Backend.Put(ctx, queue, group, payload, executionTimeout)
+}
+
+func (f *fault) GetNotReady(ctx context.Context, queue string) (string, []byte, error) {
+	if err := f.inject(ctx, "get"); err != nil {
+		return "", nil, backends.QueueError("get", queue, err)
+	}
+	return f.Backend.GetNotReady(ctx, queue)
+}
+
+func (f *fault) GetReady(ctx context.Context, taskID string) ([]byte, error) {
+	if err := f.inject(ctx, "result"); err != nil {
+		return nil, backends.TaskError("result", taskID, err)
+	}
+	return f.Backend.GetReady(ctx, taskID)
+}
+
+func (f *fault) TaskReady(ctx context.Context, taskID string, result []byte) error {
+	if err := f.inject(ctx, "ready"); err != nil {
+		return backends.TaskError("ready", taskID, err)
+	}
+	return f.Backend.TaskReady(ctx, taskID, result)
+}
+
+func (f *fault) Stats(ctx context.Context) (*backends.Stats, error) {
+	if err := f.inject(ctx, "stats"); err != nil {
+		return nil, err
+	}
+	return f.Backend.Stats(ctx)
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+// Logging logs every backend call with its duration and error.
+func Logging(logger *log.Logger) backends.Middleware {
+	return func(backend backends.Backend) backends.Backend {
+		return &logging{Backend: backend, logger: logger}
+	}
+}
+
+type logging struct {
+	backends.Backend
+	logger *log.Logger
+}
+
+func (l *logging) Unwrap() backends.Backend {
+	return l.Backend
+}
+
+func (l *logging) log(op string, subject string, started time.Time, err error) {
+	if err != nil {
+		l.logger.Printf("backend %s %s %s: %s", op, subject, time.Since(started), err)
+		return
+	}
+	l.logger.Printf("backend %s %s %s", op, subject, time.Since(started))
+}
+
+func (l *logging) Put(ctx context.Context, queue, group string, payload []byte, executionTimeout time.Duration) (string, error) {
+	started := time.Now()
+	taskID, err := l.Backend.Put(ctx, queue, group, payload, executionTimeout)
+	l.log("put", queue+" "+taskID, started, err)
+	return taskID, err
+}
+
+func (l *logging) GetNotReady(ctx context.Context, queue string) (string, []byte, error) {
+	started := time.Now()
+	taskID, payload, err := l.Backend.GetNotReady(ctx, queue)
+	l.log("get", queue+" "+taskID, started, err)
+	return taskID, payload, err
+}
+
+func (l *logging) GetReady(ctx context.Context, taskID string) ([]byte, error) {
+	started := time.Now()
+	result, err := l.Backend.GetReady(ctx, taskID)
+	l.log("result", taskID, started, err)
+	return result, err
+}
+
+func (l *logging) TaskReady(ctx context.Context, taskID string, result []byte) error {
+	started := time.Now()
+	err := l.Backend.TaskReady(ctx, taskID, result)
+	l.log("ready", taskID, started, err)
+	return err
+}
+
+func (l *logging) Stats(ctx context.Context) (*backends.Stats, error) {
+	started := time.Now()
+	stats, err := l.Backend.Stats(ctx)
+	l.log("stats", "", started, err)
+	return stats, err
+}
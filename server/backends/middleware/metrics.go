@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+// OpMetrics is the metrics of a backend operation. Misses are calls failed
+// with ErrQueueNotFound or ErrTaskNotFoundOrNotReady, which workers and
+// producers get while polling, they are not counted as errors.
+type OpMetrics struct {
+	Calls    uint64
+	Misses   uint64
+	Errors   uint64
+	Duration time.Duration
+}
+
+// Metrics counts calls, errors and duration of backend operations. It
+// serves the metrics over HTTP in the Prometheus text format.
+type Metrics struct {
+	mutex sync.Mutex
+	ops   map[string]OpMetrics
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{ops: make(map[string]OpMetrics)}
+}
+
+// Middleware returns the middleware collecting metrics into m.
+func (m *Metrics) Middleware() backends.Middleware {
+	return func(backend backends.Backend) backends.Backend {
+		return &metrics{Backend: backend, metrics: m}
+	}
+}
+
+// Snapshot returns a copy of the metrics by operation.
+func (m *Metrics) Snapshot() map[string]OpMetrics {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ops := make(map[string]OpMetrics, len(m.ops))
+	for op, opMetrics := range m.ops {
+		ops[op] = opMetrics
+	}
+	return ops
+}
+
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	ops := m.Snapshot()
+	names := make([]string, 0, len(ops))
+	for op := range ops {
+		names = append(names, op)
+	}
+	sort.Strings(names)
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(rw, "# TYPE stq_backend_calls_total counter")
+	for _, op := range names {
+		fmt.Fprintf(rw, "stq_backend_calls_total{op=%q} %d\n", op, ops[op].Calls)
+	}
+	fmt.Fprintln(rw, "# TYPE stq_backend_misses_total counter")
+	for _, op := range names {
+		fmt.Fprintf(rw, "stq_backend_misses_total{op=%q} %d\n", op, ops[op].Misses)
+	}
+	fmt.Fprintln(rw, "# TYPE stq_backend_errors_total counter")
+	for _, op := range names {
+		fmt.Fprintf(rw, "stq_backend_errors_total{op=%q} %d\n", op, ops[op].Errors)
+	}
+	fmt.Fprintln(rw, "# TYPE stq_backend_duration_seconds_total counter")
+	for _, op := range names {
+		fmt.Fprintf(rw, "stq_backend_duration_seconds_total{op=%q} %g\n", op, ops[op].Duration.Seconds())
+	}
+}
+
+func (m *Metrics) observe(op string, started time.Time, err error) {
+	duration := time.Since(started)
+	m.mutex.Lock()
+	opMetrics := m.ops[op]
+	opMetrics.Calls++
+	switch {
+	case err == nil:
+	case errors.Is(err, backends.ErrQueueNotFound), errors.Is(err, backends.ErrTaskNotFoundOrNotReady):
+		opMetrics.Misses++
+	default:
+		opMetrics.Errors++
+	}
+	opMetrics.Duration += duration
+	m.ops[op] = opMetrics
+	m.mutex.Unlock()
+}
+
+// MetricsOf returns the metrics collected by a metrics layer of the backend
+// chain or nil.
+func MetricsOf(backend backends.Backend) *Metrics {
+	for ; backend != nil; backend = backends.Unwrap(backend) {
+		if m, ok := backend.(*metrics); ok {
+			return m.metrics
+		}
+	}
+	return nil
+}
+
+type metrics struct {
+	backends.Backend
+	metrics *Metrics
+}
+
+func (m *metrics) Unwrap() backends.Backend {
+	return m.Backend
+}
+
+func (m *metrics) Put(ctx context.Context, queue, group string, payload []byte, executionTimeout time.Duration) (string, error) {
+	started := time.Now()
+	taskID, err := m.Backend.Put(ctx, queue, group, payload, executionTimeout)
+	m.metrics.observe("put", started, err)
+	return taskID, err
+}
+
+func (m *metrics) GetNotReady(ctx context.Context, queue string) (string, []byte, error) {
+	started := time.Now()
+	taskID, payload, err := m.Backend.GetNotReady(ctx, queue)
+	m.metrics.observe("get", started, err)
+	return taskID, payload, err
+}
+
+func (m *metrics) GetReady(ctx context.Context, taskID string) ([]byte, error) {
+	started := time.Now()
+	result, err := m.Backend.GetReady(ctx, taskID)
+	m.metrics.observe("result", started, err)
+	return result, err
+}
+
+func (m *metrics) TaskReady(ctx context.Context, taskID string, result []byte) error {
+	started := time.Now()
+	err := m.Backend.TaskReady(ctx, taskID, result)
+	m.metrics.observe("ready", started, err)
+	return err
+}
+
+func (m *metrics) Stats(ctx context.Context) (*backends.Stats, error) {
+	started := time.Now()
+	stats, err := m.Backend.Stats(ctx)
+	m.metrics.observe("stats", started, err)
+	return stats, err
+}
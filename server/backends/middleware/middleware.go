@@ -0,0 +1,150 @@
+// Package middleware provides backend wrappers for metrics, logging,
+// tracing, fault injection, payload compression, encryption and queue
+// concurrency and dispatch rate limits.
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+var (
+	ErrUnknownMiddleware = errors.New("unknown middleware")
+	// zstd is not implemented, the server has no dependencies beyond the
+	// standard library
+	ErrZstdNotSupported = errors.New("zstd is not supported, use gzip")
+)
+
+// Parse parses a comma separated list of middlewares with options as query
+// parameters, for example:
+//
+//	metrics,logging,fault?error_rate=0.01&latency=5ms&ops=get,gzip?min_size=1024
+//
+// Options are URL encoded, a comma in an option value is written as %2C, a
+// plain comma starts the next middleware.
+//
+// Supported middlewares and options:
+//
+//	logging                      log calls to logger
+//	metrics                      collect metrics, see MetricsOf
+//	tracing                      log spans to logger
+//	fault?error_rate=&latency=&ops=&seed=
+//	gzip?level=&min_size=
+//	zstd                         rejected with ErrZstdNotSupported
+//	encrypt?key_file=            see LoadKeys
+//	concurrency?limit=queue:n    repeated limit, see Concurrency
+//	dispatch_rate?limit=queue:n/s
+//	                             repeated limit, see DispatchRate
+func Parse(spec string, logger *log.Logger) ([]backends.Middleware, error) {
+	var middlewares []backends.Middleware
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, rawQuery := item, ""
+		if i := strings.Index(item, "?"); i >= 0 {
+			name, rawQuery = item[:i], item[i+1:]
+		}
+		params, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		middleware, err := newMiddleware(name, params, logger)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		middlewares = append(middlewares, middleware)
+	}
+	return middlewares, nil
+}
+
+func newMiddleware(name string, params url.Values, logger *log.Logger) (backends.Middleware, error) {
+	switch name {
+	case "logging":
+		return Logging(logger), nil
+	case "metrics":
+		return NewMetrics().Middleware(), nil
+	case "tracing":
+		return Tracing(&LogTracer{Logger: logger}), nil
+	case "fault":
+		var faults Faults
+		var err error
+		if faults.ErrorRate, err = floatParam(params, "error_rate"); err != nil {
+			return nil, err
+		}
+		if faults.Latency, err = durationParam(params, "latency"); err != nil {
+			return nil, err
+		}
+		seed, err := intParam(params, "seed")
+		if err != nil {
+			return nil, err
+		}
+		faults.Seed = int64(seed)
+		faults.Ops = params["ops"]
+		return FaultInjection(faults), nil
+	case "gzip":
+		var compression Compression
+		var err error
+		if compression.Level, err = intParam(params, "level"); err != nil {
+			return nil, err
+		}
+		if compression.MinSize, err = intParam(params, "min_size"); err != nil {
+			return nil, err
+		}
+		return Compress(compression), nil
+	case "zstd":
+		return nil, ErrZstdNotSupported
+	case "encrypt":
+		if params.Get("key_file") == "" {
+			return nil, errors.New("key_file is not set")
+		}
+		keys, err := LoadKeys(params.Get("key_file"))
+		if err != nil {
+			return nil, err
+		}
+		return Encrypt(keys), nil
+	case "concurrency":
+		limits, err := parseConcurrency(params["limit"])
+		if err != nil {
+			return nil, err
+		}
+		return Concurrency(limits), nil
+	case "dispatch_rate":
+		rates, err := parseDispatchRates(params["limit"])
+		if err != nil {
+			return nil, err
+		}
+		return DispatchRate(rates), nil
+	default:
+		return nil, ErrUnknownMiddleware
+	}
+}
+
+func floatParam(params url.Values, key string) (float64, error) {
+	if params.Get(key) == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(params.Get(key), 64)
+}
+
+func intParam(params url.Values, key string) (int, error) {
+	if params.Get(key) == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(params.Get(key))
+}
+
+func durationParam(params url.Values, key string) (time.Duration, error) {
+	if params.Get(key) == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(params.Get(key))
+}
@@ -0,0 +1,523 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/backendtest"
+	"github.com/alexio777/stq/server/backends/memory"
+	"github.com/alexio777/stq/server/blob"
+)
+
+func Test_Conformance(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	backendtest.Run(t, func() (backends.Backend, error) {
+		backend, err := memory.New()
+		if err != nil {
+			return nil, err
+		}
+		keys, err := NewKeys(map[string][]byte{"key": bytes.Repeat([]byte("k"), 32)}, "key")
+		if err != nil {
+			return nil, err
+		}
+		return backends.Chain(backend,
+			NewMetrics().Middleware(),
+			Logging(logger),
+			Tracing(&LogTracer{Logger: logger}),
+			FaultInjection(Faults{}),
+			Compress(Compression{}),
+			Encrypt(keys),
+			Concurrency(nil),
+			DispatchRate(nil),
+		), nil
+	})
+}
+
+func Test_Metrics(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics()
+	wrapped := backends.Chain(backend, Logging(log.New(ioutil.Discard, "", 0)), m.Middleware())
+	if MetricsOf(wrapped) != m {
+		t.Fatal("metrics is not found in the chain")
+	}
+	if MetricsOf(backend) != nil {
+		t.Fatal("metrics is found in the bare backend")
+	}
+	ctx := context.TODO()
+	if _, err := wrapped.Put(ctx, "queue", "", []byte("payload"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := wrapped.GetNotReady(ctx, "queue"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := wrapped.GetNotReady(ctx, "queue"); !errors.Is(err, backends.ErrQueueNotFound) {
+		t.Fatal(err)
+	}
+	ops := m.Snapshot()
+	if ops["put"].Calls != 1 || ops["put"].Errors != 0 {
+		t.Fatalf("unexpected put metrics: %+v", ops["put"])
+	}
+	if ops["get"].Calls != 2 || ops["get"].Misses != 1 || ops["get"].Errors != 0 {
+		t.Fatalf("unexpected get metrics: %+v", ops["get"])
+	}
+	rw := httptest.NewRecorder()
+	m.ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rw.Body.String(), `stq_backend_calls_total{op="get"} 2`) {
+		t.Fatalf("unexpected metrics: %s", rw.Body.String())
+	}
+}
+
+func Test_FaultInjection(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := FaultInjection(Faults{ErrorRate: 1, Ops: []string{"get"}})(backend)
+	ctx := context.TODO()
+	if _, err := wrapped.Put(ctx, "queue", "", []byte("payload"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := wrapped.GetNotReady(ctx, "queue"); !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("fault is not injected: %v", err)
+	}
+	wrapped = FaultInjection(Faults{Latency: time.Second})(backend)
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	if _, _, err := wrapped.GetNotReady(ctx, "queue"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("latency does not respect context: %v", err)
+	}
+}
+
+func Test_Compress(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := Compress(Compression{MinSize: 16})(backend)
+	ctx := context.TODO()
+	for _, payload := range [][]byte{
+		[]byte("short"),
+		bytes.Repeat([]byte("long payload "), 100),
+		append(append([]byte{}, gzipMagic...), "short"...),
+	} {
+		if _, err := wrapped.Put(ctx, "queue", "", payload, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		taskID, stored, err := backend.GetNotReady(ctx, "queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(payload) >= 16 && len(stored) >= len(payload) {
+			t.Fatalf("payload is not compressed: %d >= %d", len(stored), len(payload))
+		}
+		decoded, err := decode(stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, payload) {
+			t.Fatalf("payload is not equal: %q != %q", decoded, payload)
+		}
+		if err := wrapped.TaskReady(ctx, taskID, payload); err != nil {
+			t.Fatal(err)
+		}
+		result, err := wrapped.GetReady(ctx, taskID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, payload) {
+			t.Fatalf("result is not equal: %q != %q", result, payload)
+		}
+	}
+	stats, ok := CompressionOf(Logging(log.New(ioutil.Discard, "", 0))(wrapped))
+	if !ok {
+		t.Fatal("compression is not found in the chain")
+	}
+	if stats.RawBytes != 2*(5+1300+uint64(len(gzipMagic))+5) || stats.Ratio() <= 1 {
+		t.Fatalf("stats is not equal: %+v ratio %g", stats, stats.Ratio())
+	}
+	if _, ok := CompressionOf(backend); ok {
+		t.Fatal("compression is found in the bare backend")
+	}
+}
+
+func Test_Encrypt(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.TODO()
+	oldKeys, err := NewKeys(map[string][]byte{"old": bytes.Repeat([]byte("o"), 32)}, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	if err := ioutil.WriteFile(keyFile, []byte("# keys\n"+
+		"old "+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("o"), 32))+"\n"+
+		"new "+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("n"), 16))+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeys(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKeys, err := NewKeys(map[string][]byte{"new": bytes.Repeat([]byte("n"), 16)}, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped := Encrypt(oldKeys)(backend)
+	var taskIDs []string
+	for _, payload := range []string{"payload_1", "payload_2", "payload_3"} {
+		taskID, err := wrapped.Put(ctx, "queue", "", []byte(payload), time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		taskIDs = append(taskIDs, taskID)
+	}
+	if err := wrapped.TaskReady(ctx, taskIDs[0], []byte("result_1")); !errors.Is(err, backends.ErrTaskNotFoundOrNotReady) {
+		t.Fatalf("waiting task is ready: %v", err)
+	}
+	task, err := backend.Task(ctx, taskIDs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _, ok := keyID(task.Payload); !ok || id != "old" || bytes.Contains(task.Payload, []byte("payload_1")) {
+		t.Fatalf("payload is not encrypted: %q", task.Payload)
+	}
+
+	// rotate the key, old tasks are still readable
+	wrapped = Encrypt(keys)(backend)
+	if _, err := wrapped.Put(ctx, "queue", "", []byte("payload_4"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	taskID, payload, err := wrapped.GetNotReady(ctx, "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taskID != taskIDs[0] || string(payload) != "payload_1" {
+		t.Fatalf("task is not equal: %s %s != %s %s", taskID, payload, taskIDs[0], "payload_1")
+	}
+	if err := Encrypt(oldKeys)(backend).TaskReady(ctx, taskID, []byte("result_1")); err != nil {
+		t.Fatal(err)
+	}
+	count, err := wrapped.(Reencrypter).Reencrypt(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two stale waiting tasks, the fresh one behind them and the ready one
+	if count != 4 {
+		t.Fatalf("count is not equal: %d != %d", count, 4)
+	}
+
+	// the old key is not needed anymore and the order is kept
+	wrapped = Encrypt(newKeys)(backend)
+	for _, expected := range []string{"payload_2", "payload_3", "payload_4"} {
+		_, payload, err := wrapped.GetNotReady(ctx, "queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(payload) != expected {
+			t.Fatalf("payload is not equal: %s != %s", payload, expected)
+		}
+	}
+	if _, err := Encrypt(oldKeys)(backend).(backends.Inspector).Task(ctx, taskID); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("unknown key is not detected: %v", err)
+	}
+	result, err := wrapped.GetReady(ctx, taskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "result_1" {
+		t.Fatalf("result is not equal: %s != %s", result, "result_1")
+	}
+}
+
+// cancelOnDelete cancels the call of Reencrypt between the delete and the
+// import of a task.
+type cancelOnDelete struct {
+	*memory.Memory
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnDelete) Delete(ctx context.Context, taskID string) error {
+	err := c.Memory.Delete(ctx, taskID)
+	c.cancel()
+	return err
+}
+
+func Test_ReencryptCanceled(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.TODO())
+	oldKeys, err := NewKeys(map[string][]byte{"old": bytes.Repeat([]byte("o"), 32)}, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeys(map[string][]byte{"old": bytes.Repeat([]byte("o"), 32), "new": bytes.Repeat([]byte("n"), 32)}, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskID, err := Encrypt(oldKeys)(backend).Put(ctx, "queue", "", []byte("payload"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := Encrypt(keys)(&cancelOnDelete{Memory: backend, cancel: cancel})
+	if _, err := wrapped.(Reencrypter).Reencrypt(ctx); err != nil {
+		t.Fatal(err)
+	}
+	task, err := wrapped.(backends.Inspector).Task(context.TODO(), taskID)
+	if err != nil {
+		t.Fatalf("task is lost: %v", err)
+	}
+	if string(task.Payload) != "payload" {
+		t.Fatalf("payload is not equal: %s != %s", task.Payload, "payload")
+	}
+}
+
+func Test_EncryptBlobs(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	store, err := blob.NewDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeys(map[string][]byte{"key": bytes.Repeat([]byte("k"), 32)}, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := EncryptBlobs(store, keys)
+	read := func(store blob.Store, id string) []byte {
+		content, size, err := store.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer content.Close()
+		data, err := ioutil.ReadAll(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(data)) != size {
+			t.Fatalf("size is not equal: %d != %d", len(data), size)
+		}
+		return data
+	}
+	for _, size := range []int{0, 10, blobChunkSize, 2*blobChunkSize + 5} {
+		content := bytes.Repeat([]byte("p"), size)
+		id, err := encrypted.Put(ctx, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := read(encrypted, id); !bytes.Equal(data, content) {
+			t.Fatalf("content is not equal: %d != %d bytes", len(data), size)
+		}
+		stored, err := ioutil.ReadFile(filepath.Join(dir, id+".blob"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size > 0 && bytes.Contains(stored, content[:size/2+1]) {
+			t.Fatalf("blob of %d bytes is not encrypted", size)
+		}
+		if size == 2*blobChunkSize+5 {
+			// a blob cut at a chunk end does not open
+			cut := len(stored) - (5 + 16)
+			if err := ioutil.WriteFile(filepath.Join(dir, id+".blob"), stored[:cut], 0600); err != nil {
+				t.Fatal(err)
+			}
+			content, _, err := encrypted.Get(ctx, id)
+			if err == nil {
+				_, err = ioutil.ReadAll(content)
+				content.Close()
+			}
+			if !errors.Is(err, errInvalidBlob) {
+				t.Fatalf("truncated blob is not detected: %v", err)
+			}
+		}
+	}
+
+	// blobs stored before encryption is on are read as is
+	id, err := store.Put(ctx, strings.NewReader("plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := read(encrypted, id); string(data) != "plain" {
+		t.Fatalf("content is not equal: %s != %s", data, "plain")
+	}
+}
+
+func Test_Concurrency(t *testing.T) {
+	ctx := context.TODO()
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited := Concurrency(map[string]uint64{"queue": 2})(backend)
+	for i := 0; i < 4; i++ {
+		if _, err := limited.Put(ctx, "queue", "", []byte("payload"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var taskIDs []string
+	for i := 0; i < 2; i++ {
+		taskID, _, err := limited.GetNotReady(ctx, "queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		taskIDs = append(taskIDs, taskID)
+	}
+	if _, _, err := limited.GetNotReady(ctx, "queue"); !errors.Is(err, backends.ErrQueueNotFound) {
+		t.Fatalf("limit is not detected: %v", err)
+	}
+	stats, err := limited.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Queues["queue"].WorkLength != 2 || stats.Queues["queue"].WorkLimit != 2 {
+		t.Fatalf("unexpected queue stats: %+v", stats.Queues["queue"])
+	}
+	if err := limited.TaskReady(ctx, taskIDs[0], []byte("result")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := limited.GetNotReady(ctx, "queue"); err != nil {
+		t.Fatal(err)
+	}
+
+	var limiter ConcurrencyLimiter
+	if !backends.As(limited, &limiter) {
+		t.Fatal("limiter is not found")
+	}
+	limiter.SetConcurrency("queue", 0)
+	if _, _, err := limited.GetNotReady(ctx, "queue"); err != nil {
+		t.Fatal(err)
+	}
+	if limits := limiter.Concurrency(); len(limits) != 0 {
+		t.Fatalf("limit is not removed: %v", limits)
+	}
+}
+
+func Test_DispatchRate(t *testing.T) {
+	ctx := context.TODO()
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate, err := ParseRate("10/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited := DispatchRate(map[string]Rate{"queue": rate})(backend)
+	// empty polls do not take from the rate
+	if _, _, err := limited.GetNotReady(ctx, "queue"); !errors.Is(err, backends.ErrQueueNotFound) {
+		t.Fatalf("empty queue is not detected: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := limited.Put(ctx, "queue", "", []byte("payload"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := limited.GetNotReady(ctx, "queue"); err != nil {
+		t.Fatal(err)
+	}
+	// the next dispatch is after the deadline
+	shortCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	_, _, err = limited.GetNotReady(shortCtx, "queue")
+	cancel()
+	var retry *backends.RetryError
+	if !errors.Is(err, backends.ErrQueueNotFound) || !errors.As(err, &retry) {
+		t.Fatalf("rate is not detected: %v", err)
+	}
+	if retry.RetryAfter <= 0 || retry.RetryAfter > 100*time.Millisecond {
+		t.Fatalf("unexpected retry after: %s", retry.RetryAfter)
+	}
+	// the poll waits for the next dispatch
+	start := time.Now()
+	if _, _, err := limited.GetNotReady(ctx, "queue"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("dispatch is not delayed: %s", elapsed)
+	}
+
+	var limiter DispatchRateLimiter
+	if !backends.As(limited, &limiter) {
+		t.Fatal("limiter is not found")
+	}
+	if rates := limiter.DispatchRates(); rates["queue"].String() != "10/s" {
+		t.Fatalf("rate is not equal: %s != %s", rates["queue"], "10/s")
+	}
+	// removing the rate wakes the waiting poll
+	done := make(chan error)
+	go func() {
+		_, _, err := limited.GetNotReady(ctx, "queue")
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	limiter.SetDispatchRate("queue", Rate{})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("waiting poll is not woken")
+	}
+	for _, s := range []string{"10", "10/d", "x/s"} {
+		if _, err := ParseRate(s); err == nil {
+			t.Fatalf("invalid rate is not detected: %s", s)
+		}
+	}
+}
+
+func Test_Parse(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	middlewares, err := Parse("metrics, logging,tracing,fault?error_rate=0.5&latency=1ms&ops=get&ops=put,gzip?level=9&min_size=10", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(middlewares) != 5 {
+		t.Fatalf("unexpected middlewares count: %d", len(middlewares))
+	}
+	if _, err := Parse("unknown", logger); !errors.Is(err, ErrUnknownMiddleware) {
+		t.Fatalf("unknown middleware is not detected: %v", err)
+	}
+	if _, err := Parse("zstd", logger); !errors.Is(err, ErrZstdNotSupported) {
+		t.Fatalf("zstd is not rejected: %v", err)
+	}
+	if _, err := Parse("encrypt?key_file="+filepath.Join(t.TempDir(), "missing"), logger); err == nil {
+		t.Fatal("missing key file is not detected")
+	}
+	// a comma in an option value is encoded
+	keyFile := filepath.Join(t.TempDir(), "stq,keys")
+	if err := ioutil.WriteFile(keyFile, []byte("key "+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("k"), 32))+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if middlewares, err := Parse("encrypt?key_file="+strings.ReplaceAll(keyFile, ",", "%2C")+",gzip", logger); err != nil || len(middlewares) != 2 {
+		t.Fatalf("encoded comma is not parsed: %d middlewares, %v", len(middlewares), err)
+	}
+	if _, err := Parse("concurrency?limit=orders:5,reports:1", logger); !errors.Is(err, ErrUnknownMiddleware) {
+		t.Fatalf("plain comma in an option is not detected: %v", err)
+	}
+	if _, err := Parse("dispatch_rate?limit=orders:5/s&limit=mail:5", logger); err == nil {
+		t.Fatal("invalid rate is not detected")
+	}
+	if _, err := Parse("concurrency?limit=orders:5&limit=mail", logger); err == nil {
+		t.Fatal("invalid limit is not detected")
+	}
+	if _, err := Parse("fault?latency=soon", logger); err == nil {
+		t.Fatal("invalid option is not detected")
+	}
+}
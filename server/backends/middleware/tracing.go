@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+// Tracer starts a span of a backend operation. The returned function ends
+// the span with the operation error.
+type Tracer interface {
+	Start(ctx context.Context, op string) (context.Context, func(err error))
+}
+
+// Tracing reports every backend call as a span to the tracer.
+func Tracing(tracer Tracer) backends.Middleware {
+	return func(backend backends.Backend) backends.Backend {
+		return &tracing{Backend: backend, tracer: tracer}
+	}
+}
+
+type tracing struct {
+	backends.Backend
+	tracer Tracer
+}
+
+func (t *tracing) Unwrap() backends.Backend {
+	return t.Backend
+}
+
+func (t *tracing) Put(ctx context.Context, queue, group string, payload []byte, executionTimeout time.Duration) (string, error) {
+	ctx, end := t.tracer.Start(ctx, "put")
+	taskID, err := t.Backend.Put(ctx, queue, group, payload, executionTimeout)
+	end(err)
+	return taskID, err
+}
+
+func (t *tracing) GetNotReady(ctx context.Context, queue string) (string, []byte, error) {
+	ctx, end := t.tracer.Start(ctx, "get")
+	taskID, payload, err := t.Backend.GetNotReady(ctx, queue)
+	end(err)
+	return taskID, payload, err
+}
+
+func (t *tracing) GetReady(ctx context.Context, taskID string) ([]byte, error) {
+	ctx, end := t.tracer.Start(ctx, "result")
+	result, err := t.Backend.GetReady(ctx, taskID)
+	end(err)
+	return result, err
+}
+
+func (t *tracing) TaskReady(ctx context.Context, taskID string, result []byte) error {
+	ctx, end := t.tracer.Start(ctx, "ready")
+	err := t.Backend.TaskReady(ctx, taskID, result)
+	end(err)
+	return err
+}
+
+func (t *tracing) Stats(ctx context.Context) (*backends.Stats, error) {
+	ctx, end := t.tracer.Start(ctx, "stats")
+	stats, err := t.Backend.Stats(ctx)
+	end(err)
+	return stats, err
+}
+
+type spanKey struct{}
+
+// Span is a span started by LogTracer.
+type Span struct {
+	TraceID string
+	ID      string
+	Parent  string
+	Op      string
+	Started time.Time
+}
+
+// SpanFromContext returns the current span of the context or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// LogTracer is a Tracer writing ended spans to the logger. A span continues
+// the trace of the span in the context.
+type LogTracer struct {
+	Logger *log.Logger
+}
+
+func (l *LogTracer) Start(ctx context.Context, op string) (context.Context, func(err error)) {
+	span := &Span{ID: randomID(8), Op: op, Started: time.Now()}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.Parent = parent.ID
+	} else {
+		span.TraceID = randomID(16)
+	}
+	return context.WithValue(ctx, spanKey{}, span), func(err error) {
+		status := "ok"
+		if err != nil {
+			status = err.Error()
+		}
+		l.Logger.Printf("trace=%s span=%s parent=%s op=%s duration=%s status=%q",
+			span.TraceID, span.ID, span.Parent, span.Op, time.Since(span.Started), status)
+	}
+}
+
+func randomID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,96 @@
+package backends
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnknownBackend = errors.New("unknown backend")
+)
+
+// Config is a parsed backend configuration string (DSN). The DSN is either
+// a bare backend name like "memory" or an URL whose scheme is the backend
+// name, for example "memory://?snapshot=/var/lib/stq/memory.snapshot".
+type Config struct {
+	// Backend name.
+	Name string
+	// DSN as is.
+	DSN string
+	// Host and Path of the DSN URL.
+	Host string
+	Path string
+	// Query parameters of the DSN URL.
+	Params url.Values
+}
+
+// Factory creates a backend from the config.
+type Factory func(config *Config) (Backend, error)
+
+var (
+	factories      = make(map[string]Factory)
+	factoriesMutex sync.RWMutex
+)
+
+// Register makes a backend factory available by the name. It is intended to
+// be called from the init function of a backend package and panics if the
+// name is registered twice or the factory is nil.
+func Register(name string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	if factory == nil {
+		panic("backends: Register factory is nil")
+	}
+	if _, ok := factories[name]; ok {
+		panic("backends: Register called twice for backend " + name)
+	}
+	factories[name] = factory
+}
+
+// Names returns a sorted list of the registered backends.
+func Names() []string {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseConfig parses the backend DSN.
+func ParseConfig(dsn string) (*Config, error) {
+	if !strings.Contains(dsn, "://") {
+		return &Config{Name: dsn, DSN: dsn, Params: url.Values{}}, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{
+		Name:   u.Scheme,
+		DSN:    dsn,
+		Host:   u.Host,
+		Path:   u.Path,
+		Params: u.Query(),
+	}, nil
+}
+
+// Open creates a backend by the DSN with the registered factory.
+func Open(dsn string) (Backend, error) {
+	config, err := ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	factoriesMutex.RLock()
+	factory, ok := factories[config.Name]
+	factoriesMutex.RUnlock()
+	if !ok {
+		return nil, ErrUnknownBackend
+	}
+	return factory(config)
+}
@@ -0,0 +1,71 @@
+package backends
+
+import (
+	"testing"
+)
+
+type namedBackend struct {
+	Backend
+	name string
+}
+
+func (b *namedBackend) Name() string {
+	return b.name
+}
+
+func Test_Registry(t *testing.T) {
+	var opened *Config
+	Register("test", func(config *Config) (Backend, error) {
+		opened = config
+		return &namedBackend{name: "test"}, nil
+	})
+	t.Run("Open by name", func(t *testing.T) {
+		backend, err := Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backend.Name() != "test" {
+			t.Fatalf("name is not equal: %s != %s", backend.Name(), "test")
+		}
+		if opened.Name != "test" || opened.DSN != "test" || len(opened.Params) != 0 {
+			t.Fatalf("unexpected config: %+v", opened)
+		}
+	})
+	t.Run("Open by DSN", func(t *testing.T) {
+		if _, err := Open("test://host/path?a=1&b=2"); err != nil {
+			t.Fatal(err)
+		}
+		if opened.Name != "test" || opened.Host != "host" || opened.Path != "/path" {
+			t.Fatalf("unexpected config: %+v", opened)
+		}
+		if opened.Params.Get("a") != "1" || opened.Params.Get("b") != "2" {
+			t.Fatalf("unexpected params: %v", opened.Params)
+		}
+	})
+	t.Run("Open unknown", func(t *testing.T) {
+		if _, err := Open("unknown://"); err != ErrUnknownBackend {
+			t.Fatalf("unknown backend is not detected: %v", err)
+		}
+	})
+	t.Run("Names", func(t *testing.T) {
+		found := false
+		for _, name := range Names() {
+			if name == "test" {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("test is not in names: %v", Names())
+		}
+	})
+	t.Run("Register twice", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("second Register does not panic")
+			}
+		}()
+		Register("test", func(config *Config) (Backend, error) {
+			return nil, nil
+		})
+	})
+}
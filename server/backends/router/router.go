@@ -0,0 +1,320 @@
+// Package router is a backend routing queues to other backends by queue
+// name. Task ids are prefixed with the name of the owning backend, so tasks
+// are found without knowing their queue.
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+var (
+	ErrNoRoute = errors.New("no route for queue")
+)
+
+// separator splits the backend name and the backend task id.
+const separator = ":"
+
+func init() {
+	backends.Register("router", func(config *backends.Config) (backends.Backend, error) {
+		return Open(config)
+	})
+}
+
+// Route sends queues matching the pattern to the named backend. The pattern
+// is a queue name or a prefix ending with "*", "*" alone matches all queues.
+type Route struct {
+	Pattern string
+	Backend string
+}
+
+type Router struct {
+	backends map[string]backends.Backend
+	exact    map[string]string
+	// prefix routes, longest prefix first
+	prefixes []Route
+}
+
+// New creates a router over the named backends. Exact routes win over
+// prefix routes and a longer prefix wins over a shorter one.
+func New(namedBackends map[string]backends.Backend, routes []Route) (*Router, error) {
+	r := &Router{
+		backends: namedBackends,
+		exact:    make(map[string]string),
+	}
+	for name := range namedBackends {
+		if name == "" || strings.Contains(name, separator) {
+			return nil, fmt.Errorf("invalid backend name %q", name)
+		}
+	}
+	for _, route := range routes {
+		if _, ok := namedBackends[route.Backend]; !ok {
+			return nil, fmt.Errorf("route %s: unknown backend %q", route.Pattern, route.Backend)
+		}
+		if strings.HasSuffix(route.Pattern, "*") {
+			r.prefixes = append(r.prefixes, Route{
+				Pattern: strings.TrimSuffix(route.Pattern, "*"),
+				Backend: route.Backend,
+			})
+			continue
+		}
+		r.exact[route.Pattern] = route.Backend
+	}
+	sort.SliceStable(r.prefixes, func(i, j int) bool {
+		return len(r.prefixes[i].Pattern) > len(r.prefixes[j].Pattern)
+	})
+	return r, nil
+}
+
+// Open creates a router from the config. Backends are opened by DSN from
+// "backend.NAME" params and routes are "route" params of the PATTERN=NAME
+// form, for example:
+//
+//	router://?backend.fast=memory&backend.durable=memory&route=orders.*=durable&route=*=fast
+func Open(config *backends.Config) (*Router, error) {
+	namedBackends := make(map[string]backends.Backend)
+	closeAll := func() {
+		for _, backend := range namedBackends {
+			backend.Close()
+		}
+	}
+	for key := range config.Params {
+		if !strings.HasPrefix(key, "backend.") {
+			continue
+		}
+		name := strings.TrimPrefix(key, "backend.")
+		backend, err := backends.Open(config.Params.Get(key))
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("backend %s: %w", name, err)
+		}
+		namedBackends[name] = backend
+	}
+	var routes []Route
+	for _, value := range config.Params["route"] {
+		i := strings.LastIndex(value, "=")
+		if i < 0 {
+			closeAll()
+			return nil, fmt.Errorf("invalid route %q", value)
+		}
+		routes = append(routes, Route{Pattern: value[:i], Backend: value[i+1:]})
+	}
+	r, err := New(namedBackends, routes)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Router) Close() error {
+	var firstErr error
+	for _, backend := range r.backends {
+		if err := backend.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (r *Router) Name() string {
+	return "router"
+}
+
+// Route returns the name and the backend of the queue.
+func (r *Router) Route(queue string) (string, backends.Backend, bool) {
+	name, ok := r.exact[queue]
+	if !ok {
+		for _, route := range r.prefixes {
+			if strings.HasPrefix(queue, route.Pattern) {
+				name, ok = route.Backend, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return "", nil, false
+	}
+	return name, r.backends[name], true
+}
+
+// task returns the backend and its task id of the router task id.
+func (r *Router) task(taskID string) (backends.Backend, string, bool) {
+	i := strings.Index(taskID, separator)
+	if i < 0 {
+		return nil, "", false
+	}
+	backend, ok := r.backends[taskID[:i]]
+	return backend, taskID[i+1:], ok
+}
+
+func (r *Router) Put(ctx context.Context, queue, group string, payload []byte, executionTimeout time.Duration) (string, error) {
+	name, backend, ok := r.Route(queue)
+	if !ok {
+		return "", backends.QueueError("put", queue, ErrNoRoute)
+	}
+	taskID, err := backend.Put(ctx, queue, group, payload, executionTimeout)
+	if err != nil {
+		return "", err
+	}
+	return name + separator + taskID, nil
+}
+
+func (r *Router) GetNotReady(ctx context.Context, queue string) (string, []byte, error) {
+	name, backend, ok := r.Route(queue)
+	if !ok {
+		return "", nil, backends.QueueError("get", queue, backends.ErrQueueNotFound)
+	}
+	taskID, payload, err := backend.GetNotReady(ctx, queue)
+	if err != nil {
+		return "", nil, err
+	}
+	return name + separator + taskID, payload, nil
+}
+
+func (r *Router) GetReady(ctx context.Context, taskID string) ([]byte, error) {
+	backend, backendTaskID, ok := r.task(taskID)
+	if !ok {
+		return nil, backends.TaskError("result", taskID, backends.ErrTaskNotFoundOrNotReady)
+	}
+	return backend.GetReady(ctx, backendTaskID)
+}
+
+func (r *Router) TaskReady(ctx context.Context, taskID string, result []byte) error {
+	backend, backendTaskID, ok := r.task(taskID)
+	if !ok {
+		return backends.TaskError("ready", taskID, backends.ErrTaskNotFoundOrNotReady)
+	}
+	return backend.TaskReady(ctx, backendTaskID, result)
+}
+
+// Stats merges stats of all backends, stats of a queue present in several
+// backends are summed.
+func (r *Router) Stats(ctx context.Context) (*backends.Stats, error) {
+	queues := make(map[string]backends.QueueStats)
+	for _, backend := range r.backends {
+		stats, err := backend.Stats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for queue, queueStats := range stats.Queues {
+			merged := queues[queue]
+			merged.Add(queueStats)
+			queues[queue] = merged
+		}
+	}
+	return backends.NewStats(queues), nil
+}
+
+// Snapshot saves snapshots of the backends having snapshots on.
+func (r *Router) Snapshot(ctx context.Context) error {
+	for name, backend := range r.backends {
+		var snapshotter backends.Snapshotter
+		if !backends.As(backend, &snapshotter) {
+			continue
+		}
+		err := snapshotter.Snapshot(ctx)
+		if err != nil && !errors.Is(err, backends.ErrSnapshotsOff) {
+			return fmt.Errorf("backend %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Export exports tasks of all backends with router task ids.
+func (r *Router) Export(ctx context.Context, fn func(task *backends.Task) error) error {
+	for name, backend := range r.backends {
+		var exporter backends.Exporter
+		if !backends.As(backend, &exporter) {
+			return fmt.Errorf("backend %s: %w", name, backends.ErrNotSupported)
+		}
+		err := exporter.Export(ctx, func(task *backends.Task) error {
+			exported := *task
+			exported.ID = name + separator + task.ID
+			return fn(&exported)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import imports the task to the backend its router task id points to or
+// to the backend of its queue if the id is not a router one.
+func (r *Router) Import(ctx context.Context, task *backends.Task) error {
+	backend, backendTaskID, ok := r.task(task.ID)
+	if !ok {
+		_, backend, ok = r.Route(task.Queue)
+		if !ok {
+			return backends.QueueError("import", task.Queue, ErrNoRoute)
+		}
+		backendTaskID = task.ID
+	}
+	var importer backends.Importer
+	if !backends.As(backend, &importer) {
+		return backends.ErrNotSupported
+	}
+	imported := *task
+	imported.ID = backendTaskID
+	return importer.Import(ctx, &imported)
+}
+
+// Task returns the task with its router task id.
+func (r *Router) Task(ctx context.Context, taskID string) (*backends.Task, error) {
+	backend, backendTaskID, ok := r.task(taskID)
+	if !ok {
+		return nil, backends.TaskError("task", taskID, backends.ErrTaskNotFound)
+	}
+	var inspector backends.Inspector
+	if !backends.As(backend, &inspector) {
+		return nil, backends.ErrNotSupported
+	}
+	task, err := inspector.Task(ctx, backendTaskID)
+	if err != nil {
+		return nil, err
+	}
+	task.ID = taskID
+	return task, nil
+}
+
+// Delete deletes the task from its backend.
+func (r *Router) Delete(ctx context.Context, taskID string) error {
+	backend, backendTaskID, ok := r.task(taskID)
+	if !ok {
+		return backends.TaskError("delete", taskID, backends.ErrTaskNotFound)
+	}
+	var deleter backends.Deleter
+	if !backends.As(backend, &deleter) {
+		return backends.ErrNotSupported
+	}
+	return deleter.Delete(ctx, backendTaskID)
+}
+
+// SetPaused pauses or resumes dispatch of the queue by its backend.
+func (r *Router) SetPaused(ctx context.Context, queue string, paused bool) error {
+	_, backend, ok := r.Route(queue)
+	if !ok {
+		return backends.QueueError("pause", queue, ErrNoRoute)
+	}
+	var pauser backends.Pauser
+	if !backends.As(backend, &pauser) {
+		return backends.QueueError("pause", queue, backends.ErrNotSupported)
+	}
+	return pauser.SetPaused(ctx, queue, paused)
+}
+
+// QueueStats returns the stats of the queue of its backend.
+func (r *Router) QueueStats(ctx context.Context, queue string) (backends.QueueStats, error) {
+	_, backend, ok := r.Route(queue)
+	if !ok {
+		return backends.QueueStats{}, nil
+	}
+	return backends.QueueStatsOf(ctx, backend, queue)
+}
@@ -0,0 +1,139 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/backendtest"
+	"github.com/alexio777/stq/server/backends/memory"
+)
+
+func newRouter(t *testing.T) (*Router, *memory.Memory, *memory.Memory) {
+	fast, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	durable, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(map[string]backends.Backend{
+		"fast":    fast,
+		"durable": durable,
+	}, []Route{
+		{Pattern: "orders*", Backend: "durable"},
+		{Pattern: "orders.logs", Backend: "fast"},
+		{Pattern: "*", Backend: "fast"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, fast, durable
+}
+
+func Test_Conformance(t *testing.T) {
+	backendtest.Run(t, func() (backends.Backend, error) {
+		r, _, _ := newRouter(t)
+		return r, nil
+	})
+}
+
+func Test_Router(t *testing.T) {
+	ctx := context.TODO()
+	r, fast, durable := newRouter(t)
+	for queue, owner := range map[string]*memory.Memory{
+		"orders":      durable,
+		"orders.eu":   durable,
+		"orders.logs": fast,
+		"images":      fast,
+	} {
+		taskID, err := r.Put(ctx, queue, "", []byte("payload"), time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := owner.Stats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Queues[queue].WaitLength != 1 {
+			t.Fatalf("queue %s is not routed to its backend: %+v", queue, stats.Queues)
+		}
+		name, _, _ := r.Route(queue)
+		if !strings.HasPrefix(taskID, name+":") {
+			t.Fatalf("taskID is not prefixed with backend name %s: %s", name, taskID)
+		}
+	}
+	stats, err := r.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Queues) != 4 || stats.Total.WaitLength != 4 {
+		t.Fatalf("stats is not merged: %+v", stats)
+	}
+	if _, err := r.GetReady(ctx, "unknown:1"); !errors.Is(err, backends.ErrTaskNotFoundOrNotReady) {
+		t.Fatalf("unknown backend is not detected: %v", err)
+	}
+	if err := r.TaskReady(ctx, "1", nil); !errors.Is(err, backends.ErrTaskNotFoundOrNotReady) {
+		t.Fatalf("task id without backend is not detected: %v", err)
+	}
+}
+
+func Test_NoRoute(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(map[string]backends.Backend{"memory": backend}, []Route{{Pattern: "a", Backend: "memory"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Put(context.TODO(), "b", "", nil, time.Minute); !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("missing route is not detected: %v", err)
+	}
+	if _, _, err := r.GetNotReady(context.TODO(), "b"); !errors.Is(err, backends.ErrQueueNotFound) {
+		t.Fatalf("missing route is not detected: %v", err)
+	}
+}
+
+func Test_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "durable.snapshot")
+	r, err := backends.Open("router://?backend.fast=memory&backend.durable=" +
+		url.QueryEscape("memory://?snapshot="+path) + "&route=*=durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshotter backends.Snapshotter
+	if !backends.As(r, &snapshotter) {
+		t.Fatal("router is not a snapshotter")
+	}
+	if err := snapshotter.Snapshot(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Open(t *testing.T) {
+	backend, err := backends.Open("router://?backend.fast=memory&backend.durable=memory&route=orders*=durable&route=*=fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := backend.(*Router)
+	if name, _, _ := r.Route("orders.eu"); name != "durable" {
+		t.Fatalf("unexpected route: %s", name)
+	}
+	if name, _, _ := r.Route("images"); name != "fast" {
+		t.Fatalf("unexpected route: %s", name)
+	}
+	if _, err := backends.Open("router://?backend.fast=memory&route=*=slow"); err == nil {
+		t.Fatal("route to unknown backend is not detected")
+	}
+}
@@ -0,0 +1,339 @@
+// Package shard is a backend partitioning queues across independent
+// backend instances, so calls for different queues do not contend for the
+// locks of one backend. Queues are assigned to shards by the hash of their
+// name, or the tasks of every queue are spread across all shards. Task ids
+// are prefixed with the shard number, so tasks are found without knowing
+// their queue.
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+// separator splits the shard number and the shard task id.
+const separator = ":"
+
+// Mode is the way tasks are assigned to shards.
+type Mode string
+
+const (
+	// All tasks of a queue are in the shard of the queue name hash, the
+	// queue keeps its FIFO order.
+	ByQueue Mode = "queue"
+	// Tasks of a queue are spread across all shards in turn, a single busy
+	// queue scales too, but the FIFO order holds within a shard only.
+	ByTask Mode = "task"
+)
+
+func init() {
+	backends.Register("shard", func(config *backends.Config) (backends.Backend, error) {
+		return Open(config)
+	})
+}
+
+type Shard struct {
+	shards []backends.Backend
+	mode   Mode
+	// round robin counters of Put and GetNotReady in ByTask mode
+	putCounter uint64
+	getCounter uint64
+}
+
+// New creates a sharded backend over the shards.
+func New(shards []backends.Backend, mode Mode) (*Shard, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("no shards")
+	}
+	if mode != ByQueue && mode != ByTask {
+		return nil, fmt.Errorf("unknown shard mode %q", mode)
+	}
+	return &Shard{shards: shards, mode: mode}, nil
+}
+
+// Open creates a sharded backend from the config. Every shard is opened by
+// the DSN of the "backend" param with "{shard}" replaced by the shard
+// number, "shards" is the number of shards, the number of CPUs by default,
+// and "by" is the mode, for example:
+//
+//	shard://?backend=memory&shards=8&by=queue
+func Open(config *backends.Config) (*Shard, error) {
+	dsn := config.Params.Get("backend")
+	if dsn == "" {
+		dsn = "memory"
+	}
+	n := runtime.NumCPU()
+	if value := config.Params.Get("shards"); value != "" {
+		var err error
+		n, err = strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid shards %q", value)
+		}
+	}
+	mode := ByQueue
+	if value := config.Params.Get("by"); value != "" {
+		mode = Mode(value)
+	}
+	shards := make([]backends.Backend, 0, n)
+	closeAll := func() {
+		for _, backend := range shards {
+			backend.Close()
+		}
+	}
+	for i := 0; i < n; i++ {
+		backend, err := backends.Open(strings.ReplaceAll(dsn, "{shard}", strconv.Itoa(i)))
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+		shards = append(shards, backend)
+	}
+	s, err := New(shards, mode)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Shard) Close() error {
+	var firstErr error
+	for _, backend := range s.shards {
+		if err := backend.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *Shard) Name() string {
+	return "shard"
+}
+
+// Shards returns the number of shards.
+func (s *Shard) Shards() int {
+	return len(s.shards)
+}
+
+// QueueShard returns the shard number of the queue in ByQueue mode.
+func (s *Shard) QueueShard(queue string) int {
+	h := fnv.New32a()
+	h.Write([]byte(queue))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+// task returns the shard and its task id of the shard task id.
+func (s *Shard) task(taskID string) (backends.Backend, string, bool) {
+	i := strings.Index(taskID, separator)
+	if i < 0 {
+		return nil, "", false
+	}
+	n, err := strconv.Atoi(taskID[:i])
+	if err != nil || n < 0 || n >= len(s.shards) {
+		return nil, "", false
+	}
+	return s.shards[n], taskID[i+1:], true
+}
+
+func shardTaskID(n int, taskID string) string {
+	return strconv.Itoa(n) + separator + taskID
+}
+
+func (s *Shard) Put(ctx context.Context, queue, group string, payload []byte, executionTimeout time.Duration) (string, error) {
+	n := s.QueueShard(queue)
+	if s.mode == ByTask {
+		n = int(atomic.AddUint64(&s.putCounter, 1) % uint64(len(s.shards)))
+	}
+	taskID, err := s.shards[n].Put(ctx, queue, group, payload, executionTimeout)
+	if err != nil {
+		return "", err
+	}
+	return shardTaskID(n, taskID), nil
+}
+
+func (s *Shard) GetNotReady(ctx context.Context, queue string) (string, []byte, error) {
+	if s.mode == ByQueue {
+		n := s.QueueShard(queue)
+		taskID, payload, err := s.shards[n].GetNotReady(ctx, queue)
+		if err != nil {
+			return "", nil, err
+		}
+		return shardTaskID(n, taskID), payload, nil
+	}
+	// workers start at different shards and take the first task found
+	start := atomic.AddUint64(&s.getCounter, 1)
+	for i := range s.shards {
+		n := int((start + uint64(i)) % uint64(len(s.shards)))
+		taskID, payload, err := s.shards[n].GetNotReady(ctx, queue)
+		if errors.Is(err, backends.ErrQueueNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		return shardTaskID(n, taskID), payload, nil
+	}
+	return "", nil, backends.QueueError("get", queue, backends.ErrQueueNotFound)
+}
+
+func (s *Shard) GetReady(ctx context.Context, taskID string) ([]byte, error) {
+	backend, shardTaskID, ok := s.task(taskID)
+	if !ok {
+		return nil, backends.TaskError("result", taskID, backends.ErrTaskNotFoundOrNotReady)
+	}
+	return backend.GetReady(ctx, shardTaskID)
+}
+
+func (s *Shard) TaskReady(ctx context.Context, taskID string, result []byte) error {
+	backend, shardTaskID, ok := s.task(taskID)
+	if !ok {
+		return backends.TaskError("ready", taskID, backends.ErrTaskNotFoundOrNotReady)
+	}
+	return backend.TaskReady(ctx, shardTaskID, result)
+}
+
+// Stats merges stats of all shards, stats of a queue spread across shards
+// are summed.
+func (s *Shard) Stats(ctx context.Context) (*backends.Stats, error) {
+	queues := make(map[string]backends.QueueStats)
+	for _, backend := range s.shards {
+		stats, err := backend.Stats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for queue, queueStats := range stats.Queues {
+			merged := queues[queue]
+			merged.Add(queueStats)
+			queues[queue] = merged
+		}
+	}
+	return backends.NewStats(queues), nil
+}
+
+// Snapshot saves snapshots of the shards having snapshots on.
+func (s *Shard) Snapshot(ctx context.Context) error {
+	for n, backend := range s.shards {
+		var snapshotter backends.Snapshotter
+		if !backends.As(backend, &snapshotter) {
+			continue
+		}
+		err := snapshotter.Snapshot(ctx)
+		if err != nil && !errors.Is(err, backends.ErrSnapshotsOff) {
+			return fmt.Errorf("shard %d: %w", n, err)
+		}
+	}
+	return nil
+}
+
+// Export exports tasks of all shards with shard task ids.
+func (s *Shard) Export(ctx context.Context, fn func(task *backends.Task) error) error {
+	for n, backend := range s.shards {
+		var exporter backends.Exporter
+		if !backends.As(backend, &exporter) {
+			return fmt.Errorf("shard %d: %w", n, backends.ErrNotSupported)
+		}
+		err := exporter.Export(ctx, func(task *backends.Task) error {
+			exported := *task
+			exported.ID = shardTaskID(n, task.ID)
+			return fn(&exported)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import imports the task to the shard its shard task id points to or to
+// the shard of its queue if the id is not a shard one.
+func (s *Shard) Import(ctx context.Context, task *backends.Task) error {
+	backend, shardTaskID, ok := s.task(task.ID)
+	if !ok {
+		backend, shardTaskID = s.shards[s.QueueShard(task.Queue)], task.ID
+	}
+	var importer backends.Importer
+	if !backends.As(backend, &importer) {
+		return backends.ErrNotSupported
+	}
+	imported := *task
+	imported.ID = shardTaskID
+	return importer.Import(ctx, &imported)
+}
+
+// Task returns the task with its shard task id.
+func (s *Shard) Task(ctx context.Context, taskID string) (*backends.Task, error) {
+	backend, shardTaskID, ok := s.task(taskID)
+	if !ok {
+		return nil, backends.TaskError("task", taskID, backends.ErrTaskNotFound)
+	}
+	var inspector backends.Inspector
+	if !backends.As(backend, &inspector) {
+		return nil, backends.ErrNotSupported
+	}
+	task, err := inspector.Task(ctx, shardTaskID)
+	if err != nil {
+		return nil, err
+	}
+	task.ID = taskID
+	return task, nil
+}
+
+// Delete deletes the task from its shard.
+func (s *Shard) Delete(ctx context.Context, taskID string) error {
+	backend, shardTaskID, ok := s.task(taskID)
+	if !ok {
+		return backends.TaskError("delete", taskID, backends.ErrTaskNotFound)
+	}
+	var deleter backends.Deleter
+	if !backends.As(backend, &deleter) {
+		return backends.ErrNotSupported
+	}
+	return deleter.Delete(ctx, shardTaskID)
+}
+
+// SetPaused pauses or resumes dispatch of the queue by the shard of the
+// queue in ByQueue mode and by all shards otherwise.
+func (s *Shard) SetPaused(ctx context.Context, queue string, paused bool) error {
+	shards := s.shards
+	if s.mode == ByQueue {
+		n := s.QueueShard(queue)
+		shards = s.shards[n : n+1]
+	}
+	for _, backend := range shards {
+		var pauser backends.Pauser
+		if !backends.As(backend, &pauser) {
+			return backends.QueueError("pause", queue, backends.ErrNotSupported)
+		}
+		if err := pauser.SetPaused(ctx, queue, paused); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueueStats returns the stats of the queue summed across its shards.
+func (s *Shard) QueueStats(ctx context.Context, queue string) (backends.QueueStats, error) {
+	shards := s.shards
+	if s.mode == ByQueue {
+		n := s.QueueShard(queue)
+		shards = s.shards[n : n+1]
+	}
+	var stats backends.QueueStats
+	for _, backend := range shards {
+		shardStats, err := backends.QueueStatsOf(ctx, backend, queue)
+		if err != nil {
+			return backends.QueueStats{}, err
+		}
+		stats.Add(shardStats)
+	}
+	return stats, nil
+}
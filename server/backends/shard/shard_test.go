@@ -0,0 +1,153 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/backendtest"
+	"github.com/alexio777/stq/server/backends/memory"
+)
+
+func newShard(t testing.TB, n int, mode Mode) *Shard {
+	shards := make([]backends.Backend, n)
+	for i := range shards {
+		backend, err := memory.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards[i] = backend
+	}
+	s, err := New(shards, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func Test_Conformance(t *testing.T) {
+	backendtest.Run(t, func() (backends.Backend, error) {
+		return newShard(t, 4, ByQueue), nil
+	})
+}
+
+func Test_ByQueue(t *testing.T) {
+	ctx := context.TODO()
+	s := newShard(t, 4, ByQueue)
+	for i := 0; i < 20; i++ {
+		queue := fmt.Sprint("queue", i)
+		taskID, err := s.Put(ctx, queue, "", []byte("payload"), time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(taskID, fmt.Sprint(s.QueueShard(queue), ":")) {
+			t.Fatalf("taskID is not prefixed with queue shard %d: %s", s.QueueShard(queue), taskID)
+		}
+	}
+	stats, err := s.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Queues) != 20 || stats.Total.WaitLength != 20 {
+		t.Fatalf("stats is not merged: %+v", stats)
+	}
+	if _, err := s.GetReady(ctx, "4:1"); !errors.Is(err, backends.ErrTaskNotFoundOrNotReady) {
+		t.Fatalf("unknown shard is not detected: %v", err)
+	}
+	if err := s.TaskReady(ctx, "1", nil); !errors.Is(err, backends.ErrTaskNotFoundOrNotReady) {
+		t.Fatalf("task id without shard is not detected: %v", err)
+	}
+}
+
+func Test_ByTask(t *testing.T) {
+	ctx := context.TODO()
+	s := newShard(t, 4, ByTask)
+	for i := 0; i < 8; i++ {
+		if _, err := s.Put(ctx, "queue", "", []byte("payload"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for n, backend := range s.shards {
+		stats, err := backend.Stats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Queues["queue"].WaitLength != 2 {
+			t.Fatalf("tasks are not spread to shard %d: %+v", n, stats.Queues)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		taskID, _, err := s.GetNotReady(ctx, "queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.TaskReady(ctx, taskID, []byte("result")); err != nil {
+			t.Fatal(err)
+		}
+		result, err := s.GetReady(ctx, taskID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) != "result" {
+			t.Fatalf("result is not equal: %s != %s", result, "result")
+		}
+	}
+	if _, _, err := s.GetNotReady(ctx, "queue"); !errors.Is(err, backends.ErrQueueNotFound) {
+		t.Fatalf("drained queue is not detected: %v", err)
+	}
+}
+
+func Test_Open(t *testing.T) {
+	backend, err := backends.Open("shard://?backend=memory&shards=3&by=task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	s := backend.(*Shard)
+	if s.Shards() != 3 || s.mode != ByTask {
+		t.Fatalf("unexpected shards: %d %s", s.Shards(), s.mode)
+	}
+	if _, err := backends.Open("shard://?shards=0"); err == nil {
+		t.Fatal("invalid shards is not detected")
+	}
+	if _, err := backends.Open("shard://?by=payload"); err == nil {
+		t.Fatal("invalid mode is not detected")
+	}
+}
+
+// Benchmark_Shards runs the task lifecycle on many queues in parallel,
+// throughput scales with shards up to the number of cores:
+//
+//	go test -bench Shards -cpu 1,2,4,8 ./server/backends/shard
+func Benchmark_Shards(b *testing.B) {
+	for _, n := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprint("shards=", n), func(b *testing.B) {
+			ctx := context.TODO()
+			s := newShard(b, n, ByQueue)
+			var worker uint64
+			b.RunParallel(func(pb *testing.PB) {
+				queue := fmt.Sprint("queue", atomic.AddUint64(&worker, 1))
+				for pb.Next() {
+					if _, err := s.Put(ctx, queue, "", []byte("payload"), time.Minute); err != nil {
+						b.Fatal(err)
+					}
+					taskID, _, err := s.GetNotReady(ctx, queue)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if err := s.TaskReady(ctx, taskID, []byte("result")); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := s.GetReady(ctx, taskID); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
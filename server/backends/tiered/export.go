@@ -0,0 +1,154 @@
+package tiered
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+// Task returns a copy of the task with its state.
+func (t *Tiered) Task(ctx context.Context, taskID string) (*backends.Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, backends.TaskError("task", taskID, err)
+	}
+	t.mutex.Lock()
+	if q, ok := t.spilled[taskID]; ok {
+		defer t.mutex.Unlock()
+		task, err := q.read(q.find(taskID))
+		if err != nil {
+			return nil, backends.TaskError("task", taskID, err)
+		}
+		return task, nil
+	}
+	t.mutex.Unlock()
+	task, err := t.memory.Task(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	if task.Payload, err = t.decode(task.Payload); err != nil {
+		return nil, backends.TaskError("task", taskID, err)
+	}
+	return task, nil
+}
+
+// Delete deletes the task in any state.
+func (t *Tiered) Delete(ctx context.Context, taskID string) error {
+	if err := ctx.Err(); err != nil {
+		return backends.TaskError("delete", taskID, err)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if q, ok := t.spilled[taskID]; ok {
+		q.remove(q.find(taskID))
+		delete(t.spilled, taskID)
+		return nil
+	}
+	task, err := t.memory.Task(ctx, taskID)
+	if err != nil {
+		return err
+	}
+	if err := t.memory.Delete(ctx, taskID); err != nil {
+		return err
+	}
+	if task.State == backends.TaskWaiting {
+		t.memoryBytes -= taskSize(task)
+		t.queues[task.Queue].inMemory--
+	}
+	t.removeBlob(taskID)
+	return nil
+}
+
+// Export calls fn for every task, spilled tasks follow the tasks in memory
+// of their queue. The tasks are listed while no task moves between memory
+// and disk, fn is called after.
+func (t *Tiered) Export(ctx context.Context, fn func(task *backends.Task) error) error {
+	t.mutex.Lock()
+	var tasks []*backends.Task
+	err := t.memory.Export(ctx, func(task *backends.Task) error {
+		exported := *task
+		tasks = append(tasks, &exported)
+		return nil
+	})
+	if err != nil {
+		t.mutex.Unlock()
+		return err
+	}
+	for _, q := range t.queues {
+		for _, s := range q.list() {
+			task, err := q.read(s)
+			if err != nil {
+				t.mutex.Unlock()
+				return err
+			}
+			tasks = append(tasks, task)
+		}
+	}
+	t.mutex.Unlock()
+	for _, task := range tasks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		payload, err := t.decode(task.Payload)
+		if os.IsNotExist(err) {
+			// the task is gone since it is listed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		task.Payload = payload
+		if err := fn(task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import adds the task in its state, waiting tasks are spilled like new
+// ones. Numeric task ids move the task id counter forward.
+func (t *Tiered) Import(ctx context.Context, task *backends.Task) error {
+	if err := ctx.Err(); err != nil {
+		return backends.TaskError("import", task.ID, err)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.spilled[task.ID]; ok {
+		return backends.TaskError("import", task.ID, backends.ErrTaskExists)
+	}
+	if _, err := t.memory.Task(ctx, task.ID); err == nil {
+		return backends.TaskError("import", task.ID, backends.ErrTaskExists)
+	}
+	if id, err := strconv.ParseUint(task.ID, 10, 64); err == nil && id > t.taskIDCounter {
+		t.taskIDCounter = id
+	}
+	if task.State != backends.TaskWaiting {
+		return t.memory.Import(ctx, task)
+	}
+	if err := t.put(ctx, task); err != nil {
+		return backends.TaskError("import", task.ID, err)
+	}
+	return nil
+}
+
+func (t *Tiered) LastTaskID(ctx context.Context) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.taskIDCounter, nil
+}
+
+func (t *Tiered) SetLastTaskID(ctx context.Context, id uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if id > t.taskIDCounter {
+		t.taskIDCounter = id
+	}
+	return nil
+}
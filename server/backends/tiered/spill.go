@@ -0,0 +1,139 @@
+package tiered
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/export"
+)
+
+// spilledTask is the place of a task in the spill file.
+type spilledTask struct {
+	id      string
+	offset  int64
+	length  int
+	deleted bool
+}
+
+// spillQueue is the tail of a queue on disk in FIFO order. Tasks are
+// appended to the spill file as export records and read back by their
+// offsets, the file is truncated when all its tasks are read.
+type spillQueue struct {
+	path string
+	file *os.File
+	size int64
+	// spilled tasks, tasks before head are moved to memory
+	tasks []*spilledTask
+	head  int
+	// deleted tasks after head
+	deleted int
+	// waiting tasks of the queue in memory
+	inMemory int
+}
+
+// len returns the number of spilled tasks.
+func (q *spillQueue) len() int {
+	return len(q.tasks) - q.head - q.deleted
+}
+
+func (q *spillQueue) push(task *backends.Task) error {
+	if q.file == nil {
+		f, err := os.OpenFile(q.path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		q.file = f
+	}
+	data, err := json.Marshal(export.NewRecord(task))
+	if err != nil {
+		return err
+	}
+	if _, err := q.file.WriteAt(data, q.size); err != nil {
+		return err
+	}
+	q.tasks = append(q.tasks, &spilledTask{id: task.ID, offset: q.size, length: len(data)})
+	q.size += int64(len(data))
+	return nil
+}
+
+// peek returns the first spilled task, the queue must not be empty.
+func (q *spillQueue) peek() *spilledTask {
+	q.skipDeleted()
+	return q.tasks[q.head]
+}
+
+// pop removes the first spilled task.
+func (q *spillQueue) pop() {
+	q.skipDeleted()
+	q.tasks[q.head] = nil
+	q.head++
+	q.reset()
+}
+
+func (q *spillQueue) skipDeleted() {
+	for q.head < len(q.tasks) && q.tasks[q.head].deleted {
+		q.tasks[q.head] = nil
+		q.head++
+		q.deleted--
+	}
+}
+
+// reset truncates the spill file if all its tasks are read.
+func (q *spillQueue) reset() {
+	q.skipDeleted()
+	if q.head < len(q.tasks) || q.file == nil {
+		return
+	}
+	q.tasks = nil
+	q.head = 0
+	q.size = 0
+	q.file.Truncate(0)
+}
+
+func (q *spillQueue) read(s *spilledTask) (*backends.Task, error) {
+	data := make([]byte, s.length)
+	if _, err := q.file.ReadAt(data, s.offset); err != nil {
+		return nil, err
+	}
+	var record export.Record
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return record.Task(), nil
+}
+
+// find returns the spilled task by id.
+func (q *spillQueue) find(taskID string) *spilledTask {
+	for _, s := range q.tasks[q.head:] {
+		if s.id == taskID && !s.deleted {
+			return s
+		}
+	}
+	return nil
+}
+
+// remove marks the spilled task deleted.
+func (q *spillQueue) remove(s *spilledTask) {
+	s.deleted = true
+	q.deleted++
+	q.reset()
+}
+
+// list returns the spilled tasks in FIFO order.
+func (q *spillQueue) list() []*spilledTask {
+	var tasks []*spilledTask
+	for _, s := range q.tasks[q.head:] {
+		if !s.deleted {
+			tasks = append(tasks, s)
+		}
+	}
+	return tasks
+}
+
+func (q *spillQueue) close() {
+	if q.file != nil {
+		q.file.Close()
+		q.file = nil
+	}
+}
@@ -0,0 +1,372 @@
+// Package tiered is a memory backend spilling waiting tasks to local disk
+// under memory pressure. The head of every queue is kept in memory; once
+// the waiting tasks in memory exceed the memory budget, new tasks are
+// appended to a spill file of their queue and moved back to memory as
+// workers drain the queue, so the FIFO order is kept. Payloads larger than
+// the blob size are stored in their own files whatever the budget.
+//
+// Spilled tasks and blobs do not survive a restart, the same as the tasks
+// in memory.
+package tiered
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/memory"
+)
+
+const (
+	// DefaultMemory is the default memory budget of waiting tasks.
+	DefaultMemory = 64 << 20
+	// DefaultBlobSize is the default size of payloads stored in files.
+	DefaultBlobSize = 1 << 20
+	// taskOverhead is the memory of a task besides its payload counted
+	// against the budget.
+	taskOverhead = 256
+)
+
+// blobMagic marks payloads in memory stored in a blob file.
+var blobMagic = []byte("\x00stq-blob\x00")
+
+func init() {
+	backends.Register("tiered", func(config *backends.Config) (backends.Backend, error) {
+		options := Options{Dir: config.Params.Get("dir")}
+		var err error
+		if options.Memory, err = intParam(config, "memory"); err != nil {
+			return nil, err
+		}
+		if options.BlobSize, err = intParam(config, "blob_size"); err != nil {
+			return nil, err
+		}
+		return New(options)
+	})
+}
+
+func intParam(config *backends.Config, name string) (int64, error) {
+	value := config.Params.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return n, nil
+}
+
+// Options configures the tiered backend.
+type Options struct {
+	// directory of spill and blob files, required
+	Dir string
+	// bytes of waiting tasks kept in memory, DefaultMemory if zero
+	Memory int64
+	// payloads of this size and larger are stored in files,
+	// DefaultBlobSize if zero
+	BlobSize int64
+}
+
+type Tiered struct {
+	memory  *memory.Memory
+	options Options
+
+	// held while waiting tasks move between memory and disk
+	mutex         sync.Mutex
+	taskIDCounter uint64
+	queues        map[string]*spillQueue
+	// spilled task id => its queue
+	spilled map[string]*spillQueue
+	// ids of tasks with blob payloads
+	blobs map[string]bool
+	// bytes of waiting tasks in memory
+	memoryBytes int64
+	// number of spill files created
+	spillFiles int
+}
+
+// New creates the tiered backend. Spill and blob files left in the
+// directory by a previous run are removed.
+func New(options Options) (*Tiered, error) {
+	if options.Dir == "" {
+		return nil, errors.New("tiered backend directory is not set")
+	}
+	if options.Memory == 0 {
+		options.Memory = DefaultMemory
+	}
+	if options.BlobSize == 0 {
+		options.BlobSize = DefaultBlobSize
+	}
+	if err := os.MkdirAll(options.Dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := removeFiles(options.Dir); err != nil {
+		return nil, err
+	}
+	m, err := memory.New()
+	if err != nil {
+		return nil, err
+	}
+	return &Tiered{
+		memory:  m,
+		options: options,
+		queues:  make(map[string]*spillQueue),
+		spilled: make(map[string]*spillQueue),
+		blobs:   make(map[string]bool),
+	}, nil
+}
+
+func removeFiles(dir string) error {
+	for _, pattern := range []string{"*.spill", "*.blob"} {
+		paths, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes and removes spill and blob files.
+func (t *Tiered) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, q := range t.queues {
+		q.close()
+	}
+	t.queues = make(map[string]*spillQueue)
+	t.spilled = make(map[string]*spillQueue)
+	if err := t.memory.Close(); err != nil {
+		return err
+	}
+	return removeFiles(t.options.Dir)
+}
+
+func (t *Tiered) Name() string {
+	return "tiered"
+}
+
+func (t *Tiered) blobPath(taskID string) string {
+	return filepath.Join(t.options.Dir, taskID+".blob")
+}
+
+func taskSize(task *backends.Task) int64 {
+	return int64(len(task.Payload)) + taskOverhead
+}
+
+// queue returns the spill queue of the queue, creating it if needed.
+func (t *Tiered) queue(name string) *spillQueue {
+	q, ok := t.queues[name]
+	if !ok {
+		t.spillFiles++
+		q = &spillQueue{path: filepath.Join(t.options.Dir, fmt.Sprintf("queue-%d.spill", t.spillFiles))}
+		t.queues[name] = q
+	}
+	return q
+}
+
+// toMemory adds the waiting task to the memory tier, the payload is moved
+// to a blob file if it is large.
+func (t *Tiered) toMemory(ctx context.Context, task *backends.Task) error {
+	stored := *task
+	if int64(len(task.Payload)) >= t.options.BlobSize || bytes.HasPrefix(task.Payload, blobMagic) {
+		if err := ioutil.WriteFile(t.blobPath(task.ID), task.Payload, 0600); err != nil {
+			return err
+		}
+		stored.Payload = append(append([]byte(nil), blobMagic...), task.ID...)
+		t.blobs[task.ID] = true
+	}
+	if err := t.memory.Import(ctx, &stored); err != nil {
+		t.removeBlob(task.ID)
+		return err
+	}
+	if stored.State == backends.TaskWaiting {
+		t.memoryBytes += taskSize(&stored)
+		t.queue(task.Queue).inMemory++
+	}
+	return nil
+}
+
+// put adds the waiting task to memory or to the spill file of its queue if
+// the budget is exceeded or older tasks of the queue are spilled already.
+func (t *Tiered) put(ctx context.Context, task *backends.Task) error {
+	q := t.queue(task.Queue)
+	if q.len() == 0 && (q.inMemory == 0 || t.memoryBytes+taskSize(task) <= t.options.Memory) {
+		return t.toMemory(ctx, task)
+	}
+	if err := q.push(task); err != nil {
+		return err
+	}
+	t.spilled[task.ID] = q
+	return nil
+}
+
+// refill moves spilled tasks of the queue to memory while the budget allows,
+// the head of the queue is moved in any case.
+func (t *Tiered) refill(ctx context.Context, name string) error {
+	q, ok := t.queues[name]
+	if !ok {
+		return nil
+	}
+	for q.len() > 0 {
+		next := q.peek()
+		if q.inMemory > 0 && t.memoryBytes+int64(next.length)+taskOverhead > t.options.Memory {
+			return nil
+		}
+		task, err := q.read(next)
+		if err != nil {
+			return err
+		}
+		if err := t.toMemory(ctx, task); err != nil {
+			return err
+		}
+		q.pop()
+		delete(t.spilled, task.ID)
+	}
+	return nil
+}
+
+func (t *Tiered) removeBlob(taskID string) {
+	if t.blobs[taskID] {
+		os.Remove(t.blobPath(taskID))
+		delete(t.blobs, taskID)
+	}
+}
+
+// decode returns the payload stored in memory.
+func (t *Tiered) decode(payload []byte) ([]byte, error) {
+	if !bytes.HasPrefix(payload, blobMagic) {
+		return payload, nil
+	}
+	return ioutil.ReadFile(t.blobPath(string(payload[len(blobMagic):])))
+}
+
+func (t *Tiered) Put(ctx context.Context, queue, group string, payload []byte, executionTimeout time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", backends.QueueError("put", queue, err)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.taskIDCounter++
+	task := &backends.Task{
+		Queue:   queue,
+		ID:      strconv.FormatUint(t.taskIDCounter, 10),
+		Payload: payload,
+		Timeout: executionTimeout,
+		Group:   group,
+		State:   backends.TaskWaiting,
+	}
+	if err := t.put(ctx, task); err != nil {
+		return "", backends.QueueError("put", queue, err)
+	}
+	return task.ID, nil
+}
+
+func (t *Tiered) GetNotReady(ctx context.Context, queue string) (string, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, backends.QueueError("get", queue, err)
+	}
+	t.mutex.Lock()
+	if err := t.refill(ctx, queue); err != nil {
+		t.mutex.Unlock()
+		return "", nil, backends.QueueError("get", queue, err)
+	}
+	taskID, payload, err := t.memory.GetNotReady(ctx, queue)
+	if err == nil {
+		t.memoryBytes -= int64(len(payload)) + taskOverhead
+		t.queues[queue].inMemory--
+	}
+	t.mutex.Unlock()
+	if err != nil {
+		return "", nil, err
+	}
+	payload, err = t.decode(payload)
+	if err != nil {
+		return "", nil, backends.TaskError("get", taskID, err)
+	}
+	return taskID, payload, nil
+}
+
+func (t *Tiered) GetReady(ctx context.Context, taskID string) ([]byte, error) {
+	result, err := t.memory.GetReady(ctx, taskID)
+	if err == nil || errors.Is(err, backends.ErrTaskExecutionTimeout) {
+		// the task is gone
+		t.mutex.Lock()
+		t.removeBlob(taskID)
+		t.mutex.Unlock()
+	}
+	return result, err
+}
+
+func (t *Tiered) TaskReady(ctx context.Context, taskID string, result []byte) error {
+	return t.memory.TaskReady(ctx, taskID, result)
+}
+
+// SetPaused pauses or resumes dispatch of the queue by the memory tier.
+func (t *Tiered) SetPaused(ctx context.Context, queue string, paused bool) error {
+	return t.memory.SetPaused(ctx, queue, paused)
+}
+
+// Stats returns stats of the memory tier with spilled tasks counted as
+// waiting.
+func (t *Tiered) Stats(ctx context.Context) (*backends.Stats, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	stats, err := t.memory.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for name, q := range t.queues {
+		if q.len() == 0 {
+			continue
+		}
+		queueStats := stats.Queues[name]
+		queueStats.WaitLength += uint64(q.len())
+		stats.Queues[name] = queueStats
+	}
+	return backends.NewStats(stats.Queues), nil
+}
+
+// QueueStats returns stats of the queue of the memory tier with spilled
+// tasks counted as waiting.
+func (t *Tiered) QueueStats(ctx context.Context, queue string) (backends.QueueStats, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	stats, err := t.memory.QueueStats(ctx, queue)
+	if err != nil {
+		return backends.QueueStats{}, err
+	}
+	if q, ok := t.queues[queue]; ok {
+		stats.WaitLength += uint64(q.len())
+	}
+	return stats, nil
+}
+
+// TierStats is the memory usage of the tiered backend.
+type TierStats struct {
+	// bytes of waiting tasks in memory
+	MemoryBytes int64
+	// waiting tasks on disk
+	Spilled int
+	// payloads in blob files
+	Blobs int
+}
+
+// TierStats returns the memory usage of the backend.
+func (t *Tiered) TierStats() TierStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return TierStats{MemoryBytes: t.memoryBytes, Spilled: len(t.spilled), Blobs: len(t.blobs)}
+}
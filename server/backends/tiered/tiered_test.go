@@ -0,0 +1,146 @@
+package tiered
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/backendtest"
+)
+
+func Test_Conformance(t *testing.T) {
+	backendtest.Run(t, func() (backends.Backend, error) {
+		// a tiny budget spills the tail of every queue
+		return New(Options{Dir: t.TempDir(), Memory: 600, BlobSize: 100})
+	})
+}
+
+func Test_Spill(t *testing.T) {
+	ctx := context.TODO()
+	tiered, err := New(Options{Dir: t.TempDir(), Memory: 3 * (taskOverhead + 11), BlobSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiered.Close()
+	var taskIDs []string
+	for i := 0; i < 10; i++ {
+		group := ""
+		if i == 9 {
+			group = "tenant"
+		}
+		taskID, err := tiered.Put(ctx, "queue", group, []byte(fmt.Sprintf("payload-%03d", i)), time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		taskIDs = append(taskIDs, taskID)
+	}
+	tierStats := tiered.TierStats()
+	if tierStats.Spilled != 7 || tierStats.MemoryBytes != 3*(taskOverhead+11) {
+		t.Fatalf("tasks are not spilled: %+v", tierStats)
+	}
+	stats, err := tiered.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Queues["queue"].WaitLength != 10 {
+		t.Fatalf("spilled tasks are not counted: %+v", stats.Queues)
+	}
+	task, err := tiered.Task(ctx, taskIDs[9])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.State != backends.TaskWaiting || string(task.Payload) != "payload-009" || task.Group != "tenant" {
+		t.Fatalf("unexpected spilled task: %+v", task)
+	}
+	if err := tiered.Delete(ctx, taskIDs[5]); err != nil {
+		t.Fatal(err)
+	}
+	// workers drain the queue in FIFO order
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			continue
+		}
+		taskID, payload, err := tiered.GetNotReady(ctx, "queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if taskID != taskIDs[i] || string(payload) != fmt.Sprintf("payload-%03d", i) {
+			t.Fatalf("task is not equal: %s %s != %s payload-%03d", taskID, payload, taskIDs[i], i)
+		}
+	}
+	if tierStats := tiered.TierStats(); tierStats.Spilled != 0 || tierStats.MemoryBytes != 0 {
+		t.Fatalf("queue is not drained: %+v", tierStats)
+	}
+	tiered.Close()
+	if files, err := filepath.Glob(filepath.Join(tiered.options.Dir, "*")); err != nil || len(files) != 0 {
+		t.Fatalf("files are not removed: %v %v", files, err)
+	}
+}
+
+func Test_Blob(t *testing.T) {
+	ctx := context.TODO()
+	tiered, err := New(Options{Dir: t.TempDir(), BlobSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiered.Close()
+	large := bytes.Repeat([]byte("x"), 1000)
+	taskID, err := tiered.Put(ctx, "queue", "", large, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// payloads looking like blob references are stored as blobs too
+	fake, err := tiered.Put(ctx, "queue", "", append(append([]byte(nil), blobMagic...), taskID...), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tierStats := tiered.TierStats(); tierStats.Blobs != 2 || tierStats.MemoryBytes >= int64(len(large)) {
+		t.Fatalf("payload is not stored in a blob: %+v", tierStats)
+	}
+	workerTaskID, payload, err := tiered.GetNotReady(ctx, "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workerTaskID != taskID || !bytes.Equal(payload, large) {
+		t.Fatalf("task is not equal: %s %d bytes", workerTaskID, len(payload))
+	}
+	if _, payload, err = tiered.GetNotReady(ctx, "queue"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(payload, blobMagic) {
+		t.Fatalf("payload is not equal: %q", payload)
+	}
+	if err := tiered.TaskReady(ctx, taskID, []byte("result")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tiered.GetReady(ctx, taskID); err != nil {
+		t.Fatal(err)
+	}
+	if err := tiered.Delete(ctx, fake); err != nil {
+		t.Fatal(err)
+	}
+	if tierStats := tiered.TierStats(); tierStats.Blobs != 0 {
+		t.Fatalf("blobs are not removed: %+v", tierStats)
+	}
+}
+
+func Test_Open(t *testing.T) {
+	if _, err := backends.Open("tiered"); err == nil {
+		t.Fatal("missing directory is not detected")
+	}
+	if _, err := backends.Open("tiered://?dir=" + t.TempDir() + "&memory=-1"); err == nil {
+		t.Fatal("invalid memory is not detected")
+	}
+	backend, err := backends.Open("tiered://?dir=" + t.TempDir() + "&memory=1024&blob_size=512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	if options := backend.(*Tiered).options; options.Memory != 1024 || options.BlobSize != 512 {
+		t.Fatalf("unexpected options: %+v", options)
+	}
+}
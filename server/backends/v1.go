@@ -0,0 +1,102 @@
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// BackendV1 is the first version of the backend interface without contexts
+// and with stats marshalled to json by the backend.
+type BackendV1 interface {
+	// Close the backend.
+	Close() error
+	// Get the backend name.
+	Name() string
+	// Put task to queue and return task id.
+	Put(queue string, payload []byte, executionTimeout time.Duration) (taskID string, err error)
+	// Get not ready task from queue and start processing timeout.
+	GetNotReady(queue string) (taskID string, payload []byte, err error)
+	// Get ready task by task id or task error.
+	GetReady(taskid string) (result []byte, err error)
+	// Task is ready.
+	TaskReady(taskid string, result []byte) error
+	// Queues stats, json object of QueueStats by queue name.
+	Stats() ([]byte, error)
+}
+
+// FromV1 adapts a BackendV1 to the Backend interface. The context is checked
+// before every call only, a started call of the v1 backend is not canceled.
+func FromV1(backend BackendV1) Backend {
+	return &v1Adapter{backend: backend}
+}
+
+type v1Adapter struct {
+	backend BackendV1
+}
+
+func (a *v1Adapter) Close() error {
+	return a.backend.Close()
+}
+
+func (a *v1Adapter) Name() string {
+	return a.backend.Name()
+}
+
+func (a *v1Adapter) Put(ctx context.Context, queue, group string, payload []byte, executionTimeout time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", QueueError("put", queue, err)
+	}
+	taskID, err := a.backend.Put(queue, payload, executionTimeout)
+	if err != nil {
+		return "", QueueError("put", queue, err)
+	}
+	return taskID, nil
+}
+
+func (a *v1Adapter) GetNotReady(ctx context.Context, queue string) (string, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, QueueError("get", queue, err)
+	}
+	taskID, payload, err := a.backend.GetNotReady(queue)
+	if err != nil {
+		return "", nil, QueueError("get", queue, err)
+	}
+	return taskID, payload, nil
+}
+
+func (a *v1Adapter) GetReady(ctx context.Context, taskID string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, TaskError("result", taskID, err)
+	}
+	result, err := a.backend.GetReady(taskID)
+	if err != nil {
+		return nil, TaskError("result", taskID, err)
+	}
+	return result, nil
+}
+
+func (a *v1Adapter) TaskReady(ctx context.Context, taskID string, result []byte) error {
+	if err := ctx.Err(); err != nil {
+		return TaskError("ready", taskID, err)
+	}
+	if err := a.backend.TaskReady(taskID, result); err != nil {
+		return TaskError("ready", taskID, err)
+	}
+	return nil
+}
+
+func (a *v1Adapter) Stats(ctx context.Context) (*Stats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	data, err := a.backend.Stats()
+	if err != nil {
+		return nil, err
+	}
+	var queues map[string]QueueStats
+	if err := json.Unmarshal(data, &queues); err != nil {
+		return nil, err
+	}
+	return NewStats(queues), nil
+}
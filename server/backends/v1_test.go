@@ -0,0 +1,51 @@
+package backends_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/backendtest"
+	"github.com/alexio777/stq/server/backends/memory"
+)
+
+// v1Memory is the memory backend behind the v1 interface.
+type v1Memory struct {
+	*memory.Memory
+}
+
+func (m v1Memory) Put(queue string, payload []byte, executionTimeout time.Duration) (string, error) {
+	return m.Memory.Put(context.TODO(), queue, "", payload, executionTimeout)
+}
+
+func (m v1Memory) GetNotReady(queue string) (string, []byte, error) {
+	return m.Memory.GetNotReady(context.TODO(), queue)
+}
+
+func (m v1Memory) GetReady(taskID string) ([]byte, error) {
+	return m.Memory.GetReady(context.TODO(), taskID)
+}
+
+func (m v1Memory) TaskReady(taskID string, result []byte) error {
+	return m.Memory.TaskReady(context.TODO(), taskID, result)
+}
+
+func (m v1Memory) Stats() ([]byte, error) {
+	stats, err := m.Memory.Stats(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(stats.Queues)
+}
+
+func Test_FromV1(t *testing.T) {
+	backendtest.Run(t, func() (backends.Backend, error) {
+		backend, err := memory.New()
+		if err != nil {
+			return nil, err
+		}
+		return backends.FromV1(v1Memory{backend}), nil
+	})
+}
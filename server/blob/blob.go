@@ -0,0 +1,153 @@
+// Package blob stores large payloads and results outside of the backend
+// (the claim-check pattern). The backend keeps a short reference to the
+// blob instead of the content and the API streams the content from the
+// store.
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+var (
+	ErrNotFound     = errors.New("blob not found")
+	ErrUnknownStore = errors.New("unknown blob store")
+)
+
+// Store keeps blobs by id.
+type Store interface {
+	// Put stores the content read from r and returns the new blob id.
+	Put(ctx context.Context, r io.Reader) (id string, err error)
+	// Get opens the blob for reading and returns its size.
+	Get(ctx context.Context, id string) (io.ReadCloser, int64, error)
+	// Delete removes the blob.
+	Delete(ctx context.Context, id string) error
+}
+
+// Lister is implemented by stores able to list their blobs.
+type Lister interface {
+	// Blobs calls fn for every blob with the time it was stored.
+	Blobs(ctx context.Context, fn func(id string, stored time.Time) error) error
+}
+
+// maxIDLength is the longest blob id in a reference.
+const maxIDLength = 128
+
+// referenceMagic starts references to blobs stored in the backend.
+var referenceMagic = []byte("\x00stq-blobref\x00")
+
+// Reference returns the reference to the blob of size bytes kept in the
+// backend. The size is in the reference, so the backend counts the payload
+// bytes of the task, see PayloadSize.
+func Reference(id string, size int64) []byte {
+	reference := append(append([]byte(nil), referenceMagic...), id...)
+	return strconv.AppendInt(append(reference, 0), size, 10)
+}
+
+// ParseReference returns the blob id of the reference.
+func ParseReference(data []byte) (string, bool) {
+	if !IsReference(data) {
+		return "", false
+	}
+	id := data[len(referenceMagic):]
+	if i := bytes.IndexByte(id, 0); i >= 0 {
+		id = id[:i]
+	}
+	return string(id), true
+}
+
+// ReferenceSize returns the blob size of the reference, false if the data is
+// not a reference made by Reference.
+func ReferenceSize(data []byte) (int64, bool) {
+	if !IsReference(data) {
+		return 0, false
+	}
+	rest := data[len(referenceMagic):]
+	i := bytes.IndexByte(rest, 0)
+	if i <= 0 || i > maxIDLength {
+		return 0, false
+	}
+	for _, c := range rest[:i] {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '-' || c == '_') {
+			return 0, false
+		}
+	}
+	size, err := strconv.ParseInt(string(rest[i+1:]), 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// PayloadSize returns the size of the payload or result the data stands
+// for: the blob size of a reference, the data size otherwise.
+func PayloadSize(data []byte) uint64 {
+	if size, ok := ReferenceSize(data); ok && uint64(size) > uint64(len(data)) {
+		return uint64(size)
+	}
+	return uint64(len(data))
+}
+
+// IsReference reports whether the data looks like a blob reference. Data
+// looking like a reference must be stored as a blob whatever its size.
+func IsReference(data []byte) bool {
+	return bytes.HasPrefix(data, referenceMagic)
+}
+
+// Factory creates a store from the config.
+type Factory func(config *backends.Config) (Store, error)
+
+var (
+	factories      = make(map[string]Factory)
+	factoriesMutex sync.RWMutex
+)
+
+// Register makes a store factory available by the name, the same as
+// backends.Register.
+func Register(name string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	if factory == nil {
+		panic("blob: Register factory is nil")
+	}
+	if _, ok := factories[name]; ok {
+		panic("blob: Register called twice for store " + name)
+	}
+	factories[name] = factory
+}
+
+// Names returns a sorted list of the registered stores.
+func Names() []string {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open creates a store by the DSN with the registered factory, for example
+// "dir:///var/lib/stq/blobs".
+func Open(dsn string) (Store, error) {
+	config, err := backends.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	factoriesMutex.RLock()
+	factory, ok := factories[config.Name]
+	factoriesMutex.RUnlock()
+	if !ok {
+		return nil, ErrUnknownStore
+	}
+	return factory(config)
+}
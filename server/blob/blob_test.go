@@ -0,0 +1,69 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func Test_Dir(t *testing.T) {
+	ctx := context.TODO()
+	store, err := Open("dir://" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := store.Put(ctx, strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, size, err := store.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "content" || size != 7 {
+		t.Fatalf("blob is not equal: %s %d != %s %d", data, size, "content", 7)
+	}
+	if err := store.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Get(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleted blob is found: %v", err)
+	}
+	if _, _, err := store.Get(ctx, "../../etc/passwd"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("invalid id is not detected: %v", err)
+	}
+}
+
+func Test_Reference(t *testing.T) {
+	reference := Reference("id", 1<<20)
+	if !IsReference(reference) {
+		t.Fatal("reference is not detected")
+	}
+	if id, ok := ParseReference(reference); !ok || id != "id" {
+		t.Fatalf("id is not equal: %s != %s", id, "id")
+	}
+	if size := PayloadSize(reference); size != 1<<20 {
+		t.Fatalf("size is not equal: %d != %d", size, 1<<20)
+	}
+	// references without size are counted by their own size
+	old := append(append([]byte(nil), referenceMagic...), "id"...)
+	if id, ok := ParseReference(old); !ok || id != "id" {
+		t.Fatalf("id is not equal: %s != %s", id, "id")
+	}
+	if size := PayloadSize(old); size != uint64(len(old)) {
+		t.Fatalf("size is not equal: %d != %d", size, len(old))
+	}
+	if _, ok := ParseReference([]byte("payload")); ok {
+		t.Fatal("payload is a reference")
+	}
+	if _, err := Open("s3://bucket"); !errors.Is(err, ErrUnknownStore) {
+		t.Fatalf("unknown store is not detected: %v", err)
+	}
+}
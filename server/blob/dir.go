@@ -0,0 +1,150 @@
+package blob
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+func init() {
+	Register("dir", func(config *backends.Config) (Store, error) {
+		path := config.Path
+		if path == "" {
+			path = config.Params.Get("path")
+		}
+		return NewDir(path)
+	})
+}
+
+// Dir is a store keeping blobs as files in a local directory.
+type Dir struct {
+	path string
+}
+
+// NewDir creates the store in the directory, the directory is created if
+// it does not exist.
+func NewDir(path string) (*Dir, error) {
+	if path == "" {
+		return nil, errors.New("blob directory is not set")
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	return &Dir{path: path}, nil
+}
+
+// Put writes the blob to a temporary file and renames it when it is
+// complete, so readers never see a partial blob.
+func (d *Dir) Put(ctx context.Context, r io.Reader) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(random[:])
+	f, err := ioutil.TempFile(d.path, id+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(f.Name(), d.file(id)); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (d *Dir) Get(ctx context.Context, id string) (io.ReadCloser, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	if !validID(id) {
+		return nil, 0, ErrNotFound
+	}
+	f, err := os.Open(d.file(id))
+	if os.IsNotExist(err) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (d *Dir) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !validID(id) {
+		return ErrNotFound
+	}
+	err := os.Remove(d.file(id))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (d *Dir) Blobs(ctx context.Context, fn func(id string, stored time.Time) error) error {
+	paths, err := filepath.Glob(filepath.Join(d.path, "*.blob"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			// deleted meanwhile
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		id := strings.TrimSuffix(filepath.Base(path), ".blob")
+		if !validID(id) {
+			continue
+		}
+		if err := fn(id, info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Dir) file(id string) string {
+	return filepath.Join(d.path, id+".blob")
+}
+
+// validID reports whether the id is a hex one made by Put, so ids from
+// references can not point outside of the directory.
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
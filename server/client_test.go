@@ -3,12 +3,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/alexio777/stq/server/backends/memory"
+	"github.com/alexio777/stq/server/backends/middleware"
 
 	"github.com/alexio777/stq/client"
 )
@@ -18,7 +22,8 @@ func Test_Client(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	api := createAPI("d6MrLT7MwlhtaoQu2b5lWFr", backend)
+	rated := middleware.DispatchRate(map[string]middleware.Rate{"rated": {Tasks: 2, Per: time.Second}})(backend)
+	api := createAPI("d6MrLT7MwlhtaoQu2b5lWFr", rated)
 	apiListener, err := net.Listen("tcp", "localhost:11111")
 	if err != nil {
 		t.Fatal(err)
@@ -30,6 +35,8 @@ func Test_Client(t *testing.T) {
 		if err := api.Shutdown(context.TODO()); err != nil {
 			log.Println(err)
 		}
+		// drop keep-alive connections to the closed server
+		http.DefaultClient.CloseIdleConnections()
 	}()
 	t.Run("Test client flow", func(t *testing.T) {
 		c := client.New("http://localhost:11111", "d6MrLT7MwlhtaoQu2b5lWFr")
@@ -61,4 +68,99 @@ func Test_Client(t *testing.T) {
 			t.Fatalf("result is not equal: %s != %s", string(result), "result_123")
 		}
 	})
+	t.Run("Test client compression", func(t *testing.T) {
+		c := client.New("http://localhost:11111", "d6MrLT7MwlhtaoQu2b5lWFr")
+		c.Compress = true
+		payload := bytes.Repeat([]byte("payload_789"), 1000)
+		newTaskID, err := c.AddTask("compressed", 15, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		taskID, data, err := c.WaitWorkerTask("compressed", 10, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if taskID != newTaskID || !bytes.Equal(data, payload) {
+			t.Fatalf("task is not equal: %s %d bytes != %s %d bytes", taskID, len(data), newTaskID, len(payload))
+		}
+		if err := c.SetTaskReady(taskID, payload); err != nil {
+			t.Fatal(err)
+		}
+		result, err := c.WaitTaskReady(newTaskID, 10, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, payload) {
+			t.Fatalf("result is not equal: %d != %d bytes", len(result), len(payload))
+		}
+	})
+	t.Run("Test client streams", func(t *testing.T) {
+		c := client.New("http://localhost:11111", "d6MrLT7MwlhtaoQu2b5lWFr")
+		newTaskID, err := c.AddTaskReader("stream", 15, strings.NewReader("payload_456"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		taskID, body, err := c.WaitWorkerTaskReader("stream", 10, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if taskID != newTaskID || string(payload) != "payload_456" {
+			t.Fatalf("task is not equal: %s %s != %s %s", taskID, payload, newTaskID, "payload_456")
+		}
+		if err := c.SetTaskReadyReader(taskID, strings.NewReader("result_456")); err != nil {
+			t.Fatal(err)
+		}
+		body, err = c.WaitTaskReadyReader(newTaskID, 10, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) != "result_456" {
+			t.Fatalf("result is not equal: %s != %s", result, "result_456")
+		}
+	})
+	t.Run("Test client dispatch rate", func(t *testing.T) {
+		c := client.New("http://localhost:11111", "d6MrLT7MwlhtaoQu2b5lWFr")
+		for i := 0; i < 2; i++ {
+			if _, err := c.AddTask("rated", 15, []byte("payload")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		start := time.Now()
+		for i := 0; i < 2; i++ {
+			// the server holds the poll until the rate refills
+			if _, _, err := c.WaitWorkerTask("rated", 2, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 5*time.Second {
+			t.Fatalf("tasks are not dispatched at the rate: %s", elapsed)
+		}
+	})
+	t.Run("Test client groups", func(t *testing.T) {
+		c := client.New("http://localhost:11111", "d6MrLT7MwlhtaoQu2b5lWFr")
+		for _, task := range [][2]string{{"tenant a", "a1"}, {"tenant a", "a2"}, {"tenant b", "b1"}} {
+			if _, err := c.AddGroupTask("grouped", task[0], 15, []byte(task[1])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, expected := range []string{"a1", "b1", "a2"} {
+			_, payload, err := c.WaitWorkerTask("grouped", 1, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(payload) != expected {
+				t.Fatalf("payload is not equal: %s != %s", payload, expected)
+			}
+		}
+	})
 }
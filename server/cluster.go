@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/alexio777/stq/server/cluster"
+)
+
+// proxiedHeader marks requests proxied to the leader, so a node with stale
+// leader information does not proxy them again.
+const proxiedHeader = "X-STQ-PROXIED"
+
+// parsePeers parses "id=url,id=url" cluster members.
+func parsePeers(spec string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, peer := range strings.Split(spec, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer == "" {
+			continue
+		}
+		parts := strings.SplitN(peer, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("invalid cluster peer " + peer + ", id=url expected")
+		}
+		peers[parts[0]] = parts[1]
+	}
+	return peers, nil
+}
+
+// withCluster adds cluster endpoints to the API handler. Reads are served
+// by the node, other requests are proxied to the leader.
+func withCluster(api http.Handler, apiKey string, c *cluster.Cluster) http.Handler {
+	mux := http.NewServeMux()
+	// POST /cluster/raft/...
+	// requests of other nodes
+	mux.HandleFunc(cluster.RPCPath, func(rw http.ResponseWriter, r *http.Request) {
+		if !checkAPIKey(r, apiKey) {
+			http.Error(rw, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		c.ServeHTTP(rw, r)
+	})
+	// GET /cluster/status
+	// return cluster state of the node in json
+	mux.HandleFunc("/cluster/status", func(rw http.ResponseWriter, r *http.Request) {
+		if !checkAPIKey(r, apiKey) {
+			http.Error(rw, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "GET" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := json.MarshalIndent(c.Status(), "", "  ")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Write(data)
+	})
+	// POST /cluster/join?id=nodeid&addr=url
+	// add the node to the cluster
+	mux.HandleFunc("/cluster/join", func(rw http.ResponseWriter, r *http.Request) {
+		if !checkAPIKey(r, apiKey) {
+			http.Error(rw, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id, addr := r.URL.Query().Get("id"), r.URL.Query().Get("addr")
+		if id == "" || addr == "" {
+			http.Error(rw, "id or addr is empty", http.StatusBadRequest)
+			return
+		}
+		if !c.IsLeader() {
+			proxyToLeader(rw, r, c)
+			return
+		}
+		if err := c.AddMember(r.Context(), id, addr); err != nil {
+			membershipError(rw, err)
+		}
+	})
+	// POST /cluster/leave?id=nodeid
+	// remove the node from the cluster
+	mux.HandleFunc("/cluster/leave", func(rw http.ResponseWriter, r *http.Request) {
+		if !checkAPIKey(r, apiKey) {
+			http.Error(rw, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(rw, "id is empty", http.StatusBadRequest)
+			return
+		}
+		if !c.IsLeader() {
+			proxyToLeader(rw, r, c)
+			return
+		}
+		if err := c.RemoveMember(r.Context(), id); err != nil {
+			membershipError(rw, err)
+		}
+	})
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		if (r.Method == "GET" && readOnlyPaths[r.URL.Path]) || c.IsLeader() {
+			api.ServeHTTP(rw, r)
+			return
+		}
+		proxyToLeader(rw, r, c)
+	})
+	return mux
+}
+
+func membershipError(rw http.ResponseWriter, err error) {
+	if errors.Is(err, cluster.ErrMembershipChange) {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, cluster.ErrNotLeader) || errors.Is(err, cluster.ErrLeadershipLost) {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(rw, err.Error(), http.StatusInternalServerError)
+}
+
+// proxyToLeader sends the request to the leader known to the node.
+func proxyToLeader(rw http.ResponseWriter, r *http.Request, c *cluster.Cluster) {
+	_, addr := c.Leader()
+	if addr == "" || r.Header.Get(proxiedHeader) != "" {
+		http.Error(rw, "no cluster leader", http.StatusServiceUnavailable)
+		return
+	}
+	target, err := url.Parse(addr)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.Header.Set(proxiedHeader, "1")
+	httputil.NewSingleHostReverseProxy(target).ServeHTTP(rw, r)
+}
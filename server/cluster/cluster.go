@@ -0,0 +1,418 @@
+// Package cluster runs stq on three or more servers replicating every
+// backend change through the Raft consensus algorithm. A change is
+// acknowledged when the majority of the members stored it in their logs,
+// so the cluster keeps acknowledged tasks while the majority is alive.
+//
+// Each node applies the committed changes to its own backend in the log
+// order. Changes are made by the leader only, the other nodes answer
+// reads from their backends and return ErrNotLeader for changes, the
+// server proxies such requests to the leader. Members are added and
+// removed one at a time with AddMember and RemoveMember on the leader.
+//
+// Every SnapshotEntries applied changes the log is compacted to a snapshot
+// of the backend made with export. A restarted node restores its snapshot
+// and applies the changes after it, a node behind the compacted log of the
+// leader gets the snapshot of the leader. Backends without task id
+// counters keep the whole log and apply it from the beginning, so the
+// backend of a node must start empty.
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/export"
+)
+
+var (
+	ErrNotLeader        = errors.New("not the cluster leader")
+	ErrLeadershipLost   = errors.New("cluster leadership lost before the change was committed")
+	ErrMembershipChange = errors.New("cluster membership change in progress")
+	ErrClosed           = errors.New("cluster node is closed")
+	ErrBackendNotEmpty  = errors.New("cluster backend is not empty")
+)
+
+// Config configures a cluster node.
+type Config struct {
+	// unique id of the node
+	ID string
+	// URL other nodes reach the node API at
+	Addr string
+	// initial members by id including the node itself, empty for a node
+	// joining a running cluster
+	Peers map[string]string
+	// directory for the raft state, log and snapshot, required
+	Dir string
+	// API key of the other nodes
+	APIKey string
+}
+
+// Status is the cluster state of a node.
+type Status struct {
+	ID          string
+	Role        Role
+	Term        uint64
+	Leader      string `json:",omitempty"`
+	LeaderAddr  string `json:",omitempty"`
+	Members     map[string]string
+	LastIndex   uint64
+	CommitIndex uint64
+	LastApplied uint64
+	// last entry compacted to the snapshot
+	SnapshotIndex uint64 `json:",omitempty"`
+	LastError     string `json:",omitempty"`
+}
+
+// Cluster is a backend replicating its changes to the cluster members.
+type Cluster struct {
+	backend  backends.Backend
+	exporter backends.Exporter
+	fsm      *fsm
+	raft     *raft
+	storage  *storage
+}
+
+// New starts the cluster node applying the changes to the backend. The
+// backend must support import, export, delete and task lookup and be empty,
+// New returns ErrBackendNotEmpty otherwise.
+func New(backend backends.Backend, config Config) (*Cluster, error) {
+	if config.ID == "" || config.Addr == "" {
+		return nil, errors.New("cluster node id and address are required")
+	}
+	c := &Cluster{backend: backend}
+	if !backends.As(backend, &c.exporter) {
+		return nil, backends.ErrNotSupported
+	}
+	f, err := newFSM(backend)
+	if err != nil {
+		return nil, err
+	}
+	f.onRunning = c.scheduleExpire
+	c.fsm = f
+	if err := f.checkEmpty(); err != nil {
+		return nil, err
+	}
+	c.storage, err = openStorage(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	peers := config.Peers
+	if peers == nil {
+		peers = map[string]string{}
+	}
+	t := &transport{apiKey: config.APIKey, client: &http.Client{}}
+	c.raft, err = newRaft(config.ID, config.Addr, peers, c.storage, t, f, c.expireRunning)
+	if err != nil {
+		c.storage.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close stops the node and closes its backend.
+func (c *Cluster) Close() error {
+	c.raft.close()
+	if err := c.storage.close(); err != nil {
+		c.backend.Close()
+		return err
+	}
+	return c.backend.Close()
+}
+
+func (c *Cluster) Name() string {
+	return "cluster"
+}
+
+func (c *Cluster) propose(ctx context.Context, command *Command) applyResult {
+	return c.raft.propose(ctx, Entry{Type: EntryCommand, Command: command})
+}
+
+func (c *Cluster) Put(ctx context.Context, queue, group string, payload []byte, executionTimeout time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", backends.QueueError("put", queue, err)
+	}
+	result := c.propose(ctx, &Command{Op: "put", Queue: queue, Group: group, Payload: payload, Timeout: executionTimeout})
+	if result.err != nil {
+		return "", backends.QueueError("put", queue, result.err)
+	}
+	return result.taskID, nil
+}
+
+func (c *Cluster) GetNotReady(ctx context.Context, queue string) (string, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, backends.QueueError("get", queue, err)
+	}
+	// workers poll empty queues, the polls are not written to the log
+	if c.IsLeader() {
+		stats, err := backends.QueueStatsOf(ctx, c.backend, queue)
+		if err == nil && (stats.WaitLength == 0 || stats.Paused) {
+			return "", nil, backends.QueueError("get", queue, backends.ErrQueueNotFound)
+		}
+	}
+	result := c.propose(ctx, &Command{Op: "get", Queue: queue})
+	if result.err != nil {
+		return "", nil, backends.QueueError("get", queue, result.err)
+	}
+	return result.taskID, result.payload, nil
+}
+
+func (c *Cluster) GetReady(ctx context.Context, taskID string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, backends.TaskError("result", taskID, err)
+	}
+	// clients poll results of running tasks, the polls are not written to
+	// the log
+	if c.IsLeader() {
+		_, err := c.inspect(ctx, taskID)
+		if errors.Is(err, backends.ErrTaskNotFound) || errors.Is(err, backends.ErrTaskNotFoundOrNotReady) {
+			return nil, backends.TaskError("result", taskID, backends.ErrTaskNotFoundOrNotReady)
+		}
+	}
+	result := c.propose(ctx, &Command{Op: "result", TaskID: taskID})
+	if result.err != nil {
+		return nil, backends.TaskError("result", taskID, result.err)
+	}
+	return result.payload, nil
+}
+
+func (c *Cluster) TaskReady(ctx context.Context, taskID string, result []byte) error {
+	if err := ctx.Err(); err != nil {
+		return backends.TaskError("ready", taskID, err)
+	}
+	if r := c.propose(ctx, &Command{Op: "ready", TaskID: taskID, Payload: result}); r.err != nil {
+		return backends.TaskError("ready", taskID, r.err)
+	}
+	return nil
+}
+
+func (c *Cluster) Stats(ctx context.Context) (*backends.Stats, error) {
+	return c.backend.Stats(ctx)
+}
+
+func (c *Cluster) QueueStats(ctx context.Context, queue string) (backends.QueueStats, error) {
+	return backends.QueueStatsOf(ctx, c.backend, queue)
+}
+
+// Task returns the task of the node backend, a task timed out by the node
+// but not by the cluster yet is running.
+func (c *Cluster) Task(ctx context.Context, taskID string) (*backends.Task, error) {
+	task, err := c.fsm.inspector.Task(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	if c.fsm.isRunning(taskID) && task.State != backends.TaskRunning {
+		task.State = backends.TaskRunning
+		task.Error = nil
+	}
+	return task, nil
+}
+
+// inspect returns the task if its result is ready for the cluster.
+func (c *Cluster) inspect(ctx context.Context, taskID string) (*backends.Task, error) {
+	task, err := c.Task(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	if task.State != backends.TaskReady && task.State != backends.TaskFailed {
+		return nil, backends.ErrTaskNotFoundOrNotReady
+	}
+	return task, nil
+}
+
+func (c *Cluster) Export(ctx context.Context, fn func(task *backends.Task) error) error {
+	return c.exporter.Export(ctx, func(task *backends.Task) error {
+		if c.fsm.isRunning(task.ID) && task.State != backends.TaskRunning {
+			task.State = backends.TaskRunning
+			task.Error = nil
+		}
+		return fn(task)
+	})
+}
+
+func (c *Cluster) Import(ctx context.Context, task *backends.Task) error {
+	if err := ctx.Err(); err != nil {
+		return backends.TaskError("import", task.ID, err)
+	}
+	record := export.NewRecord(task)
+	if r := c.propose(ctx, &Command{Op: "import", TaskID: task.ID, Task: &record}); r.err != nil {
+		return backends.TaskError("import", task.ID, r.err)
+	}
+	return nil
+}
+
+func (c *Cluster) Delete(ctx context.Context, taskID string) error {
+	if err := ctx.Err(); err != nil {
+		return backends.TaskError("delete", taskID, err)
+	}
+	if r := c.propose(ctx, &Command{Op: "delete", TaskID: taskID}); r.err != nil {
+		return backends.TaskError("delete", taskID, r.err)
+	}
+	return nil
+}
+
+// SetPaused pauses or resumes dispatch of the queue on all nodes, the
+// command is in the log, so the queue stays paused after restarts.
+func (c *Cluster) SetPaused(ctx context.Context, queue string, paused bool) error {
+	if err := ctx.Err(); err != nil {
+		return backends.QueueError("pause", queue, err)
+	}
+	op := "resume"
+	if paused {
+		op = "pause"
+	}
+	if r := c.propose(ctx, &Command{Op: op, Queue: queue}); r.err != nil {
+		return backends.QueueError("pause", queue, r.err)
+	}
+	return nil
+}
+
+// scheduleExpire times out the task on the leader after its timeout.
+func (c *Cluster) scheduleExpire(taskID string, timeout time.Duration) {
+	if !c.IsLeader() {
+		return
+	}
+	time.AfterFunc(timeout, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), RPCTimeout)
+		defer cancel()
+		// a ready task or a lost leadership is fine, the next leader
+		// times out the task again
+		c.propose(ctx, &Command{Op: "expire", TaskID: taskID})
+	})
+}
+
+// expireRunning schedules timeouts of the running tasks on a new leader.
+func (c *Cluster) expireRunning() {
+	for taskID, timeout := range c.fsm.runningTasks() {
+		c.scheduleExpire(taskID, timeout)
+	}
+}
+
+// IsLeader reports whether the node is the leader and takes changes.
+func (c *Cluster) IsLeader() bool {
+	c.raft.mutex.Lock()
+	defer c.raft.mutex.Unlock()
+	return c.raft.role == Leader
+}
+
+// Leader returns the id and the address of the leader known to the node,
+// empty while there is no leader.
+func (c *Cluster) Leader() (id string, addr string) {
+	c.raft.mutex.Lock()
+	defer c.raft.mutex.Unlock()
+	return c.raft.leaderID, c.raft.leaderAddr
+}
+
+// Status returns the cluster state of the node.
+func (c *Cluster) Status() Status {
+	r := c.raft
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := Status{
+		ID:          r.id,
+		Role:        r.role,
+		Term:        r.term,
+		Leader:      r.leaderID,
+		LeaderAddr:  r.leaderAddr,
+		Members:     make(map[string]string, len(r.members)),
+		LastIndex:   r.lastIndex(),
+		CommitIndex: r.commitIndex,
+		LastApplied: r.lastApplied,
+	}
+	if r.snapshotMembers != nil {
+		status.SnapshotIndex = r.snapshotIndex()
+	}
+	for id, addr := range r.members {
+		status.Members[id] = addr
+	}
+	if r.lastError != nil {
+		status.LastError = r.lastError.Error()
+	}
+	return status
+}
+
+// AddMember adds the node to the cluster, the node gets all changes from
+// the leader. Call it on the leader.
+func (c *Cluster) AddMember(ctx context.Context, id string, addr string) error {
+	if id == "" || addr == "" {
+		return errors.New("member id and address are required")
+	}
+	return c.changeMembers(ctx, func(members map[string]string) {
+		members[id] = addr
+	})
+}
+
+// RemoveMember removes the node from the cluster. Call it on the leader, a
+// removed leader steps down when the change is committed.
+func (c *Cluster) RemoveMember(ctx context.Context, id string) error {
+	return c.changeMembers(ctx, func(members map[string]string) {
+		delete(members, id)
+	})
+}
+
+func (c *Cluster) changeMembers(ctx context.Context, change func(members map[string]string)) error {
+	c.raft.mutex.Lock()
+	members := make(map[string]string, len(c.raft.members)+1)
+	for id, addr := range c.raft.members {
+		members[id] = addr
+	}
+	c.raft.mutex.Unlock()
+	change(members)
+	if len(members) == 0 {
+		return errors.New("cluster must have a member")
+	}
+	return c.raft.propose(ctx, Entry{Type: EntryConfig, Members: members}).err
+}
+
+// ServeHTTP serves the requests of other nodes under RPCPath.
+func (c *Cluster) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var resp interface{}
+	var err error
+	switch path.Base(r.URL.Path) {
+	case "vote":
+		var req voteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err = c.raft.handleVote(&req)
+	case "append":
+		var req appendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err = c.raft.handleAppend(&req)
+	case "snapshot":
+		query := r.URL.Query()
+		term, parseErr := strconv.ParseUint(query.Get("term"), 10, 64)
+		if parseErr != nil {
+			http.Error(rw, parseErr.Error(), http.StatusBadRequest)
+			return
+		}
+		req := snapshotRequest{Term: term, LeaderID: query.Get("leader"), LeaderAddr: query.Get("leader_addr")}
+		resp, err = c.raft.handleSnapshot(&req, r.Body)
+	default:
+		http.Error(rw, "unknown request "+strconv.Quote(r.URL.Path), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Write(data)
+}
@@ -0,0 +1,538 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/backendtest"
+	"github.com/alexio777/stq/server/backends/export"
+	"github.com/alexio777/stq/server/backends/memory"
+)
+
+func init() {
+	HeartbeatInterval = 10 * time.Millisecond
+	ElectionTimeout = 100 * time.Millisecond
+}
+
+// node is a cluster node served over loopback.
+type node struct {
+	*Cluster
+	server *httptest.Server
+}
+
+func (n *node) Close() error {
+	n.server.Close()
+	return n.Cluster.Close()
+}
+
+// listen starts a test server for a node created later.
+func listen() (*httptest.Server, *http.Handler) {
+	handler := new(http.Handler)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if *handler == nil {
+			http.Error(rw, "node is starting", http.StatusServiceUnavailable)
+			return
+		}
+		(*handler).ServeHTTP(rw, r)
+	}))
+	return server, handler
+}
+
+func startNode(server *httptest.Server, handler *http.Handler, id string, peers map[string]string, dir string) (*node, error) {
+	backend, err := memory.New()
+	if err != nil {
+		return nil, err
+	}
+	c, err := New(backend, Config{ID: id, Addr: server.URL, Peers: peers, Dir: dir})
+	if err != nil {
+		return nil, err
+	}
+	*handler = c
+	return &node{Cluster: c, server: server}, nil
+}
+
+// startCluster starts n nodes.
+func startCluster(t *testing.T, n int) ([]*node, error) {
+	servers := make([]*httptest.Server, n)
+	handlers := make([]*http.Handler, n)
+	peers := make(map[string]string)
+	for i := range servers {
+		servers[i], handlers[i] = listen()
+		peers[fmt.Sprint("node", i)] = servers[i].URL
+	}
+	nodes := make([]*node, n)
+	for i := range nodes {
+		var err error
+		nodes[i], err = startNode(servers[i], handlers[i], fmt.Sprint("node", i), peers, t.TempDir())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+func closeNodes(nodes []*node) {
+	for _, n := range nodes {
+		n.Close()
+	}
+}
+
+func waitLeader(t *testing.T, nodes []*node) *node {
+	t.Helper()
+	for i := 0; i < 300; i++ {
+		for _, n := range nodes {
+			if n.IsLeader() {
+				return n
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("cluster has no leader")
+	return nil
+}
+
+// waitApplied waits for the node to apply the changes committed by the
+// leader.
+func waitApplied(t *testing.T, n *node, leader *node) {
+	t.Helper()
+	commit := leader.Status().CommitIndex
+	for i := 0; i < 300; i++ {
+		if n.Status().LastApplied >= commit {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("node has not applied the changes: %+v, leader commit %d", n.Status(), commit)
+}
+
+// tasks returns exported tasks by id.
+func tasks(t *testing.T, exporter backends.Exporter) map[string]export.Record {
+	t.Helper()
+	records := make(map[string]export.Record)
+	err := exporter.Export(context.TODO(), func(task *backends.Task) error {
+		records[task.ID] = export.NewRecord(task)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// testCluster closes all nodes with the leader.
+type testCluster struct {
+	*node
+	nodes []*node
+}
+
+func (c *testCluster) Close() error {
+	closeNodes(c.nodes)
+	return nil
+}
+
+func Test_Conformance(t *testing.T) {
+	backendtest.Run(t, func() (backends.Backend, error) {
+		nodes, err := startCluster(t, 3)
+		if err != nil {
+			return nil, err
+		}
+		return &testCluster{node: waitLeader(t, nodes), nodes: nodes}, nil
+	})
+}
+
+func Test_Cluster(t *testing.T) {
+	ctx := context.TODO()
+	nodes, err := startCluster(t, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeNodes(nodes)
+	leader := waitLeader(t, nodes)
+	taskID, err := leader.Put(ctx, "queue", "", []byte("payload"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := leader.Put(ctx, "queue", "tenant", []byte("other"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group := tasks(t, leader)[other].Group; group != "tenant" {
+		t.Fatalf("group is not equal: %s != %s", group, "tenant")
+	}
+	var followers []*node
+	for _, n := range nodes {
+		if n == leader {
+			continue
+		}
+		followers = append(followers, n)
+		if _, err := n.Put(ctx, "queue", "", []byte("payload"), time.Minute); !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("follower takes changes: %v", err)
+		}
+		if id, addr := n.Leader(); id != leader.Status().ID || addr != leader.server.URL {
+			t.Fatalf("leader is not equal: %s %s != %s %s", id, addr, leader.Status().ID, leader.server.URL)
+		}
+		waitApplied(t, n, leader)
+		if !reflect.DeepEqual(tasks(t, n), tasks(t, leader)) {
+			t.Fatalf("follower tasks are not equal to leader: %+v != %+v", tasks(t, n), tasks(t, leader))
+		}
+	}
+
+	// the acknowledged tasks survive the leader loss
+	leader.Close()
+	newLeader := waitLeader(t, followers)
+	workerTaskID, payload, err := newLeader.GetNotReady(ctx, "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workerTaskID != taskID || string(payload) != "payload" {
+		t.Fatalf("task is not equal: %s %s != %s %s", workerTaskID, payload, taskID, "payload")
+	}
+	if err := newLeader.TaskReady(ctx, taskID, []byte("result")); err != nil {
+		t.Fatal(err)
+	}
+	result, err := newLeader.GetReady(ctx, taskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "result" {
+		t.Fatalf("result is not equal: %s != %s", result, "result")
+	}
+	// new task ids are not taken
+	taskID, err = newLeader.Put(ctx, "queue", "", []byte("payload"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taskID == other {
+		t.Fatalf("task id is taken: %s", taskID)
+	}
+}
+
+func Test_ClusterTimeout(t *testing.T) {
+	ctx := context.TODO()
+	nodes, err := startCluster(t, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeNodes(nodes)
+	leader := waitLeader(t, nodes)
+	taskID, err := leader.Put(ctx, "queue", "", []byte("payload"), 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := leader.GetNotReady(ctx, "queue"); err != nil {
+		t.Fatal(err)
+	}
+	// the new leader times out the running task of the lost one
+	leader.Close()
+	var followers []*node
+	for _, n := range nodes {
+		if n != leader {
+			followers = append(followers, n)
+		}
+	}
+	newLeader := waitLeader(t, followers)
+	time.Sleep(400 * time.Millisecond)
+	if _, err := newLeader.GetReady(ctx, taskID); !errors.Is(err, backends.ErrTaskExecutionTimeout) {
+		t.Fatalf("task is not timed out: %v", err)
+	}
+}
+
+func Test_Membership(t *testing.T) {
+	ctx := context.TODO()
+	nodes, err := startCluster(t, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeNodes(nodes)
+	leader := waitLeader(t, nodes)
+	taskID, err := leader.Put(ctx, "queue", "", []byte("payload"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new node gets the whole log
+	server, handler := listen()
+	joined, err := startNode(server, handler, "node3", nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer joined.Close()
+	if err := joined.AddMember(ctx, "node3", server.URL); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("new node takes changes: %v", err)
+	}
+	if err := leader.AddMember(ctx, "node3", server.URL); err != nil {
+		t.Fatal(err)
+	}
+	waitApplied(t, joined, leader)
+	task, err := joined.Task(ctx, taskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(task.Payload) != "payload" {
+		t.Fatalf("payload is not equal: %s != %s", task.Payload, "payload")
+	}
+	if len(joined.Status().Members) != 4 {
+		t.Fatalf("members are not equal: %v", joined.Status().Members)
+	}
+
+	// the removed leader steps down
+	if err := leader.RemoveMember(ctx, leader.Status().ID); err != nil {
+		t.Fatal(err)
+	}
+	var members []*node
+	for _, n := range append(nodes, joined) {
+		if n != leader {
+			members = append(members, n)
+		}
+	}
+	newLeader := waitLeader(t, members)
+	if leader.IsLeader() {
+		t.Fatal("removed leader is the leader")
+	}
+	status := newLeader.Status()
+	if _, ok := status.Members[leader.Status().ID]; ok || len(status.Members) != 3 {
+		t.Fatalf("members are not equal: %v", status.Members)
+	}
+	if _, err := newLeader.Put(ctx, "queue", "", []byte("payload"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Restart(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	server, handler := listen()
+	peers := map[string]string{"node0": server.URL}
+	n, err := startNode(server, handler, "node0", peers, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitLeader(t, []*node{n})
+	taskID, err := n.Put(ctx, "queue", "", []byte("payload"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Put(ctx, "paused", "", []byte("payload"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.SetPaused(ctx, "paused", true); err != nil {
+		t.Fatal(err)
+	}
+	n.Close()
+
+	server, handler = listen()
+	n, err = startNode(server, handler, "node0", map[string]string{"node0": server.URL}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	waitLeader(t, []*node{n})
+	waitApplied(t, n, n)
+	workerTaskID, payload, err := n.GetNotReady(ctx, "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workerTaskID != taskID || string(payload) != "payload" {
+		t.Fatalf("task is not equal: %s %s != %s %s", workerTaskID, payload, taskID, "payload")
+	}
+	if _, _, err := n.GetNotReady(ctx, "paused"); !errors.Is(err, backends.ErrQueueNotFound) {
+		t.Fatalf("pause is not restored: %v", err)
+	}
+	stats, err := n.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.Queues["paused"].Paused || stats.Queues["paused"].WaitLength != 1 {
+		t.Fatalf("pause is not in stats: %+v", stats.Queues["paused"])
+	}
+}
+
+// restart closes the single node and starts it again on its directory.
+func restart(t *testing.T, n *node, dir string) *node {
+	t.Helper()
+	n.Close()
+	server, handler := listen()
+	n, err := startNode(server, handler, "node0", map[string]string{"node0": server.URL}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitLeader(t, []*node{n})
+	waitApplied(t, n, n)
+	return n
+}
+
+func Test_TornLog(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	server, handler := listen()
+	n, err := startNode(server, handler, "node0", map[string]string{"node0": server.URL}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitLeader(t, []*node{n})
+	if _, err := n.Put(ctx, "queue", "", []byte("before"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	n.Close()
+	// a crash cuts the last entry
+	f, err := os.OpenFile(filepath.Join(dir, "log.jsonl"), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"Index":`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	server, handler = listen()
+	n, err = startNode(server, handler, "node0", map[string]string{"node0": server.URL}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitLeader(t, []*node{n})
+	if _, err := n.Put(ctx, "queue", "", []byte("after"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// the entries after the torn one survive the next restart
+	n = restart(t, n, dir)
+	defer n.Close()
+	for _, expected := range []string{"before", "after"} {
+		_, payload, err := n.GetNotReady(ctx, "queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(payload) != expected {
+			t.Fatalf("payload is not equal: %s != %s", payload, expected)
+		}
+	}
+}
+
+func Test_NotSupported(t *testing.T) {
+	if _, err := New(backends.FromV1(nil), Config{ID: "node0", Addr: "http://localhost"}); !errors.Is(err, backends.ErrNotSupported) {
+		t.Fatalf("backend without import is not detected: %v", err)
+	}
+}
+
+func Test_NotEmpty(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	if _, err := backend.Put(context.TODO(), "queue", "", []byte("payload"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	_, err = New(backend, Config{ID: "node0", Addr: "http://localhost", Dir: t.TempDir()})
+	if !errors.Is(err, ErrBackendNotEmpty) {
+		t.Fatalf("backend with tasks is not detected: %v", err)
+	}
+}
+
+func Test_NoDir(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(backend, Config{ID: "node0", Addr: "http://localhost"}); err == nil {
+		t.Fatal("node without directory is started")
+	}
+}
+
+func Test_Compaction(t *testing.T) {
+	ctx := context.TODO()
+	defer func(entries uint64) { SnapshotEntries = entries }(SnapshotEntries)
+	SnapshotEntries = 10
+
+	t.Run("Restart", func(t *testing.T) {
+		dir := t.TempDir()
+		server, handler := listen()
+		n, err := startNode(server, handler, "node0", map[string]string{"node0": server.URL}, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitLeader(t, []*node{n})
+		for i := 0; i < 25; i++ {
+			if _, err := n.Put(ctx, "queue", "", []byte(fmt.Sprint(i)), time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}
+		runningID, _, err := n.GetNotReady(ctx, "queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.SetPaused(ctx, "queue", true); err != nil {
+			t.Fatal(err)
+		}
+		if n.Status().SnapshotIndex == 0 {
+			t.Fatalf("log is not compacted: %+v", n.Status())
+		}
+		expected := tasks(t, n)
+
+		n = restart(t, n, dir)
+		defer n.Close()
+		if restored := tasks(t, n); !reflect.DeepEqual(restored, expected) {
+			t.Fatalf("tasks are not equal: %v != %v", restored, expected)
+		}
+		if !n.fsm.isRunning(runningID) {
+			t.Fatalf("task %s is not running", runningID)
+		}
+		stats, err := n.Stats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !stats.Queues["queue"].Paused {
+			t.Fatalf("pause is not restored: %+v", stats.Queues["queue"])
+		}
+		taskID, err := n.Put(ctx, "queue", "", []byte("new"), time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := expected[taskID]; ok {
+			t.Fatalf("task id %s is made twice", taskID)
+		}
+	})
+
+	t.Run("Install", func(t *testing.T) {
+		nodes, err := startCluster(t, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeNodes(nodes)
+		leader := waitLeader(t, nodes)
+		for i := 0; i < 25; i++ {
+			if _, err := leader.Put(ctx, "queue", "", []byte(fmt.Sprint(i)), time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if leader.Status().SnapshotIndex == 0 {
+			t.Fatalf("log is not compacted: %+v", leader.Status())
+		}
+
+		// a new node gets the snapshot and the entries after it
+		server, handler := listen()
+		joined, err := startNode(server, handler, "node3", nil, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer joined.Close()
+		if err := leader.AddMember(ctx, "node3", server.URL); err != nil {
+			t.Fatal(err)
+		}
+		waitApplied(t, joined, leader)
+		if joined.Status().SnapshotIndex == 0 {
+			t.Fatalf("snapshot is not installed: %+v", joined.Status())
+		}
+		if installed, expected := tasks(t, joined), tasks(t, leader); !reflect.DeepEqual(installed, expected) {
+			t.Fatalf("tasks are not equal: %v != %v", installed, expected)
+		}
+	})
+}
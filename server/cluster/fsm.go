@@ -0,0 +1,219 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/export"
+)
+
+// Command is a backend change in the log.
+type Command struct {
+	// put, get, ready, result, delete, import, expire, pause or resume
+	Op      string
+	Queue   string         `json:",omitempty"`
+	Group   string         `json:",omitempty"`
+	TaskID  string         `json:",omitempty"`
+	Payload []byte         `json:",omitempty"`
+	Timeout time.Duration  `json:",omitempty"`
+	Task    *export.Record `json:",omitempty"`
+}
+
+// applyResult is the result of the command for the node that proposed it.
+type applyResult struct {
+	taskID  string
+	payload []byte
+	err     error
+}
+
+// fsm applies the commands to the backend of the node. Every node starts
+// with an empty backend and applies the same commands in the same order,
+// so all backends have the same tasks and task ids.
+//
+// Execution timeouts are the only changes a backend makes on its own and
+// their timers fire on every node at a different time. The fsm keeps the
+// running tasks itself and a task is timed out for the cluster when the
+// leader commits the expire command: a task timed out by the backend of
+// the node but not by the cluster is still running for ready and result
+// commands.
+type fsm struct {
+	backend   backends.Backend
+	importer  backends.Importer
+	deleter   backends.Deleter
+	inspector backends.Inspector
+	exporter  backends.Exporter
+	// nil if the backend has no pause
+	pauser backends.Pauser
+	// nil if the backend has no task id counter, see canSnapshot
+	counter backends.TaskIDCounter
+	// called with the task a worker took
+	onRunning func(taskID string, timeout time.Duration)
+
+	mutex sync.Mutex
+	// running task id => execution timeout
+	running map[string]time.Duration
+}
+
+func newFSM(backend backends.Backend) (*fsm, error) {
+	f := &fsm{
+		backend: backend,
+		running: make(map[string]time.Duration),
+	}
+	if !backends.As(backend, &f.importer) || !backends.As(backend, &f.deleter) || !backends.As(backend, &f.inspector) || !backends.As(backend, &f.exporter) {
+		return nil, backends.ErrNotSupported
+	}
+	backends.As(backend, &f.pauser)
+	backends.As(backend, &f.counter)
+	return f, nil
+}
+
+// checkEmpty returns ErrBackendNotEmpty if the backend has tasks, paused
+// queues or made task ids, the log replayed on it would make other ones.
+func (f *fsm) checkEmpty() error {
+	ctx := context.Background()
+	stats, err := f.backend.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	for _, queueStats := range stats.Queues {
+		if queueStats.WaitLength != 0 || queueStats.WorkLength != 0 || queueStats.ReadyLength != 0 || queueStats.Paused {
+			return ErrBackendNotEmpty
+		}
+	}
+	if f.counter != nil {
+		last, err := f.counter.LastTaskID(ctx)
+		if err != nil {
+			return err
+		}
+		if last != 0 {
+			return ErrBackendNotEmpty
+		}
+	}
+	return nil
+}
+
+// runningTasks returns the running tasks with their timeouts.
+func (f *fsm) runningTasks() map[string]time.Duration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	running := make(map[string]time.Duration, len(f.running))
+	for id, timeout := range f.running {
+		running[id] = timeout
+	}
+	return running
+}
+
+func (f *fsm) setRunning(taskID string, timeout time.Duration) {
+	f.mutex.Lock()
+	f.running[taskID] = timeout
+	f.mutex.Unlock()
+	f.onRunning(taskID, timeout)
+}
+
+// stopRunning removes the task from the running ones and reports whether it
+// was running.
+func (f *fsm) stopRunning(taskID string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, ok := f.running[taskID]
+	delete(f.running, taskID)
+	return ok
+}
+
+func (f *fsm) isRunning(taskID string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, ok := f.running[taskID]
+	return ok
+}
+
+func (f *fsm) apply(e Entry) applyResult {
+	// the command is in the log already, the caller context does not matter
+	ctx := context.Background()
+	c := e.Command
+	switch c.Op {
+	case "put":
+		taskID, err := f.backend.Put(ctx, c.Queue, c.Group, c.Payload, c.Timeout)
+		return applyResult{taskID: taskID, err: err}
+	case "get":
+		taskID, payload, err := f.backend.GetNotReady(ctx, c.Queue)
+		if err != nil {
+			return applyResult{err: err}
+		}
+		task, err := f.inspector.Task(ctx, taskID)
+		if err != nil {
+			return applyResult{err: err}
+		}
+		f.setRunning(taskID, task.Timeout)
+		return applyResult{taskID: taskID, payload: payload}
+	case "ready":
+		if !f.stopRunning(c.TaskID) {
+			return applyResult{err: backends.TaskError("ready", c.TaskID, backends.ErrTaskNotFoundOrNotReady)}
+		}
+		if err := f.backend.TaskReady(ctx, c.TaskID, c.Payload); err == nil {
+			return applyResult{}
+		}
+		// timed out by the backend of the node only
+		return applyResult{err: f.replace(ctx, c.TaskID, func(task *backends.Task) bool {
+			task.State = backends.TaskReady
+			task.Result = c.Payload
+			task.Error = nil
+			return true
+		})}
+	case "result":
+		if f.isRunning(c.TaskID) {
+			return applyResult{err: backends.TaskError("result", c.TaskID, backends.ErrTaskNotFoundOrNotReady)}
+		}
+		result, err := f.backend.GetReady(ctx, c.TaskID)
+		return applyResult{payload: result, err: err}
+	case "delete":
+		f.stopRunning(c.TaskID)
+		return applyResult{err: f.deleter.Delete(ctx, c.TaskID)}
+	case "import":
+		task := c.Task.Task()
+		if err := f.importer.Import(ctx, task); err != nil {
+			return applyResult{err: err}
+		}
+		if task.State == backends.TaskRunning {
+			f.setRunning(task.ID, task.Timeout)
+		}
+		return applyResult{}
+	case "expire":
+		if !f.stopRunning(c.TaskID) {
+			return applyResult{}
+		}
+		return applyResult{err: f.replace(ctx, c.TaskID, func(task *backends.Task) bool {
+			if task.State != backends.TaskRunning {
+				// timed out by the backend of the node already
+				return false
+			}
+			task.State = backends.TaskFailed
+			task.Error = backends.ErrTaskExecutionTimeout
+			return true
+		})}
+	case "pause", "resume":
+		if f.pauser == nil {
+			return applyResult{err: backends.ErrNotSupported}
+		}
+		return applyResult{err: f.pauser.SetPaused(ctx, c.Queue, c.Op == "pause")}
+	}
+	return applyResult{err: fmt.Errorf("unknown command %q", c.Op)}
+}
+
+// replace changes the task of the backend if update reports a change.
+func (f *fsm) replace(ctx context.Context, taskID string, update func(task *backends.Task) bool) error {
+	task, err := f.inspector.Task(ctx, taskID)
+	if err != nil {
+		return err
+	}
+	if !update(task) {
+		return nil
+	}
+	if err := f.deleter.Delete(ctx, taskID); err != nil {
+		return err
+	}
+	return f.importer.Import(ctx, task)
+}
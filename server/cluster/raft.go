@@ -0,0 +1,896 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// Interval of leader heartbeats.
+	HeartbeatInterval = 50 * time.Millisecond
+	// A follower starts an election when it does not hear from the leader
+	// for a random time between ElectionTimeout and twice ElectionTimeout.
+	ElectionTimeout = 500 * time.Millisecond
+	// Timeout of a request to another node.
+	RPCTimeout = time.Second
+)
+
+// maxAppendEntries is the maximum number of entries sent in one request.
+const maxAppendEntries = 256
+
+// Role is the raft role of a node.
+type Role string
+
+const (
+	Follower  Role = "follower"
+	Candidate Role = "candidate"
+	Leader    Role = "leader"
+)
+
+// EntryType is the type of a log entry.
+type EntryType string
+
+const (
+	// A backend change.
+	EntryCommand EntryType = "command"
+	// A new set of members, in effect from the moment it is in the log.
+	EntryConfig EntryType = "config"
+	// Appended by a new leader to commit the entries of previous terms.
+	EntryNoop EntryType = "noop"
+)
+
+// Entry is a raft log entry.
+type Entry struct {
+	Index   uint64
+	Term    uint64
+	Type    EntryType
+	Command *Command          `json:",omitempty"`
+	Members map[string]string `json:",omitempty"`
+}
+
+type voteRequest struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type voteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type appendRequest struct {
+	Term         uint64
+	LeaderID     string
+	LeaderAddr   string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+// snapshotRequest is sent with the snapshot in the body to a member that
+// needs entries the leader compacted.
+type snapshotRequest struct {
+	Term       uint64
+	LeaderID   string
+	LeaderAddr string
+}
+
+type appendResponse struct {
+	Term    uint64
+	Success bool
+	// last log index of the follower, the leader continues from it
+	LastIndex uint64
+}
+
+// waiter waits for the entry appended by the leader in the term to be
+// applied.
+type waiter struct {
+	term   uint64
+	result chan applyResult
+}
+
+// raft keeps the replicated log of a node and applies the committed entries
+// in the log order. The applied entries are compacted to a snapshot of the
+// backend, the first entry of the log is the last one in the snapshot.
+type raft struct {
+	id        string
+	addr      string
+	peers     map[string]string
+	storage   *storage
+	transport *transport
+	fsm       *fsm
+	// called in its own goroutine when the node becomes the leader
+	onLeader func()
+
+	// held while entries are applied or the snapshot is changed
+	applyMutex sync.Mutex
+
+	mutex       sync.Mutex
+	role        Role
+	term        uint64
+	votedFor    string
+	leaderID    string
+	leaderAddr  string
+	log         []Entry
+	commitIndex uint64
+	lastApplied uint64
+	// members of the last config entry in the log, the snapshot or peers
+	members map[string]string
+	// members at the snapshot, nil if there is no snapshot
+	snapshotMembers map[string]string
+
+	// leader state by member id
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	lastAck    map[string]time.Time
+	inflight   map[string]bool
+
+	electionDeadline time.Time
+	lastContact      time.Time
+	lastHeartbeat    time.Time
+	lastError        error
+
+	waiters map[uint64]*waiter
+	applied chan struct{}
+	done    chan struct{}
+}
+
+func newRaft(id, addr string, peers map[string]string, s *storage, t *transport, f *fsm, onLeader func()) (*raft, error) {
+	r := &raft{
+		id:        id,
+		addr:      addr,
+		peers:     peers,
+		storage:   s,
+		transport: t,
+		fsm:       f,
+		onLeader:  onLeader,
+		role:      Follower,
+		log:       []Entry{{}},
+		waiters:   make(map[uint64]*waiter),
+		applied:   make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	state, snapshot, entries, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	r.term = state.Term
+	r.votedFor = state.VotedFor
+	if snapshot != nil {
+		if err := r.restore(); err != nil {
+			return nil, err
+		}
+		r.log[0] = Entry{Index: snapshot.Index, Term: snapshot.Term}
+		r.snapshotMembers = snapshot.Members
+		r.commitIndex = snapshot.Index
+		r.lastApplied = snapshot.Index
+	}
+	r.log = append(r.log, entries...)
+	r.updateMembers()
+	r.resetElectionDeadline()
+	go r.run()
+	go r.runApply()
+	return r, nil
+}
+
+func (r *raft) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+	close(r.done)
+	r.failWaiters(0, ErrClosed)
+}
+
+func (r *raft) run() {
+	ticker := time.NewTicker(HeartbeatInterval / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.tick()
+		}
+	}
+}
+
+func (r *raft) tick() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	if r.role == Leader {
+		if !r.hasQuorum(now) {
+			// the leader is cut off from the majority, the members
+			// elect a new one
+			r.stepDown(r.term)
+			return
+		}
+		if now.Sub(r.lastHeartbeat) >= HeartbeatInterval {
+			r.lastHeartbeat = now
+			r.broadcast()
+		}
+		return
+	}
+	if now.After(r.electionDeadline) {
+		r.startElection()
+	}
+}
+
+func (r *raft) resetElectionDeadline() {
+	r.electionDeadline = time.Now().Add(ElectionTimeout + time.Duration(rand.Int63n(int64(ElectionTimeout))))
+}
+
+// snapshotIndex returns the index of the last entry in the snapshot.
+func (r *raft) snapshotIndex() uint64 {
+	return r.log[0].Index
+}
+
+func (r *raft) lastIndex() uint64 {
+	return r.snapshotIndex() + uint64(len(r.log)-1)
+}
+
+// entry returns the entry of the log by index, the index must not be before
+// the snapshot.
+func (r *raft) entry(index uint64) Entry {
+	return r.log[index-r.snapshotIndex()]
+}
+
+func (r *raft) quorum() int {
+	return len(r.members)/2 + 1
+}
+
+// updateMembers sets the members from the last config entry in the log.
+func (r *raft) updateMembers() {
+	r.members = r.membersAt(r.lastIndex())
+}
+
+// membersAt returns the members at the entry of the index.
+func (r *raft) membersAt(index uint64) map[string]string {
+	for i := index - r.snapshotIndex(); i > 0; i-- {
+		if r.log[i].Type == EntryConfig {
+			return r.log[i].Members
+		}
+	}
+	if r.snapshotMembers != nil {
+		return r.snapshotMembers
+	}
+	return r.peers
+}
+
+// configPending reports whether the last config entry is not committed yet.
+func (r *raft) configPending() bool {
+	for i := r.lastIndex(); i > r.commitIndex; i-- {
+		if r.entry(i).Type == EntryConfig {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *raft) startElection() {
+	r.resetElectionDeadline()
+	if _, ok := r.members[r.id]; !ok {
+		// a new node waits for the leader to add it
+		return
+	}
+	if err := r.storage.saveState(r.term+1, r.id); err != nil {
+		r.lastError = err
+		return
+	}
+	r.term++
+	r.votedFor = r.id
+	r.role = Candidate
+	r.leaderID = ""
+	r.leaderAddr = ""
+	term := r.term
+	votes := 1
+	if votes >= r.quorum() {
+		r.becomeLeader()
+		return
+	}
+	req := &voteRequest{
+		Term:         term,
+		CandidateID:  r.id,
+		LastLogIndex: r.lastIndex(),
+		LastLogTerm:  r.entry(r.lastIndex()).Term,
+	}
+	for id, addr := range r.members {
+		if id == r.id {
+			continue
+		}
+		go func(addr string) {
+			var resp voteResponse
+			if err := r.transport.call(addr, "vote", req, &resp); err != nil {
+				return
+			}
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			if resp.Term > r.term {
+				r.stepDown(resp.Term)
+				return
+			}
+			if r.role != Candidate || r.term != term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes == r.quorum() {
+				r.becomeLeader()
+			}
+		}(addr)
+	}
+}
+
+func (r *raft) becomeLeader() {
+	r.role = Leader
+	r.leaderID = r.id
+	r.leaderAddr = r.addr
+	r.nextIndex = make(map[string]uint64)
+	r.matchIndex = make(map[string]uint64)
+	r.lastAck = make(map[string]time.Time)
+	r.inflight = make(map[string]bool)
+	entry := Entry{Type: EntryNoop}
+	if r.members[r.id] != "" && !r.hasConfig() {
+		// the first leader writes the initial members to the log, so
+		// nodes joining later learn them
+		entry = Entry{Type: EntryConfig, Members: r.members}
+	}
+	if _, err := r.appendEntry(entry); err != nil {
+		r.lastError = err
+		r.stepDown(r.term)
+		return
+	}
+	r.lastHeartbeat = time.Now()
+	r.broadcast()
+	go r.onLeader()
+}
+
+func (r *raft) hasConfig() bool {
+	if r.snapshotMembers != nil {
+		return true
+	}
+	for i := 1; i < len(r.log); i++ {
+		if r.log[i].Type == EntryConfig {
+			return true
+		}
+	}
+	return false
+}
+
+// hasQuorum reports whether the leader heard from the majority recently.
+func (r *raft) hasQuorum(now time.Time) bool {
+	count := 0
+	for id := range r.members {
+		if id == r.id {
+			count++
+			continue
+		}
+		ack, ok := r.lastAck[id]
+		if !ok {
+			// a member added while the node is the leader
+			r.lastAck[id] = now
+			ack = now
+		}
+		if now.Sub(ack) < ElectionTimeout {
+			count++
+		}
+	}
+	return count >= r.quorum()
+}
+
+// stepDown makes the node a follower in the term.
+func (r *raft) stepDown(term uint64) {
+	if term > r.term {
+		if err := r.storage.saveState(term, ""); err != nil {
+			r.lastError = err
+		}
+		r.term = term
+		r.votedFor = ""
+	}
+	if r.role == Leader {
+		r.leaderID = ""
+		r.leaderAddr = ""
+		// the entries not committed yet may still be committed by the
+		// next leader, but there is no way to know it here
+		r.failWaiters(r.commitIndex+1, ErrLeadershipLost)
+	}
+	r.role = Follower
+	r.resetElectionDeadline()
+}
+
+// appendEntry appends the entry to the log of the leader.
+func (r *raft) appendEntry(e Entry) (uint64, error) {
+	e.Index = r.lastIndex() + 1
+	e.Term = r.term
+	if err := r.storage.append([]Entry{e}); err != nil {
+		return 0, err
+	}
+	r.log = append(r.log, e)
+	if e.Type == EntryConfig {
+		r.members = e.Members
+	}
+	r.advanceCommit()
+	return e.Index, nil
+}
+
+func (r *raft) broadcast() {
+	for id := range r.members {
+		if id != r.id {
+			r.replicate(id)
+		}
+	}
+}
+
+// replicate sends the entries the member does not have yet, one request
+// at a time.
+func (r *raft) replicate(id string) {
+	if r.inflight[id] {
+		return
+	}
+	addr := r.members[id]
+	next, ok := r.nextIndex[id]
+	if !ok {
+		next = r.lastIndex() + 1
+		r.nextIndex[id] = next
+	}
+	if next <= r.snapshotIndex() {
+		r.sendSnapshot(id)
+		return
+	}
+	end := r.lastIndex() + 1
+	if end > next+maxAppendEntries {
+		end = next + maxAppendEntries
+	}
+	req := &appendRequest{
+		Term:         r.term,
+		LeaderID:     r.id,
+		LeaderAddr:   r.addr,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  r.entry(next - 1).Term,
+		Entries:      append([]Entry(nil), r.log[next-r.snapshotIndex():end-r.snapshotIndex()]...),
+		LeaderCommit: r.commitIndex,
+	}
+	r.inflight[id] = true
+	go func() {
+		var resp appendResponse
+		err := r.transport.call(addr, "append", req, &resp)
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.role != Leader || r.term != req.Term {
+			if err == nil && resp.Term > r.term {
+				r.stepDown(resp.Term)
+			}
+			return
+		}
+		r.inflight[id] = false
+		if err != nil {
+			return
+		}
+		if resp.Term > r.term {
+			r.stepDown(resp.Term)
+			return
+		}
+		r.lastAck[id] = time.Now()
+		if _, ok := r.members[id]; !ok {
+			// removed while the request was sent
+			return
+		}
+		if !resp.Success {
+			next := resp.LastIndex + 1
+			if next > req.PrevLogIndex {
+				next = req.PrevLogIndex
+			}
+			if next < 1 {
+				next = 1
+			}
+			r.nextIndex[id] = next
+			r.replicate(id)
+			return
+		}
+		match := req.PrevLogIndex + uint64(len(req.Entries))
+		if match > r.matchIndex[id] {
+			r.matchIndex[id] = match
+		}
+		r.nextIndex[id] = match + 1
+		r.advanceCommit()
+		if r.role == Leader && r.nextIndex[id] <= r.lastIndex() {
+			r.replicate(id)
+		}
+	}()
+}
+
+// advanceCommit commits the last entry of the current term stored by the
+// majority of members.
+func (r *raft) advanceCommit() {
+	for n := r.lastIndex(); n > r.commitIndex && r.entry(n).Term == r.term; n-- {
+		count := 0
+		for id := range r.members {
+			if id == r.id || r.matchIndex[id] >= n {
+				count++
+			}
+		}
+		if count < r.quorum() {
+			continue
+		}
+		r.commitIndex = n
+		r.notifyApply()
+		if _, ok := r.members[r.id]; !ok && !r.configPending() {
+			// the leader is removed from the cluster
+			r.stepDown(r.term)
+		}
+		return
+	}
+}
+
+func (r *raft) notifyApply() {
+	select {
+	case r.applied <- struct{}{}:
+	default:
+	}
+}
+
+// truncate drops the entries from the index, they are not committed.
+func (r *raft) truncate(index uint64) error {
+	i := index - r.snapshotIndex()
+	if err := r.storage.rewrite(r.log[1:i]); err != nil {
+		return err
+	}
+	r.log = r.log[:i]
+	r.updateMembers()
+	r.failWaiters(index, ErrLeadershipLost)
+	return nil
+}
+
+// failWaiters fails the waiters of the entries from the index.
+func (r *raft) failWaiters(index uint64, err error) {
+	for i, w := range r.waiters {
+		if i >= index {
+			w.result <- applyResult{err: err}
+			delete(r.waiters, i)
+		}
+	}
+}
+
+func (r *raft) handleVote(req *voteRequest) (*voteResponse, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	resp := &voteResponse{Term: r.term}
+	if req.Term < r.term {
+		return resp, nil
+	}
+	if r.role == Leader || (r.leaderID != "" && time.Since(r.lastContact) < ElectionTimeout) {
+		// the leader is alive, a removed or partitioned node must not
+		// disturb it
+		return resp, nil
+	}
+	if req.Term > r.term {
+		r.stepDown(req.Term)
+		resp.Term = r.term
+	}
+	lastTerm := r.entry(r.lastIndex()).Term
+	upToDate := req.LastLogTerm > lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex >= r.lastIndex())
+	if !upToDate || (r.votedFor != "" && r.votedFor != req.CandidateID) {
+		return resp, nil
+	}
+	if err := r.storage.saveState(r.term, req.CandidateID); err != nil {
+		return nil, err
+	}
+	r.votedFor = req.CandidateID
+	r.resetElectionDeadline()
+	resp.Granted = true
+	return resp, nil
+}
+
+// follow makes the node a follower of the leader in the term.
+func (r *raft) follow(term uint64, leaderID, leaderAddr string) {
+	if term > r.term || r.role != Follower {
+		r.stepDown(term)
+	}
+	r.leaderID = leaderID
+	r.leaderAddr = leaderAddr
+	r.lastContact = time.Now()
+	r.resetElectionDeadline()
+}
+
+func (r *raft) handleAppend(req *appendRequest) (*appendResponse, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	resp := &appendResponse{Term: r.term, LastIndex: r.lastIndex()}
+	if req.Term < r.term {
+		return resp, nil
+	}
+	r.follow(req.Term, req.LeaderID, req.LeaderAddr)
+	resp.Term = r.term
+	if req.PrevLogIndex > r.lastIndex() {
+		return resp, nil
+	}
+	prevIndex, prevTerm, entries := req.PrevLogIndex, req.PrevLogTerm, req.Entries
+	if prevIndex < r.snapshotIndex() {
+		// the entries in the snapshot are committed and match
+		for len(entries) > 0 && entries[0].Index <= r.snapshotIndex() {
+			entries = entries[1:]
+		}
+		prevIndex, prevTerm = r.snapshotIndex(), r.log[0].Term
+	}
+	if r.entry(prevIndex).Term != prevTerm {
+		resp.LastIndex = prevIndex - 1
+		return resp, nil
+	}
+	for len(entries) > 0 && entries[0].Index <= r.lastIndex() {
+		if r.entry(entries[0].Index).Term != entries[0].Term {
+			if err := r.truncate(entries[0].Index); err != nil {
+				return nil, err
+			}
+			break
+		}
+		entries = entries[1:]
+	}
+	if len(entries) > 0 {
+		if err := r.storage.append(entries); err != nil {
+			return nil, err
+		}
+		r.log = append(r.log, entries...)
+		r.updateMembers()
+	}
+	commit := req.LeaderCommit
+	if last := req.PrevLogIndex + uint64(len(req.Entries)); commit > last {
+		commit = last
+	}
+	if commit > r.commitIndex {
+		r.commitIndex = commit
+		r.notifyApply()
+	}
+	resp.Success = true
+	resp.LastIndex = r.lastIndex()
+	return resp, nil
+}
+
+// propose appends the entry to the log of the leader and waits until it is
+// applied.
+func (r *raft) propose(ctx context.Context, e Entry) applyResult {
+	r.mutex.Lock()
+	select {
+	case <-r.done:
+		r.mutex.Unlock()
+		return applyResult{err: ErrClosed}
+	default:
+	}
+	if r.role != Leader {
+		r.mutex.Unlock()
+		return applyResult{err: ErrNotLeader}
+	}
+	if e.Type == EntryConfig && r.configPending() {
+		r.mutex.Unlock()
+		return applyResult{err: ErrMembershipChange}
+	}
+	index, err := r.appendEntry(e)
+	if err != nil {
+		r.mutex.Unlock()
+		return applyResult{err: err}
+	}
+	w := &waiter{term: r.term, result: make(chan applyResult, 1)}
+	r.waiters[index] = w
+	r.broadcast()
+	r.mutex.Unlock()
+	select {
+	case result := <-w.result:
+		return result
+	case <-ctx.Done():
+		r.mutex.Lock()
+		if r.waiters[index] == w {
+			delete(r.waiters, index)
+		}
+		r.mutex.Unlock()
+		return applyResult{err: ctx.Err()}
+	}
+}
+
+// runApply applies the committed entries in the log order.
+func (r *raft) runApply() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.applied:
+		}
+		for {
+			r.applyMutex.Lock()
+			r.mutex.Lock()
+			if r.lastApplied >= r.commitIndex {
+				r.mutex.Unlock()
+				r.applyMutex.Unlock()
+				break
+			}
+			entry := r.entry(r.lastApplied + 1)
+			r.mutex.Unlock()
+			var result applyResult
+			if entry.Type == EntryCommand {
+				result = r.fsm.apply(entry)
+			}
+			r.mutex.Lock()
+			r.lastApplied = entry.Index
+			if w, ok := r.waiters[entry.Index]; ok {
+				delete(r.waiters, entry.Index)
+				if w.term != entry.Term {
+					// the entry of the waiter is replaced
+					result = applyResult{err: ErrLeadershipLost}
+				}
+				w.result <- result
+			}
+			r.mutex.Unlock()
+			r.applyMutex.Unlock()
+		}
+		r.compact()
+	}
+}
+
+// compact saves the snapshot of the applied entries and drops them from the
+// log when there are SnapshotEntries of them.
+func (r *raft) compact() {
+	r.applyMutex.Lock()
+	defer r.applyMutex.Unlock()
+	r.mutex.Lock()
+	index := r.lastApplied
+	if !r.fsm.canSnapshot() || index-r.snapshotIndex() < SnapshotEntries {
+		r.mutex.Unlock()
+		return
+	}
+	header := snapshotHeader{Index: index, Term: r.entry(index).Term, Members: r.membersAt(index)}
+	r.mutex.Unlock()
+	err := r.storage.saveSnapshot(func(w io.Writer) error {
+		return r.fsm.snapshot(w, header)
+	})
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err != nil {
+		r.lastError = err
+		return
+	}
+	log := append([]Entry{{Index: index, Term: header.Term}}, r.log[index-r.snapshotIndex()+1:]...)
+	if err := r.storage.rewrite(log[1:]); err != nil {
+		r.lastError = err
+		return
+	}
+	r.log = log
+	r.snapshotMembers = header.Members
+}
+
+// restore replaces the backend state with the snapshot of the node.
+func (r *raft) restore() error {
+	f, err := r.storage.openSnapshot()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = r.fsm.restore(f)
+	return err
+}
+
+// sendSnapshot sends the snapshot to the member, the member continues with
+// the entries after it.
+func (r *raft) sendSnapshot(id string) {
+	f, err := r.storage.openSnapshot()
+	if err != nil {
+		r.lastError = err
+		return
+	}
+	addr := r.members[id]
+	req := &snapshotRequest{Term: r.term, LeaderID: r.id, LeaderAddr: r.addr}
+	r.inflight[id] = true
+	go func() {
+		defer f.Close()
+		var resp appendResponse
+		err := r.transport.sendSnapshot(addr, req, f, &resp)
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.role != Leader || r.term != req.Term {
+			if err == nil && resp.Term > r.term {
+				r.stepDown(resp.Term)
+			}
+			return
+		}
+		r.inflight[id] = false
+		if err != nil {
+			return
+		}
+		if resp.Term > r.term {
+			r.stepDown(resp.Term)
+			return
+		}
+		r.lastAck[id] = time.Now()
+		if _, ok := r.members[id]; !ok || !resp.Success {
+			return
+		}
+		if resp.LastIndex > r.matchIndex[id] {
+			r.matchIndex[id] = resp.LastIndex
+		}
+		r.nextIndex[id] = resp.LastIndex + 1
+		r.advanceCommit()
+		if r.role == Leader && r.nextIndex[id] <= r.lastIndex() {
+			r.replicate(id)
+		}
+	}()
+}
+
+// handleSnapshot installs the snapshot read from body, the entries after it
+// are kept if the log has the last entry of the snapshot.
+func (r *raft) handleSnapshot(req *snapshotRequest, body io.Reader) (*appendResponse, error) {
+	r.mutex.Lock()
+	resp := &appendResponse{Term: r.term, LastIndex: r.lastIndex()}
+	if req.Term < r.term {
+		r.mutex.Unlock()
+		return resp, nil
+	}
+	r.follow(req.Term, req.LeaderID, req.LeaderAddr)
+	resp.Term = r.term
+	r.mutex.Unlock()
+	// the snapshot is received without the lock, the node keeps taking
+	// heartbeats meanwhile
+	path, err := r.storage.receiveSnapshot(body)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header, err := readSnapshotHeader(bufio.NewReader(f))
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	r.applyMutex.Lock()
+	defer r.applyMutex.Unlock()
+	r.mutex.Lock()
+	if r.term != req.Term {
+		resp.Term = r.term
+		r.mutex.Unlock()
+		return resp, nil
+	}
+	resp.Success = true
+	resp.LastIndex = header.Index
+	if header.Index <= r.lastApplied {
+		r.mutex.Unlock()
+		return resp, nil
+	}
+	if err := r.storage.installSnapshot(path); err != nil {
+		r.mutex.Unlock()
+		return nil, err
+	}
+	var kept []Entry
+	if header.Index < r.lastIndex() && r.entry(header.Index).Term == header.Term {
+		kept = r.log[header.Index-r.snapshotIndex()+1:]
+	}
+	r.log = append([]Entry{{Index: header.Index, Term: header.Term}}, kept...)
+	r.snapshotMembers = header.Members
+	r.updateMembers()
+	if header.Index > r.commitIndex {
+		r.commitIndex = header.Index
+	}
+	r.lastApplied = header.Index
+	err = r.storage.rewrite(r.log[1:])
+	r.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.restore(); err != nil {
+		r.mutex.Lock()
+		r.lastError = err
+		r.mutex.Unlock()
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,170 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/export"
+)
+
+var (
+	// Applied entries kept in the log, the log is compacted to a snapshot
+	// of the backend when it has more.
+	SnapshotEntries uint64 = 10000
+	// Timeout of sending a snapshot to another node.
+	SnapshotTimeout = 10 * time.Minute
+)
+
+// snapshotHeader is the first line of a snapshot file, the tasks of the
+// backend follow as export records.
+//
+//	{"Index":10000,"Term":3,"Members":{"node1":"http://node1:11111"},"LastTaskID":42}
+//	{"State":"waiting","Queue":"queue","ID":"42","Payload":"cGF5bG9hZA==","Timeout":15000}
+type snapshotHeader struct {
+	// last entry in the snapshot
+	Index uint64
+	Term  uint64
+	// members at the entry
+	Members map[string]string
+	// last task id made by the backend
+	LastTaskID uint64
+	// running tasks of the cluster by id => execution timeout
+	Running map[string]time.Duration `json:",omitempty"`
+	Paused  []string                 `json:",omitempty"`
+}
+
+// canSnapshot reports whether the backend can be copied to a snapshot, a
+// backend without a task id counter keeps the whole log.
+func (f *fsm) canSnapshot() bool {
+	return f.counter != nil
+}
+
+// snapshot writes the header and the tasks of the backend to w. It is
+// called between the entries applied, so the backend does not change.
+func (f *fsm) snapshot(w io.Writer, header snapshotHeader) error {
+	// the entries are in the log already, the caller context does not matter
+	ctx := context.Background()
+	var err error
+	if header.LastTaskID, err = f.counter.LastTaskID(ctx); err != nil {
+		return err
+	}
+	header.Running = f.runningTasks()
+	stats, err := f.backend.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	for queue, queueStats := range stats.Queues {
+		if queueStats.Paused {
+			header.Paused = append(header.Paused, queue)
+		}
+	}
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	if err := encoder.Encode(header); err != nil {
+		return err
+	}
+	err = f.exporter.Export(ctx, func(task *backends.Task) error {
+		return encoder.Encode(export.NewRecord(task))
+	})
+	if err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// readSnapshotHeader reads the header of the snapshot.
+func readSnapshotHeader(r *bufio.Reader) (snapshotHeader, error) {
+	var header snapshotHeader
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return header, fmt.Errorf("cluster snapshot: %w", err)
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return header, fmt.Errorf("cluster snapshot: %w", err)
+	}
+	return header, nil
+}
+
+// restore replaces the tasks of the backend with the tasks of the snapshot
+// and returns its header.
+func (f *fsm) restore(r io.Reader) (snapshotHeader, error) {
+	ctx := context.Background()
+	reader := bufio.NewReader(r)
+	header, err := readSnapshotHeader(reader)
+	if err != nil {
+		return header, err
+	}
+	if err := f.clear(ctx); err != nil {
+		return header, err
+	}
+	decoder := json.NewDecoder(reader)
+	for {
+		var record export.Record
+		err := decoder.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return header, fmt.Errorf("cluster snapshot: %w", err)
+		}
+		if err := f.importer.Import(ctx, record.Task()); err != nil {
+			return header, err
+		}
+	}
+	if err := f.counter.SetLastTaskID(ctx, header.LastTaskID); err != nil {
+		return header, err
+	}
+	for _, queue := range header.Paused {
+		if f.pauser == nil {
+			return header, backends.ErrNotSupported
+		}
+		if err := f.pauser.SetPaused(ctx, queue, true); err != nil {
+			return header, err
+		}
+	}
+	f.mutex.Lock()
+	f.running = make(map[string]time.Duration, len(header.Running))
+	for taskID, timeout := range header.Running {
+		f.running[taskID] = timeout
+	}
+	f.mutex.Unlock()
+	return header, nil
+}
+
+// clear deletes all tasks of the backend and resumes its paused queues.
+func (f *fsm) clear(ctx context.Context) error {
+	var taskIDs []string
+	err := f.exporter.Export(ctx, func(task *backends.Task) error {
+		taskIDs = append(taskIDs, task.ID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, taskID := range taskIDs {
+		if err := f.deleter.Delete(ctx, taskID); err != nil && !errors.Is(err, backends.ErrTaskNotFound) {
+			return err
+		}
+	}
+	if f.pauser == nil {
+		return nil
+	}
+	stats, err := f.backend.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	for queue, queueStats := range stats.Queues {
+		if queueStats.Paused {
+			if err := f.pauser.SetPaused(ctx, queue, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
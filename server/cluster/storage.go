@@ -0,0 +1,227 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// storage keeps the raft term, vote, snapshot and log of a node in a
+// directory, so a restarted node does not vote twice in a term or lose
+// entries it acknowledged. The log has the entries after the snapshot.
+type storage struct {
+	dir string
+	log *os.File
+}
+
+type storageState struct {
+	Term     uint64
+	VotedFor string
+}
+
+func openStorage(dir string) (*storage, error) {
+	if dir == "" {
+		return nil, errors.New("cluster directory is not set")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "log.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &storage{dir: dir, log: f}, nil
+}
+
+func (s *storage) close() error {
+	return s.log.Close()
+}
+
+// load reads the saved term, vote, snapshot header and the log entries
+// after the snapshot, the snapshot is nil if there is none.
+func (s *storage) load() (state storageState, snapshot *snapshotHeader, entries []Entry, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, "state.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return state, nil, nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return state, nil, nil, fmt.Errorf("cluster state %s: %w", s.dir, err)
+		}
+	}
+	var first uint64 = 1
+	f, err := s.openSnapshot()
+	if err == nil {
+		header, err := readSnapshotHeader(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			return state, nil, nil, fmt.Errorf("%s: %w", s.dir, err)
+		}
+		snapshot = &header
+		first = header.Index + 1
+	} else if !os.IsNotExist(err) {
+		return state, nil, nil, err
+	}
+	if f, err = os.Open(filepath.Join(s.dir, "log.jsonl")); err != nil {
+		return state, nil, nil, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	// size of the complete entries
+	var size int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return state, nil, nil, err
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			break
+		}
+		size += int64(len(line))
+		if e.Index < first {
+			// in the snapshot already, the log was not rewritten
+			// after it was saved
+			continue
+		}
+		if e.Index != first+uint64(len(entries)) {
+			return state, nil, nil, fmt.Errorf("cluster log %s: entry %d out of order", s.dir, e.Index)
+		}
+		entries = append(entries, e)
+	}
+	// the tail written by a crash is not acknowledged, it is cut off so new
+	// entries follow the complete ones
+	if err := s.log.Truncate(size); err != nil {
+		return state, nil, nil, err
+	}
+	return state, snapshot, entries, nil
+}
+
+func (s *storage) saveState(term uint64, votedFor string) error {
+	data, err := json.Marshal(storageState{Term: term, VotedFor: votedFor})
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(s.dir, "state.json"), data)
+}
+
+// append adds the entries to the end of the log file.
+func (s *storage) append(entries []Entry) error {
+	var data []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if _, err := s.log.Write(data); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// rewrite replaces the log file with the entries.
+func (s *storage) rewrite(entries []Entry) error {
+	path := filepath.Join(s.dir, "log.jsonl")
+	err := writeFileWith(path, func(w io.Writer) error {
+		buffered := bufio.NewWriter(w)
+		encoder := json.NewEncoder(buffered)
+		for _, e := range entries {
+			if err := encoder.Encode(e); err != nil {
+				return err
+			}
+		}
+		return buffered.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	s.log.Close()
+	s.log = f
+	return nil
+}
+
+func (s *storage) snapshotPath() string {
+	return filepath.Join(s.dir, "snapshot.jsonl")
+}
+
+// saveSnapshot replaces the snapshot with the one written by write.
+func (s *storage) saveSnapshot(write func(w io.Writer) error) error {
+	return writeFileWith(s.snapshotPath(), write)
+}
+
+// openSnapshot opens the snapshot, an error of os.IsNotExist if there is
+// none.
+func (s *storage) openSnapshot() (*os.File, error) {
+	return os.Open(s.snapshotPath())
+}
+
+// receiveSnapshot writes the snapshot read from r to a temporary file and
+// returns its path, installSnapshot makes it the snapshot of the node.
+func (s *storage) receiveSnapshot(r io.Reader) (string, error) {
+	f, err := ioutil.TempFile(s.dir, "snapshot.jsonl.*")
+	if err != nil {
+		return "", err
+	}
+	if err := writeSynced(f, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func (s *storage) installSnapshot(path string) error {
+	return os.Rename(path, s.snapshotPath())
+}
+
+// writeFile replaces the file with the data, so a crash leaves either the
+// old or the new file.
+func writeFile(path string, data []byte) error {
+	return writeFileWith(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeFileWith replaces the file with the data written by write like
+// writeFile.
+func writeFileWith(path string, write func(w io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := writeSynced(f, write); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// writeSynced writes the file with write, syncs and closes it.
+func writeSynced(f *os.File, write func(w io.Writer) error) error {
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,65 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RPCPath is the path prefix of requests between nodes, the node API
+// serves it with Cluster.ServeHTTP.
+const RPCPath = "/cluster/raft/"
+
+// transport sends raft requests to other nodes over HTTP.
+type transport struct {
+	apiKey string
+	client *http.Client
+}
+
+func (t *transport) call(addr string, rpc string, req interface{}, resp interface{}) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return t.post(addr, rpc, bytes.NewReader(data), RPCTimeout, resp)
+}
+
+// sendSnapshot sends the snapshot read from body, the request is in the
+// query as the body is the snapshot.
+func (t *transport) sendSnapshot(addr string, req *snapshotRequest, body io.Reader, resp interface{}) error {
+	query := url.Values{}
+	query.Set("term", fmt.Sprint(req.Term))
+	query.Set("leader", req.LeaderID)
+	query.Set("leader_addr", req.LeaderAddr)
+	return t.post(addr, "snapshot?"+query.Encode(), body, SnapshotTimeout, resp)
+}
+
+func (t *transport) post(addr string, rpc string, body io.Reader, timeout time.Duration, resp interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(addr, "/")+RPCPath+rpc, body)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("X-API-KEY", t.apiKey)
+	httpResp, err := t.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	data, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s %s", addr, rpc, httpResp.Status, bytes.TrimSpace(data))
+	}
+	return json.Unmarshal(data, resp)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/client"
+	"github.com/alexio777/stq/server/backends/memory"
+	"github.com/alexio777/stq/server/cluster"
+)
+
+func Test_Cluster(t *testing.T) {
+	cluster.HeartbeatInterval = 10 * time.Millisecond
+	cluster.ElectionTimeout = 100 * time.Millisecond
+	handlers := make([]http.Handler, 3)
+	servers := make([]*httptest.Server, 3)
+	peers := make(map[string]string)
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if handlers[i] == nil {
+				http.Error(rw, "node is starting", http.StatusServiceUnavailable)
+				return
+			}
+			handlers[i].ServeHTTP(rw, r)
+		}))
+		defer servers[i].Close()
+		peers[fmt.Sprint("node", i)] = servers[i].URL
+	}
+	nodes := make([]*cluster.Cluster, 3)
+	for i := range nodes {
+		backend, err := memory.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i], err = cluster.New(backend, cluster.Config{
+			ID:     fmt.Sprint("node", i),
+			Addr:   servers[i].URL,
+			Peers:  peers,
+			Dir:    t.TempDir(),
+			APIKey: "d6MrLT7MwlhtaoQu2b5lWFr",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nodes[i].Close()
+		handlers[i] = withCluster(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", nodes[i]).Handler, "d6MrLT7MwlhtaoQu2b5lWFr", nodes[i])
+	}
+	follower := -1
+	for i := 0; i < 300 && follower < 0; i++ {
+		for j, node := range nodes {
+			if id, _ := node.Leader(); id != "" && !node.IsLeader() {
+				follower = j
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if follower < 0 {
+		t.Fatal("cluster has no leader")
+	}
+
+	// changes sent to a follower are proxied to the leader
+	c := client.New(servers[follower].URL, "d6MrLT7MwlhtaoQu2b5lWFr")
+	taskID, err := c.AddTask("queue", 15, []byte("payload_123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	workerTaskID, payload, err := c.WaitWorkerTask("queue", 1, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workerTaskID != taskID || string(payload) != "payload_123" {
+		t.Fatalf("unexpected task: %s %s", workerTaskID, payload)
+	}
+
+	code, data := adminRequest(t, "GET", servers[follower].URL+"/cluster/status", nil)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d, body: %s", code, data)
+	}
+	var status cluster.Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Role != cluster.Follower || status.Leader == "" || len(status.Members) != 3 {
+		t.Fatalf("unexpected cluster status: %+v", status)
+	}
+	code, data = adminRequest(t, "POST", servers[follower].URL+"/cluster/join?id=node0", nil)
+	if code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d, body: %s", code, data)
+	}
+}
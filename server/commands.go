@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/export"
+	"github.com/alexio777/stq/server/backends/middleware"
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage:
+  %[1]s                          serve the API, configured by environment variables
+  %[1]s --list-backends          print the compiled in backends
+  %[1]s export [-backend DSN] [-output FILE]
+                                 export all tasks of the backend to the file or stdout
+  %[1]s import [-backend DSN] [-input FILE]
+                                 import tasks from the file or stdin to the backend
+  %[1]s migrate -from DSN -to DSN
+                                 copy all tasks from one backend to another
+  %[1]s reencrypt [-backend DSN]
+                                 rewrite tasks encrypted with old keys by the encrypt middleware
+
+DSN defaults to the BACKEND environment variable, MIDDLEWARE is applied to
+the opened backends. Do not export or import a backend used by a running
+server unless the backend supports it.
+`, os.Args[0])
+}
+
+func runCommand(name string, args []string) error {
+	switch name {
+	case "export":
+		return runExport(args)
+	case "import":
+		return runImport(args)
+	case "migrate":
+		return runMigrate(args)
+	case "reencrypt":
+		return runReencrypt(args)
+	default:
+		usage()
+		return fmt.Errorf("%w: %s", ErrUnknownCommand, name)
+	}
+}
+
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dsn := flags.String("backend", os.Getenv("BACKEND"), "backend DSN")
+	output := flags.String("output", "", "export file, stdout if empty")
+	flags.Parse(args)
+	backend, err := openBackend(*dsn)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	var exporter backends.Exporter
+	if !backends.As(backend, &exporter) {
+		return backends.ErrNotSupported
+	}
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	count, err := export.Write(context.Background(), w, exporter)
+	if err != nil {
+		return err
+	}
+	log.Println("Exported tasks:", count)
+	return nil
+}
+
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dsn := flags.String("backend", os.Getenv("BACKEND"), "backend DSN")
+	input := flags.String("input", "", "export file, stdin if empty")
+	flags.Parse(args)
+	backend, err := openBackend(*dsn)
+	if err != nil {
+		return err
+	}
+	var importer backends.Importer
+	if !backends.As(backend, &importer) {
+		backend.Close()
+		return backends.ErrNotSupported
+	}
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			backend.Close()
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	count, err := export.Read(context.Background(), r, importer)
+	log.Println("Imported tasks:", count)
+	// close saves the imported tasks of backends like memory with snapshot
+	if closeErr := backend.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fromDSN := flags.String("from", "", "source backend DSN")
+	toDSN := flags.String("to", "", "target backend DSN")
+	flags.Parse(args)
+	if *fromDSN == "" || *toDSN == "" {
+		flags.Usage()
+		return errors.New("both -from and -to are required")
+	}
+	from, err := openBackend(*fromDSN)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+	to, err := openBackend(*toDSN)
+	if err != nil {
+		return err
+	}
+	var exporter backends.Exporter
+	var importer backends.Importer
+	if !backends.As(from, &exporter) || !backends.As(to, &importer) {
+		to.Close()
+		return backends.ErrNotSupported
+	}
+	count, err := export.Copy(context.Background(), importer, exporter)
+	log.Println("Migrated tasks:", count)
+	if closeErr := to.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func runReencrypt(args []string) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	dsn := flags.String("backend", os.Getenv("BACKEND"), "backend DSN")
+	flags.Parse(args)
+	backend, err := openBackend(*dsn)
+	if err != nil {
+		return err
+	}
+	var reencrypter middleware.Reencrypter
+	if !backends.As(backend, &reencrypter) {
+		backend.Close()
+		return errors.New("MIDDLEWARE has no encrypt")
+	}
+	count, err := reencrypter.Reencrypt(context.Background())
+	log.Println("Reencrypted tasks:", count)
+	// close saves the rewritten tasks of backends like memory with snapshot
+	if closeErr := backend.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
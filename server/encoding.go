@@ -0,0 +1,75 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minGzipSize is the smallest payload or result sent gzip compressed to
+// clients accepting it, smaller ones do not get shorter.
+const minGzipSize = 1 << 10
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// errZstdEncoding rejects zstd bodies, zstd is not implemented as the server
+// has no dependencies beyond the standard library.
+var errZstdEncoding = fmt.Errorf("%w: zstd, use gzip", errUnsupportedEncoding)
+
+// decodeBody returns the request body decoded by its Content-Encoding, only
+// gzip is supported.
+func decodeBody(r *http.Request) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip":
+		return gzip.NewReader(r.Body)
+	case "zstd":
+		return nil, errZstdEncoding
+	default:
+		return nil, errUnsupportedEncoding
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding request header allows a
+// gzip response.
+func acceptsGzip(r *http.Request) bool {
+	for _, item := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(item, ";")
+		if strings.ToLower(strings.TrimSpace(params[0])) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// writeEncoded copies the content of size bytes to the response, gzip
+// compressed if the client accepts it.
+func writeEncoded(rw http.ResponseWriter, r *http.Request, content io.Reader, size int64) error {
+	rw.Header().Add("Vary", "Accept-Encoding")
+	if size < minGzipSize || !acceptsGzip(r) {
+		rw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		_, err := io.Copy(rw, content)
+		return err
+	}
+	rw.Header().Set("Content-Encoding", "gzip")
+	w := gzip.NewWriter(rw)
+	if _, err := io.Copy(w, content); err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/memory"
+	"github.com/alexio777/stq/server/backends/middleware"
+)
+
+func Test_Encoding(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := backends.Chain(backend, middleware.Compress(middleware.Compression{}))
+	server := httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", wrapped, withMaxBodySize(1<<20)).Handler)
+	defer server.Close()
+	request := func(method, url string, body []byte, header http.Header) *http.Response {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+		req.Header.Set("X-API-KEY", "d6MrLT7MwlhtaoQu2b5lWFr")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	payload := bytes.Repeat([]byte(`{"key":"value"}`), 1000)
+
+	t.Run("Test gzip upload", func(t *testing.T) {
+		var compressed bytes.Buffer
+		w := gzip.NewWriter(&compressed)
+		w.Write(payload)
+		w.Close()
+		resp := request("POST", server.URL+"/task?queue=queue&timeout=15", compressed.Bytes(), http.Header{"Content-Encoding": {"gzip"}})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status code is not equal: %d != %d", resp.StatusCode, http.StatusOK)
+		}
+		for _, encoding := range []string{"br", "zstd"} {
+			resp = request("POST", server.URL+"/task?queue=queue&timeout=15", payload, http.Header{"Content-Encoding": {encoding}})
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnsupportedMediaType {
+				t.Fatalf("status code is not equal: %s %d != %d", encoding, resp.StatusCode, http.StatusUnsupportedMediaType)
+			}
+		}
+	})
+	t.Run("Test gzip download", func(t *testing.T) {
+		// the transport does not decode a response to an explicit Accept-Encoding
+		resp := request("GET", server.URL+"/task/worker?queue=queue", nil, http.Header{"Accept-Encoding": {"gzip"}})
+		defer resp.Body.Close()
+		if resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Fatalf("content encoding is not equal: %s != %s", resp.Header.Get("Content-Encoding"), "gzip")
+		}
+		r, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, payload) {
+			t.Fatalf("payload is not equal: %d != %d bytes", len(data), len(payload))
+		}
+	})
+	t.Run("Test compression stats", func(t *testing.T) {
+		code, data := adminRequest(t, "GET", server.URL+"/stats/compression", nil)
+		if code != http.StatusOK {
+			t.Fatalf("unexpected status code: %d, body: %s", code, data)
+		}
+		var stats compressionStats
+		if err := json.Unmarshal(data, &stats); err != nil {
+			t.Fatal(err)
+		}
+		if stats.RawBytes != uint64(len(payload)) || stats.Ratio <= 1 {
+			t.Fatalf("stats is not equal: %s", data)
+		}
+	})
+}
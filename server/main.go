@@ -1,43 +1,71 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
-
-	"github.com/alexio777/stq/server/backends/memory"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/alexio777/stq/server/backends"
-)
+	"github.com/alexio777/stq/server/backends/middleware"
+	"github.com/alexio777/stq/server/blob"
+	"github.com/alexio777/stq/server/cluster"
+	"github.com/alexio777/stq/server/replication"
 
-var (
-	ErrUnknownBackend = errors.New("unknown backend")
+	// backends compiled into the server
+	_ "github.com/alexio777/stq/server/backends/memory"
+	_ "github.com/alexio777/stq/server/backends/router"
+	_ "github.com/alexio777/stq/server/backends/shard"
+	_ "github.com/alexio777/stq/server/backends/tiered"
 )
 
-func NewBackend(name string) (backends.Backend, error) {
-	switch name {
-	case "memory":
-		return memory.New()
-	default:
-		return nil, ErrUnknownBackend
-	}
-}
+// defaultReplicationLog is the number of changes a replica keeps for its
+// own replicas if REPLICATION_LOG is not set.
+const defaultReplicationLog = 10000
+
+// defaultBlobThreshold is the size of payloads and results streamed to the
+// blob store if BLOB_THRESHOLD is not set.
+const defaultBlobThreshold = 1 << 20
+
+// blobSweepInterval is how often blobs no task references are deleted, and
+// their minimal age.
+const blobSweepInterval = time.Hour
+
+// defaultMaxBodySize is the request body limit if MAX_BODY_SIZE is not set.
+const defaultMaxBodySize = 64 << 20
 
 func main() {
+	listBackends := flag.Bool("list-backends", false, "print the compiled in backends and exit")
+	flag.Usage = usage
+	flag.Parse()
+	if *listBackends {
+		for _, name := range backends.Names() {
+			fmt.Println(name)
+		}
+		return
+	}
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Arg(0), flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	log.Println("STQ v1.0.1")
 
-	backendName := os.Getenv("BACKEND")
-	if backendName == "" {
+	backendDSN := os.Getenv("BACKEND")
+	if backendDSN == "" {
 		log.Fatal("BACKEND environment variable is not set")
 	}
-	backend, err := NewBackend(backendName)
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println("Backend:", backend.Name())
-
 	listen := os.Getenv("LISTEN")
 	if listen == "" {
 		log.Fatal("LISTEN environment variable is not set")
@@ -46,10 +74,248 @@ func main() {
 	if apiKey == "" {
 		log.Fatal("APIKEY environment variable is not set")
 	}
-	api := createAPI(apiKey, backend)
+	var backend backends.Backend
+	var c *cluster.Cluster
+	var err error
+	if clusterID := os.Getenv("CLUSTER_ID"); clusterID != "" {
+		if os.Getenv("REPLICA_OF") != "" || os.Getenv("REPLICATION_LOG") != "" {
+			log.Fatal("cluster mode does not support REPLICA_OF and REPLICATION_LOG")
+		}
+		c, err = openCluster(backendDSN, clusterID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backend, err = withMiddleware(c)
+	} else {
+		backend, err = openBackend(backendDSN)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	var primary *replication.Primary
+	var replica *replication.Replica
+	replicaOf := os.Getenv("REPLICA_OF")
+	logSize, err := strconv.Atoi(os.Getenv("REPLICATION_LOG"))
+	if err != nil {
+		logSize = 0
+	}
+	if replicaOf != "" && logSize == 0 {
+		logSize = defaultReplicationLog
+	}
+	if logSize > 0 {
+		primary, err = replication.NewPrimary(backend, logSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backend = primary
+		log.Println("Replication log:", logSize)
+	}
+	if replicaOf != "" {
+		replicaAPIKey := os.Getenv("REPLICA_APIKEY")
+		if replicaAPIKey == "" {
+			replicaAPIKey = apiKey
+		}
+		replica, err = replication.NewReplica(replicaOf, replicaAPIKey, backend)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go replica.Run(context.Background())
+		log.Println("Replica of:", replicaOf)
+	}
+	maxBodySize, err := strconv.ParseInt(os.Getenv("MAX_BODY_SIZE"), 10, 64)
+	if err != nil || maxBodySize < 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+	apiOptions := []apiOption{withMaxBodySize(maxBodySize)}
+	var reloaders []reloader
+	if path := os.Getenv("API_KEYS"); path != "" {
+		keys, err := newAPIKeys(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reloaders = append(reloaders, keys)
+		apiOptions = append(apiOptions, withAPIKeys(keys))
+		log.Println("API keys:", path)
+	}
+	if path := os.Getenv("TOKEN_KEYS"); path != "" {
+		keys, err := newTokenKeys(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reloaders = append(reloaders, keys)
+		apiOptions = append(apiOptions, withTokens(keys))
+		log.Println("Token keys:", path)
+	}
+	if path := os.Getenv("TLS_CLIENT_SUBJECTS"); path != "" {
+		subjects, err := newAPIKeys(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reloaders = append(reloaders, subjects)
+		apiOptions = append(apiOptions, withClientCerts(subjects))
+		log.Println("TLS client subjects:", path)
+	}
+	if path := os.Getenv("TENANT_LIMITS"); path != "" {
+		limits, err := newTenantLimits(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reloaders = append(reloaders, limits)
+		apiOptions = append(apiOptions, withTenantLimits(limits))
+		log.Println("Tenant limits:", path)
+	}
+	if path := os.Getenv("RATE_LIMITS"); path != "" {
+		limits, err := newRateLimits(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reloaders = append(reloaders, limits)
+		apiOptions = append(apiOptions, withRateLimits(limits))
+		log.Println("Rate limits:", path)
+	}
+	if len(reloaders) > 0 {
+		go reloadOnSignal(reloaders...)
+	}
+	if dsn := os.Getenv("BLOB_STORE"); dsn != "" {
+		store, err := blob.Open(dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		threshold, err := strconv.ParseInt(os.Getenv("BLOB_THRESHOLD"), 10, 64)
+		if err != nil || threshold <= 0 {
+			threshold = defaultBlobThreshold
+		}
+		if keys, ok := middleware.KeysOf(backend); ok {
+			// blobs hold payloads and results as well
+			store = middleware.EncryptBlobs(store, keys)
+			log.Println("Blob store: encrypted")
+		}
+		apiOptions = append(apiOptions, withBlobStore(store, threshold))
+		go sweepBlobsEvery(store, backend, blobSweepInterval)
+		log.Println("Blob store:", dsn, "threshold:", threshold)
+	}
+	api := createAPI(apiKey, backend, apiOptions...)
+	if primary != nil {
+		api.Handler = withReplication(api.Handler, apiKey, primary, replica)
+	}
+	if c != nil {
+		api.Handler = withCluster(api.Handler, apiKey, c)
+	}
 	apiListener, err := net.Listen("tcp", listen)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Fatal(api.Serve(apiListener))
+	if certFile := os.Getenv("TLS_CERT"); certFile != "" {
+		tlsConfig, err := newTLSConfig(certFile, os.Getenv("TLS_KEY"), os.Getenv("TLS_CLIENT_CA"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		apiListener = tls.NewListener(apiListener, tlsConfig)
+		log.Println("TLS:", certFile)
+	}
+	done := make(chan struct{})
+	go shutdownOnSignal(api, backend, done)
+	if err := api.Serve(apiListener); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// wait for the backend to close
+	<-done
+}
+
+// openBackend opens the backend by DSN and wraps it with the middlewares
+// from the MIDDLEWARE environment variable.
+func openBackend(dsn string) (backends.Backend, error) {
+	backend, err := backends.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Backend:", backend.Name())
+	return withMiddleware(backend)
+}
+
+// withMiddleware wraps the backend with the middlewares from the MIDDLEWARE
+// environment variable. The concurrency layer is added without limits if it
+// is not there, so limits can be set by /admin/concurrency.
+func withMiddleware(backend backends.Backend) (backends.Backend, error) {
+	if spec := os.Getenv("MIDDLEWARE"); spec != "" {
+		middlewares, err := middleware.Parse(spec, log.Default())
+		if err != nil {
+			backend.Close()
+			return nil, err
+		}
+		backend = backends.Chain(backend, middlewares...)
+		log.Println("Middleware:", spec)
+	}
+	var limiter middleware.ConcurrencyLimiter
+	if !backends.As(backend, &limiter) {
+		backend = middleware.Concurrency(nil)(backend)
+	}
+	return backend, nil
+}
+
+// openCluster opens the backend by DSN as the state of the cluster node
+// configured by CLUSTER_* environment variables.
+func openCluster(dsn string, id string) (*cluster.Cluster, error) {
+	addr := os.Getenv("CLUSTER_ADDR")
+	if addr == "" {
+		return nil, errors.New("CLUSTER_ADDR environment variable is not set")
+	}
+	peers, err := parsePeers(os.Getenv("CLUSTER_PEERS"))
+	if err != nil {
+		return nil, err
+	}
+	backend, err := backends.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Backend:", backend.Name())
+	c, err := cluster.New(backend, cluster.Config{
+		ID:     id,
+		Addr:   addr,
+		Peers:  peers,
+		Dir:    os.Getenv("CLUSTER_DIR"),
+		APIKey: os.Getenv("APIKEY"),
+	})
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	log.Println("Cluster node:", id, addr)
+	return c, nil
+}
+
+// reloader is a keys file reloaded on SIGHUP.
+type reloader interface {
+	Reload() error
+}
+
+// reloadOnSignal reloads the API and token keys on SIGHUP.
+func reloadOnSignal(reloaders ...reloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		for _, r := range reloaders {
+			if err := r.Reload(); err != nil {
+				log.Println("Keys reload:", err)
+			}
+		}
+		log.Println("Keys reloaded")
+	}
+}
+
+// shutdownOnSignal stops the API and closes the backend on SIGINT or
+// SIGTERM, so backends can save their state, and closes done then.
+func shutdownOnSignal(api *http.Server, backend backends.Backend, done chan<- struct{}) {
+	defer close(done)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Println("Shutdown:", <-signals)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := api.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
+	if err := backend.Close(); err != nil {
+		log.Fatal(err)
+	}
 }
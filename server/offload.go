@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/blob"
+)
+
+// apiOption configures the API.
+type apiOption func(o *apiOptions)
+
+type apiOptions struct {
+	blobs         blob.Store
+	blobThreshold int64
+	// zero means no limit
+	maxBodySize int64
+	keys        *apiKeys
+	tokens      *tokenKeys
+	certs       *apiKeys
+	limits      *tenantLimits
+	rates       *rateLimits
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// withMaxBodySize limits request bodies to size bytes, larger ones are
+// rejected with 413 HTTP StatusRequestEntityTooLarge.
+func withMaxBodySize(size int64) apiOption {
+	return func(o *apiOptions) {
+		o.maxBodySize = size
+	}
+}
+
+// limitedBody returns errBodyTooLarge when the body has more than n bytes
+// left.
+type limitedBody struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var one [1]byte
+		n, err := l.r.Read(one[:])
+		if n > 0 {
+			return 0, errBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// bodyError responds to the request with the body read error.
+func bodyError(rw http.ResponseWriter, err error) {
+	if errors.Is(err, errBodyTooLarge) {
+		http.Error(rw, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, errUnsupportedEncoding) {
+		http.Error(rw, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	http.Error(rw, err.Error(), http.StatusBadRequest)
+}
+
+// withBlobStore streams payloads and results of threshold bytes and larger
+// to the store, the backend keeps references to them.
+func withBlobStore(store blob.Store, threshold int64) apiOption {
+	return func(o *apiOptions) {
+		o.blobs = store
+		o.blobThreshold = threshold
+	}
+}
+
+// readBody reads the request body decoded by its Content-Encoding up to
+// maxSize bytes, zero means no limit. A body of the blob threshold and
+// larger is streamed to the blob store and the reference to it is returned,
+// only the first threshold bytes are kept in memory.
+func (o *apiOptions) readBody(r *http.Request, maxSize int64) ([]byte, error) {
+	if maxSize > 0 && r.ContentLength > maxSize && r.Header.Get("Content-Encoding") == "" {
+		return nil, errBodyTooLarge
+	}
+	body, err := decodeBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 {
+		// the limit is of the decoded body
+		body = &limitedBody{r: body, n: maxSize}
+	}
+	if o.blobs == nil {
+		return ioutil.ReadAll(body)
+	}
+	head, err := ioutil.ReadAll(io.LimitReader(body, o.blobThreshold))
+	if err != nil {
+		return nil, err
+	}
+	// the body ends before the threshold
+	if int64(len(head)) < o.blobThreshold && !blob.IsReference(head) {
+		return head, nil
+	}
+	content := &countedReader{r: io.MultiReader(bytes.NewReader(head), body)}
+	id, err := o.blobs.Put(r.Context(), content)
+	if err != nil {
+		return nil, err
+	}
+	return blob.Reference(id, content.n), nil
+}
+
+// countedReader counts the bytes read.
+type countedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeBody writes the data as the response body or streams the blob the
+// data references, gzip compressed if the client accepts it.
+func (o *apiOptions) writeBody(rw http.ResponseWriter, r *http.Request, data []byte) {
+	id, ok := blob.ParseReference(data)
+	if !ok || o.blobs == nil {
+		writeEncoded(rw, r, bytes.NewReader(data), int64(len(data)))
+		return
+	}
+	content, size, err := o.blobs.Get(r.Context(), id)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+	writeEncoded(rw, r, content, size)
+}
+
+// taskPayload returns the payload of the task, so its blob is deleted once
+// the task is done. It is nil without blobs or task lookup.
+func (o *apiOptions) taskPayload(ctx context.Context, backend backends.Backend, taskID string) []byte {
+	if o.blobs == nil {
+		return nil
+	}
+	var inspector backends.Inspector
+	if !backends.As(backend, &inspector) {
+		return nil
+	}
+	task, err := inspector.Task(ctx, taskID)
+	if err != nil {
+		return nil
+	}
+	return task.Payload
+}
+
+// deleteBlob deletes the blob the data references, if any.
+func (o *apiOptions) deleteBlob(data []byte) {
+	id, ok := blob.ParseReference(data)
+	if !ok || o.blobs == nil {
+		return
+	}
+	// the request may be gone already
+	if err := o.blobs.Delete(context.Background(), id); err != nil && !errors.Is(err, blob.ErrNotFound) {
+		log.Println("Blob delete:", err)
+	}
+}
+
+// sweepBlobs deletes the blobs stored before minAge ago that no task of the
+// backend references: payloads of deleted, dropped or failed tasks and
+// blobs of interrupted requests. Younger blobs may be of tasks being added.
+func sweepBlobs(ctx context.Context, store blob.Store, backend backends.Backend, minAge time.Duration) (int, error) {
+	var exporter backends.Exporter
+	lister, ok := store.(blob.Lister)
+	if !ok || !backends.As(backend, &exporter) {
+		return 0, backends.ErrNotSupported
+	}
+	// blobs are listed before tasks, so a blob stored after the listing is
+	// not deleted and one listed has its task added already
+	before := time.Now().Add(-minAge)
+	var old []string
+	err := lister.Blobs(ctx, func(id string, stored time.Time) error {
+		if stored.Before(before) {
+			old = append(old, id)
+		}
+		return nil
+	})
+	if err != nil || len(old) == 0 {
+		return 0, err
+	}
+	referenced := make(map[string]bool)
+	err = exporter.Export(ctx, func(task *backends.Task) error {
+		for _, data := range [][]byte{task.Payload, task.Result} {
+			if id, ok := blob.ParseReference(data); ok {
+				referenced[id] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, id := range old {
+		if referenced[id] {
+			continue
+		}
+		if err := store.Delete(ctx, id); err != nil && !errors.Is(err, blob.ErrNotFound) {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// sweepBlobsEvery sweeps the blobs of the backend every interval.
+func sweepBlobsEvery(store blob.Store, backend backends.Backend, interval time.Duration) {
+	for range time.Tick(interval) {
+		deleted, err := sweepBlobs(context.Background(), store, backend, interval)
+		if err != nil {
+			log.Println("Blob sweep:", err)
+			continue
+		}
+		if deleted > 0 {
+			log.Println("Blob sweep: deleted", deleted)
+		}
+	}
+}
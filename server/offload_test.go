@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/server/backends/memory"
+	"github.com/alexio777/stq/server/backends/middleware"
+	"github.com/alexio777/stq/server/blob"
+)
+
+func Test_BlobOffload(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	store, err := blob.NewDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", backend, withBlobStore(store, 16)).Handler)
+	defer server.Close()
+	blobs := func() int {
+		files, err := filepath.Glob(filepath.Join(dir, "*.blob"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+
+	large := bytes.Repeat([]byte("payload_"), 1000)
+	code, taskID := adminRequest(t, "POST", server.URL+"/task?queue=queue&timeout=15", large)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d, body: %s", code, taskID)
+	}
+	small := []byte("small")
+	if code, data := adminRequest(t, "POST", server.URL+"/task?queue=queue&timeout=15", small); code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d, body: %s", code, data)
+	}
+	task, err := backend.Task(context.TODO(), string(taskID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blob.IsReference(task.Payload) || blobs() != 1 {
+		t.Fatalf("payload is not offloaded: %q, %d blobs", task.Payload, blobs())
+	}
+
+	code, payload := adminRequest(t, "GET", server.URL+"/task/worker?queue=queue", nil)
+	if code != http.StatusOK || !bytes.Equal(payload, large) {
+		t.Fatalf("payload is not equal: %d %d bytes", code, len(payload))
+	}
+	if blobs() != 1 {
+		t.Fatal("payload blob is deleted before the task is done")
+	}
+	if code, payload = adminRequest(t, "GET", server.URL+"/task/worker?queue=queue", nil); code != http.StatusOK || !bytes.Equal(payload, small) {
+		t.Fatalf("payload is not equal: %d %s != %s", code, payload, small)
+	}
+
+	if code, data := adminRequest(t, "POST", server.URL+"/task/ready?taskid="+string(taskID), large); code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d, body: %s", code, data)
+	}
+	if blobs() != 2 {
+		t.Fatal("result is not offloaded")
+	}
+	code, result := adminRequest(t, "GET", server.URL+"/task/result?taskid="+string(taskID), nil)
+	if code != http.StatusOK || !bytes.Equal(result, large) {
+		t.Fatalf("result is not equal: %d %d bytes", code, len(result))
+	}
+	if blobs() != 0 {
+		t.Fatal("payload and result blobs are not deleted")
+	}
+}
+
+func Test_BlobRedispatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memory.snapshot")
+	backend, err := memory.New(memory.WithSnapshot(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := blob.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := bytes.Repeat([]byte("payload_"), 1000)
+	server := httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", backend, withBlobStore(store, 16)).Handler)
+	if code, data := adminRequest(t, "POST", server.URL+"/task?queue=queue&timeout=15", large); code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d, body: %s", code, data)
+	}
+	if code, payload := adminRequest(t, "GET", server.URL+"/task/worker?queue=queue", nil); code != http.StatusOK || !bytes.Equal(payload, large) {
+		t.Fatalf("payload is not equal: %d %d bytes", code, len(payload))
+	}
+	server.Close()
+	if err := backend.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the running task is queued again on restore
+	restored, err := memory.New(memory.WithSnapshot(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", restored, withBlobStore(store, 16)).Handler)
+	defer server.Close()
+	if code, payload := adminRequest(t, "GET", server.URL+"/task/worker?queue=queue", nil); code != http.StatusOK || !bytes.Equal(payload, large) {
+		t.Fatalf("payload is not equal: %d %d bytes", code, len(payload))
+	}
+}
+
+func Test_BlobSweep(t *testing.T) {
+	ctx := context.TODO()
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	store, err := blob.NewDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", backend, withBlobStore(store, 16)).Handler)
+	defer server.Close()
+	large := bytes.Repeat([]byte("payload_"), 1000)
+	var taskIDs []string
+	for i := 0; i < 2; i++ {
+		code, taskID := adminRequest(t, "POST", server.URL+"/task?queue=queue&timeout=15", large)
+		if code != http.StatusOK {
+			t.Fatalf("unexpected status code: %d, body: %s", code, taskID)
+		}
+		taskIDs = append(taskIDs, string(taskID))
+	}
+	if err := backend.Delete(ctx, taskIDs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := sweepBlobs(ctx, store, backend, time.Hour); err != nil || deleted != 0 {
+		t.Fatalf("young blobs are swept: %d %v", deleted, err)
+	}
+	deleted, err := sweepBlobs(ctx, store, backend, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Fatalf("deleted blobs are not equal: %d != %d", deleted, 1)
+	}
+	if code, payload := adminRequest(t, "GET", server.URL+"/task/worker?queue=queue", nil); code != http.StatusOK || !bytes.Equal(payload, large) {
+		t.Fatalf("payload is not equal: %d %d bytes", code, len(payload))
+	}
+}
+
+func Test_BlobPayloadBytes(t *testing.T) {
+	backend, err := memory.New(memory.WithQueueLimit("queue", memory.QueueLimit{MaxBytes: 12000}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := middleware.NewKeys(map[string][]byte{"key": make([]byte, 32)}, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := blob.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := middleware.Encrypt(keys)(backend)
+	server := httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", encrypted, withBlobStore(middleware.EncryptBlobs(store, keys), 16)).Handler)
+	defer server.Close()
+
+	// offloaded payloads count by their size, not the size of the reference
+	large := bytes.Repeat([]byte("payload_"), 1000)
+	if code, data := adminRequest(t, "POST", server.URL+"/task?queue=queue&timeout=15", large); code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d, body: %s", code, data)
+	}
+	stats, err := encrypted.Stats(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Queues["queue"].WaitBytes != uint64(len(large)) {
+		t.Fatalf("wait bytes are not equal: %d != %d", stats.Queues["queue"].WaitBytes, len(large))
+	}
+	if code, _ := adminRequest(t, "POST", server.URL+"/task?queue=queue&timeout=15", large); code != http.StatusInsufficientStorage {
+		t.Fatalf("status code is not equal: %d != %d", code, http.StatusInsufficientStorage)
+	}
+}
+
+func Test_MaxBodySize(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := blob.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, api := range map[string]*http.Server{
+		"inline": createAPI("d6MrLT7MwlhtaoQu2b5lWFr", backend, withMaxBodySize(16)),
+		"blob":   createAPI("d6MrLT7MwlhtaoQu2b5lWFr", backend, withMaxBodySize(16), withBlobStore(store, 8)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(api.Handler)
+			defer server.Close()
+			if code, data := adminRequest(t, "POST", server.URL+"/task?queue=queue&timeout=15", make([]byte, 16)); code != http.StatusOK {
+				t.Fatalf("unexpected status code: %d, body: %s", code, data)
+			}
+			if code, _ := adminRequest(t, "POST", server.URL+"/task?queue=queue&timeout=15", make([]byte, 17)); code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("status code is not equal: %d != %d", code, http.StatusRequestEntityTooLarge)
+			}
+			// chunked body without the content length
+			req, err := http.NewRequest("POST", server.URL+"/task?queue=queue&timeout=15", io.MultiReader(bytes.NewReader(make([]byte, 10)), bytes.NewReader(make([]byte, 10))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-API-KEY", "d6MrLT7MwlhtaoQu2b5lWFr")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Fatalf("status code is not equal: %d != %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRateBuckets is the bucket count above which full buckets are dropped,
+// they are created again full.
+const maxRateBuckets = 10000
+
+// rateScope is what a rate limit is of, kind is "key" or "queue".
+type rateScope struct {
+	kind string
+	role string
+	name string
+}
+
+// rateRule allows rate calls per second and bursts of burst calls.
+type rateRule struct {
+	rate  float64
+	burst float64
+}
+
+// bucket is a token bucket of a rule.
+type bucket struct {
+	rule   rateRule
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.rule.burst, b.tokens+now.Sub(b.last).Seconds()*b.rule.rate)
+	b.last = now
+}
+
+// wait returns how long until the bucket has a token.
+func (b *bucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rule.rate * float64(time.Second))
+}
+
+// rateLimits are token bucket limits of API keys and queues loaded from a
+// file, see loadRateLimits.
+type rateLimits struct {
+	path    string
+	mutex   sync.Mutex
+	rules   map[rateScope]rateRule
+	buckets map[rateScope]*bucket
+}
+
+func newRateLimits(path string) (*rateLimits, error) {
+	l := &rateLimits{path: path}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload reads the limits file again and refills the buckets, the limits are
+// kept if it fails.
+func (l *rateLimits) Reload() error {
+	rules, err := loadRateLimits(l.path)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	l.rules = rules
+	l.buckets = make(map[rateScope]*bucket)
+	l.mutex.Unlock()
+	return nil
+}
+
+// bucket returns the bucket of the scope, nil if it is not limited. Scopes
+// without a rule of their name get own buckets of the "*" rule.
+func (l *rateLimits) bucket(scope rateScope, now time.Time) *bucket {
+	if b, ok := l.buckets[scope]; ok {
+		b.refill(now)
+		return b
+	}
+	rule, ok := l.rules[scope]
+	if !ok {
+		rule, ok = l.rules[rateScope{kind: scope.kind, role: scope.role, name: "*"}]
+	}
+	if !ok {
+		return nil
+	}
+	if len(l.buckets) >= maxRateBuckets {
+		for s, b := range l.buckets {
+			if b.refill(now); b.tokens >= b.rule.burst {
+				delete(l.buckets, s)
+			}
+		}
+	}
+	b := &bucket{rule: rule, tokens: rule.burst, last: now}
+	l.buckets[scope] = b
+	return b
+}
+
+// take takes a token of the key and the queue buckets of the role, or
+// returns how long to wait for them. Calls of unnamed keys, APIKEY, are
+// limited by the queue only.
+func (l *rateLimits) take(role string, key string, queue string, now time.Time) (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var buckets []*bucket
+	if key != "" {
+		if b := l.bucket(rateScope{kind: "key", role: role, name: key}, now); b != nil {
+			buckets = append(buckets, b)
+		}
+	}
+	if b := l.bucket(rateScope{kind: "queue", role: role, name: queue}, now); b != nil {
+		buckets = append(buckets, b)
+	}
+	var wait time.Duration
+	for _, b := range buckets {
+		if w := b.wait(); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return wait, false
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0, true
+}
+
+// loadRateLimits reads a limit per line, the scope "key" or "queue", the key
+// or queue name or "*" for each one not in the file, the role "enqueue" or
+// "consume", calls per second and the burst:
+//
+//	# scope  name      role     rate  burst
+//	key      producer  enqueue  100   200
+//	key      *         enqueue  10    20
+//	queue    orders    consume  50    50
+func loadRateLimits(path string) (map[rateScope]rateRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules := make(map[rateScope]rateRule)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("%s:%d: expected scope, name, role, rate and burst", path, line)
+		}
+		scope := rateScope{kind: fields[0], name: fields[1], role: fields[2]}
+		if scope.kind != "key" && scope.kind != "queue" {
+			return nil, fmt.Errorf("%s:%d: unknown scope %q", path, line, scope.kind)
+		}
+		if scope.role != roleEnqueue && scope.role != roleConsume {
+			return nil, fmt.Errorf("%s:%d: role %q is not limited", path, line, scope.role)
+		}
+		var rule rateRule
+		if rule.rate, err = strconv.ParseFloat(fields[3], 64); err != nil || rule.rate <= 0 {
+			return nil, fmt.Errorf("%s:%d: rate must be a positive number", path, line)
+		}
+		if rule.burst, err = strconv.ParseFloat(fields[4], 64); err != nil || rule.burst < 1 {
+			return nil, fmt.Errorf("%s:%d: burst must be at least 1", path, line)
+		}
+		rules[scope] = rule
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// withRateLimits limits enqueue and consume calls of keys and queues.
+func withRateLimits(limits *rateLimits) apiOption {
+	return func(o *apiOptions) {
+		o.rates = limits
+	}
+}
+
+// allowRate answers 429 HTTP StatusTooManyRequests with Retry-After in
+// seconds if the call of the grant on the backend queue is over the limits.
+func (o *apiOptions) allowRate(rw http.ResponseWriter, g *grant, role string, queue string) bool {
+	if o.rates == nil {
+		return true
+	}
+	wait, ok := o.rates.take(role, g.name, queue, time.Now())
+	if ok {
+		return true
+	}
+	rw.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+	http.Error(rw, "rate limit exceeded", http.StatusTooManyRequests)
+	return false
+}
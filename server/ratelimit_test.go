@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/client"
+	"github.com/alexio777/stq/server/backends/memory"
+)
+
+func Test_RateLimits(t *testing.T) {
+	dir := t.TempDir()
+	keysPath := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(keysPath, []byte(`producer enqueue
+worker   consume
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	limitsPath := filepath.Join(dir, "limits")
+	if err := ioutil.WriteFile(limitsPath, []byte(`# scope name role rate burst
+key   producer enqueue  1  2
+key   *        enqueue  10 1
+queue orders   consume  1  1
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := newAPIKeys(keysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits, err := newRateLimits(limitsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Test buckets", func(t *testing.T) {
+		now := time.Now()
+		for i := 0; i < 2; i++ {
+			if _, ok := limits.take(roleEnqueue, "producer", "orders", now); !ok {
+				t.Fatalf("burst is not allowed: %d", i)
+			}
+		}
+		wait, ok := limits.take(roleEnqueue, "producer", "orders", now)
+		if ok || wait != time.Second {
+			t.Fatalf("wait is not equal: %s != %s", wait, time.Second)
+		}
+		if _, ok := limits.take(roleEnqueue, "producer", "orders", now.Add(time.Second)); !ok {
+			t.Fatal("bucket is not refilled")
+		}
+		// other keys get own buckets of the "*" rule
+		if _, ok := limits.take(roleEnqueue, "other", "orders", now); !ok {
+			t.Fatal("other key is limited")
+		}
+		if _, ok := limits.take(roleEnqueue, "", "orders", now); !ok {
+			t.Fatal("APIKEY is limited")
+		}
+		if err := limits.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", backend, withAPIKeys(keys), withRateLimits(limits)).Handler)
+	defer server.Close()
+
+	t.Run("Test Retry-After", func(t *testing.T) {
+		// queues without rules are not limited
+		for i := 0; i < 3; i++ {
+			if status := keyRequest(t, "worker", "GET", server.URL+"/task/worker?queue=mail", nil); status != http.StatusNotFound {
+				t.Fatalf("status code is not equal: %d != %d", status, http.StatusNotFound)
+			}
+		}
+		if status := keyRequest(t, "worker", "GET", server.URL+"/task/worker?queue=orders", nil); status != http.StatusNotFound {
+			t.Fatalf("status code is not equal: %d != %d", status, http.StatusNotFound)
+		}
+		req, err := http.NewRequest("GET", server.URL+"/task/worker?queue=orders", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-API-KEY", "worker")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("status code is not equal: %d != %d", resp.StatusCode, http.StatusTooManyRequests)
+		}
+		if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "1" {
+			t.Fatalf("Retry-After is not equal: %s != %s", retryAfter, "1")
+		}
+	})
+
+	t.Run("Test client retries", func(t *testing.T) {
+		producer := client.New(server.URL, "producer")
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			if _, err := producer.AddTask("orders", 15, []byte("payload")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if time.Since(start) < time.Second {
+			t.Fatal("client does not wait for Retry-After")
+		}
+		producer.RateLimitRetries = 0
+		if _, err := producer.AddTask("orders", 15, []byte("payload")); err == nil || err.Error() != "429 Too Many Requests" {
+			t.Fatalf("rate limit is not detected: %v", err)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/alexio777/stq/server/replication"
+)
+
+// readOnlyPaths are served by a replica following its primary, GET only.
+var readOnlyPaths = map[string]bool{
+	"/stats":               true,
+	"/stats/compression":   true,
+	"/task/status":         true,
+	"/metrics":             true,
+	"/admin/export":        true,
+	"/admin/concurrency":   true,
+	"/admin/dispatch-rate": true,
+}
+
+// withReplication adds replication endpoints to the API handler and makes
+// it read-only while the server is a following replica. The replica is nil
+// on a primary.
+func withReplication(api http.Handler, apiKey string, primary *replication.Primary, replica *replication.Replica) http.Handler {
+	mux := http.NewServeMux()
+	// GET /replication/stream?log=logid&from=seq
+	// stream task changes to a replica
+	mux.HandleFunc("/replication/stream", func(rw http.ResponseWriter, r *http.Request) {
+		if !checkAPIKey(r, apiKey) {
+			http.Error(rw, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "GET" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		primary.ServeHTTP(rw, r)
+	})
+	// GET /replication/status
+	// return replication state and lag in json
+	mux.HandleFunc("/replication/status", func(rw http.ResponseWriter, r *http.Request) {
+		if !checkAPIKey(r, apiKey) {
+			http.Error(rw, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "GET" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		status := primary.Status()
+		if replica != nil && replica.Following() {
+			status = replica.Status()
+		}
+		data, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Write(data)
+	})
+	// POST /replication/promote
+	// stop following the primary and take writes
+	mux.HandleFunc("/replication/promote", func(rw http.ResponseWriter, r *http.Request) {
+		if !checkAPIKey(r, apiKey) {
+			http.Error(rw, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if replica == nil {
+			http.Error(rw, "server is not a replica", http.StatusConflict)
+			return
+		}
+		replica.Promote()
+	})
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		if replica != nil && replica.Following() && !(r.Method == "GET" && readOnlyPaths[r.URL.Path]) {
+			http.Error(rw, "read-only replica", http.StatusServiceUnavailable)
+			return
+		}
+		api.ServeHTTP(rw, r)
+	})
+	return mux
+}
@@ -0,0 +1,103 @@
+package replication
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/alexio777/stq/server/backends/export"
+)
+
+// EventType is the type of a replication stream event.
+type EventType string
+
+const (
+	// First event of a stream with the log id and its last sequence number.
+	EventHello EventType = "hello"
+	// The replica must drop all its tasks, upserts of all primary tasks
+	// follow until EventSynced.
+	EventReset EventType = "reset"
+	// The full state is sent, the replica is at the event sequence number.
+	EventSynced EventType = "synced"
+	// The task is created or changed.
+	EventUpsert EventType = "upsert"
+	// The task is deleted.
+	EventDelete EventType = "delete"
+	// The queue is paused or resumed.
+	EventPause EventType = "pause"
+	// Sent when there are no changes with the last sequence number.
+	EventHeartbeat EventType = "heartbeat"
+)
+
+// Event is an event of the replication stream.
+type Event struct {
+	Type   EventType
+	Seq    uint64
+	Time   time.Time
+	Log    string         `json:",omitempty"`
+	Task   *export.Record `json:",omitempty"`
+	TaskID string         `json:",omitempty"`
+	Queue  string         `json:",omitempty"`
+	Paused bool           `json:",omitempty"`
+}
+
+// eventLog keeps the last events in memory.
+type eventLog struct {
+	id   string
+	size int
+
+	mutex  sync.Mutex
+	events []Event
+	seq    uint64
+	// closed and replaced on every append
+	notify chan struct{}
+}
+
+func newEventLog(size int) *eventLog {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &eventLog{
+		id:     hex.EncodeToString(id),
+		size:   size,
+		notify: make(chan struct{}),
+	}
+}
+
+func (l *eventLog) append(e Event) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.seq++
+	e.Seq = l.seq
+	e.Time = time.Now()
+	l.events = append(l.events, e)
+	if len(l.events) > 2*l.size {
+		l.events = append([]Event(nil), l.events[len(l.events)-l.size:]...)
+	}
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// last returns the sequence number of the last event.
+func (l *eventLog) last() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.seq
+}
+
+// since returns events starting from the sequence number and the channel
+// closed on the next append. It returns false if some of the events are
+// not kept any more.
+func (l *eventLog) since(seq uint64) ([]Event, <-chan struct{}, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if seq > l.seq {
+		return nil, l.notify, true
+	}
+	// events in the log are numbered without gaps
+	first := l.seq - uint64(len(l.events)) + 1
+	if seq < first {
+		return nil, l.notify, false
+	}
+	return append([]Event(nil), l.events[seq-first:]...), l.notify, true
+}
@@ -0,0 +1,263 @@
+// Package replication streams task state changes of a primary server to
+// replicas over HTTP. The primary wraps its backend with Primary, which
+// keeps the last changes in memory and serves them as a stream of JSON
+// lines. A Replica follows the stream and applies the changes to its own
+// backend, starting with a full copy of the primary tasks when it is new
+// or too far behind. Replication is asynchronous, a replica reports its
+// lag in events and time.
+//
+// Tasks are replicated by state: every change sends the whole task as it
+// is after the change, so applying a change twice is harmless. Execution
+// timeouts of running tasks are not replicated, a replica runs its own
+// timeouts from the moment it gets a running task. Paused queues are
+// replicated too if the replica backend has pause.
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/export"
+)
+
+var (
+	// Interval of heartbeats sent when there are no changes.
+	HeartbeatInterval = time.Second
+)
+
+// Primary is a backend wrapper recording task changes for replicas. The
+// backend is called without a lock, so a call waiting in the backend does not
+// hold up the others, and the changes are recorded one by one with the state
+// read when they are recorded, so the last event of a task has its last
+// state.
+type Primary struct {
+	backends.Backend
+	log *eventLog
+
+	inspector backends.Inspector
+	exporter  backends.Exporter
+
+	// held while a change is recorded
+	mutex sync.Mutex
+}
+
+// NewPrimary wraps the backend keeping the last logSize changes for
+// replicas. The backend must support task lookup and export.
+func NewPrimary(backend backends.Backend, logSize int) (*Primary, error) {
+	p := &Primary{
+		Backend: backend,
+		log:     newEventLog(logSize),
+	}
+	if !backends.As(backend, &p.inspector) || !backends.As(backend, &p.exporter) {
+		return nil, backends.ErrNotSupported
+	}
+	var notifier backends.DropNotifier
+	if backends.As(backend, &notifier) {
+		// tasks dropped by queue limits are deleted on replicas too
+		notifier.OnDrop(p.record)
+	}
+	return p, nil
+}
+
+func (p *Primary) Unwrap() backends.Backend {
+	return p.Backend
+}
+
+// record appends the current state of the task to the log.
+func (p *Primary) record(taskID string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// the backend is changed already, the caller context does not matter
+	task, err := p.inspector.Task(context.Background(), taskID)
+	if errors.Is(err, backends.ErrTaskNotFound) {
+		p.log.append(Event{Type: EventDelete, TaskID: taskID})
+		return
+	}
+	if err != nil {
+		// the replica gets the task with the next change or full sync
+		return
+	}
+	record := export.NewRecord(task)
+	p.log.append(Event{Type: EventUpsert, Task: &record})
+}
+
+func (p *Primary) Put(ctx context.Context, queue, group string, payload []byte, executionTimeout time.Duration) (string, error) {
+	taskID, err := p.Backend.Put(ctx, queue, group, payload, executionTimeout)
+	if err == nil {
+		p.record(taskID)
+	}
+	return taskID, err
+}
+
+func (p *Primary) GetNotReady(ctx context.Context, queue string) (string, []byte, error) {
+	taskID, payload, err := p.Backend.GetNotReady(ctx, queue)
+	if err == nil {
+		p.record(taskID)
+	}
+	return taskID, payload, err
+}
+
+func (p *Primary) GetReady(ctx context.Context, taskID string) ([]byte, error) {
+	result, err := p.Backend.GetReady(ctx, taskID)
+	if err == nil || errors.Is(err, backends.ErrTaskExecutionTimeout) {
+		p.record(taskID)
+	}
+	return result, err
+}
+
+func (p *Primary) TaskReady(ctx context.Context, taskID string, result []byte) error {
+	err := p.Backend.TaskReady(ctx, taskID, result)
+	if err == nil {
+		p.record(taskID)
+	}
+	return err
+}
+
+func (p *Primary) Import(ctx context.Context, task *backends.Task) error {
+	var importer backends.Importer
+	if !backends.As(p.Backend, &importer) {
+		return backends.ErrNotSupported
+	}
+	err := importer.Import(ctx, task)
+	if err == nil {
+		p.record(task.ID)
+	}
+	return err
+}
+
+func (p *Primary) Delete(ctx context.Context, taskID string) error {
+	var deleter backends.Deleter
+	if !backends.As(p.Backend, &deleter) {
+		return backends.ErrNotSupported
+	}
+	err := deleter.Delete(ctx, taskID)
+	if err == nil {
+		p.record(taskID)
+	}
+	return err
+}
+
+// SetPaused pauses or resumes dispatch of the queue on the primary and its
+// replicas.
+func (p *Primary) SetPaused(ctx context.Context, queue string, paused bool) error {
+	var pauser backends.Pauser
+	if !backends.As(p.Backend, &pauser) {
+		return backends.ErrNotSupported
+	}
+	err := pauser.SetPaused(ctx, queue, paused)
+	if err == nil {
+		p.recordPause(queue)
+	}
+	return err
+}
+
+// recordPause appends the current pause of the queue to the log.
+func (p *Primary) recordPause(queue string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	stats, err := backends.QueueStatsOf(context.Background(), p.Backend, queue)
+	if err != nil {
+		// replicas get the pause with the next full sync
+		return
+	}
+	p.log.append(Event{Type: EventPause, Queue: queue, Paused: stats.Paused})
+}
+
+// Seq returns the sequence number of the last change.
+func (p *Primary) Seq() uint64 {
+	return p.log.last()
+}
+
+// Status returns the replication state of the primary.
+func (p *Primary) Status() Status {
+	seq := p.log.last()
+	return Status{Role: "primary", Connected: true, Log: p.log.id, AppliedSeq: seq, PrimarySeq: seq}
+}
+
+// ServeHTTP streams changes as JSON lines. The replica passes the log id
+// and the sequence number of the next change it needs in "log" and "from"
+// query parameters. If the log is another one or the changes are not kept
+// any more the stream starts with the full state.
+func (p *Primary) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	from, _ := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	if r.URL.Query().Get("log") != p.log.id {
+		from = 0
+	}
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(rw)
+	send := func(e Event) bool {
+		return encoder.Encode(e) == nil
+	}
+	if !send(Event{Type: EventHello, Log: p.log.id, Seq: p.log.last(), Time: time.Now()}) {
+		return
+	}
+	if _, _, ok := p.log.since(from); from == 0 || !ok {
+		// changes after seq are sent after the tasks and fix the tasks
+		// changed while they are exported
+		seq := p.log.last()
+		if !send(Event{Type: EventReset, Seq: seq, Time: time.Now()}) {
+			return
+		}
+		err := p.exporter.Export(r.Context(), func(task *backends.Task) error {
+			record := export.NewRecord(task)
+			if !send(Event{Type: EventUpsert, Seq: seq, Time: time.Now(), Task: &record}) {
+				return errors.New("replica is gone")
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		stats, err := p.Backend.Stats(r.Context())
+		if err != nil {
+			return
+		}
+		for queue, queueStats := range stats.Queues {
+			if queueStats.Paused && !send(Event{Type: EventPause, Seq: seq, Time: time.Now(), Queue: queue, Paused: true}) {
+				return
+			}
+		}
+		if !send(Event{Type: EventSynced, Seq: seq, Time: time.Now()}) {
+			return
+		}
+		from = seq + 1
+	}
+	flusher.Flush()
+	heartbeat := time.NewTicker(HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		events, notify, ok := p.log.since(from)
+		if !ok {
+			// the replica is too slow, it starts over with full sync
+			return
+		}
+		for _, e := range events {
+			if !send(e) {
+				return
+			}
+			from = e.Seq + 1
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-notify:
+		case <-heartbeat.C:
+			if !send(Event{Type: EventHeartbeat, Seq: p.log.last(), Time: time.Now()}) {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+var (
+	// Delay before the replica reconnects to the primary.
+	ReconnectInterval = time.Second
+)
+
+// Status is the replication state of a server.
+type Status struct {
+	Role string
+	// primary URL of a replica
+	Primary   string `json:",omitempty"`
+	Connected bool
+	// log id of the primary the replica follows
+	Log string `json:",omitempty"`
+	// last applied change of the primary
+	AppliedSeq uint64
+	// last change of the primary known to the replica
+	PrimarySeq uint64
+	// changes not applied yet
+	Lag uint64
+	// time since the oldest change not applied yet was made on the primary
+	DelaySeconds float64
+	LastError    string `json:",omitempty"`
+}
+
+// Replica follows the changes of a primary server and applies them to its
+// backend until it is promoted.
+type Replica struct {
+	primaryURL string
+	apiKey     string
+	client     *http.Client
+
+	backend  backends.Backend
+	importer backends.Importer
+	deleter  backends.Deleter
+	exporter backends.Exporter
+	// nil if the backend has no pause
+	pauser backends.Pauser
+
+	mutex    sync.Mutex
+	status   Status
+	syncing  bool
+	promoted bool
+	cancel   context.CancelFunc
+	// time of the first change received but not applied yet
+	behindSince time.Time
+}
+
+// NewReplica creates a replica of the primary server applying changes to
+// the backend. The backend must support import, delete and export, pause
+// events are skipped if it has no pause.
+func NewReplica(primaryURL string, apiKey string, backend backends.Backend) (*Replica, error) {
+	r := &Replica{
+		backend:    backend,
+		primaryURL: primaryURL,
+		apiKey:     apiKey,
+		client:     &http.Client{},
+		status:     Status{Role: "replica", Primary: primaryURL},
+	}
+	if !backends.As(backend, &r.importer) || !backends.As(backend, &r.deleter) || !backends.As(backend, &r.exporter) {
+		return nil, backends.ErrNotSupported
+	}
+	backends.As(backend, &r.pauser)
+	return r, nil
+}
+
+// Run follows the primary, reconnecting on errors, until the context is
+// done or the replica is promoted.
+func (r *Replica) Run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	r.mutex.Lock()
+	if r.promoted {
+		r.mutex.Unlock()
+		cancel()
+		return
+	}
+	r.cancel = cancel
+	r.mutex.Unlock()
+	defer cancel()
+	for {
+		err := r.follow(ctx)
+		r.mutex.Lock()
+		r.status.Connected = false
+		if err != nil && ctx.Err() == nil {
+			r.status.LastError = err.Error()
+		}
+		r.mutex.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ReconnectInterval):
+		}
+	}
+}
+
+// Promote stops following the primary, the server takes writes since then.
+func (r *Replica) Promote() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.promoted = true
+	r.status.Role = "primary"
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// Following returns true until the replica is promoted.
+func (r *Replica) Following() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return !r.promoted
+}
+
+// Status returns the replication state.
+func (r *Replica) Status() Status {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := r.status
+	if status.PrimarySeq > status.AppliedSeq {
+		status.Lag = status.PrimarySeq - status.AppliedSeq
+		if !r.behindSince.IsZero() {
+			status.DelaySeconds = time.Since(r.behindSince).Seconds()
+		}
+	}
+	return status
+}
+
+func (r *Replica) follow(ctx context.Context) error {
+	r.mutex.Lock()
+	url := r.primaryURL + "/replication/stream?log=" + r.status.Log +
+		"&from=" + strconv.FormatUint(r.status.AppliedSeq+1, 10)
+	r.mutex.Unlock()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-KEY", r.apiKey)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	r.mutex.Lock()
+	r.status.Connected = true
+	r.status.LastError = ""
+	r.mutex.Unlock()
+	decoder := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var e Event
+		if err := decoder.Decode(&e); err != nil {
+			return err
+		}
+		if err := r.apply(ctx, e); err != nil {
+			return fmt.Errorf("apply %s %d: %w", e.Type, e.Seq, err)
+		}
+	}
+}
+
+func (r *Replica) apply(ctx context.Context, e Event) error {
+	switch e.Type {
+	case EventHello:
+		r.mutex.Lock()
+		r.status.Log = e.Log
+		r.observe(e)
+		r.mutex.Unlock()
+		return nil
+	case EventHeartbeat:
+		r.mutex.Lock()
+		r.observe(e)
+		r.mutex.Unlock()
+		return nil
+	case EventReset:
+		r.mutex.Lock()
+		r.syncing = true
+		r.mutex.Unlock()
+		return r.reset(ctx)
+	case EventSynced:
+		r.mutex.Lock()
+		r.syncing = false
+		r.applied(e)
+		r.mutex.Unlock()
+		return nil
+	case EventUpsert:
+		if e.Task == nil {
+			return errors.New("upsert without task")
+		}
+		if err := r.deleter.Delete(ctx, e.Task.ID); err != nil && !errors.Is(err, backends.ErrTaskNotFound) {
+			return err
+		}
+		if err := r.importer.Import(ctx, e.Task.Task()); err != nil {
+			return err
+		}
+	case EventDelete:
+		if err := r.deleter.Delete(ctx, e.TaskID); err != nil && !errors.Is(err, backends.ErrTaskNotFound) {
+			return err
+		}
+	case EventPause:
+		if r.pauser != nil {
+			if err := r.pauser.SetPaused(ctx, e.Queue, e.Paused); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown event type %q", e.Type)
+	}
+	r.mutex.Lock()
+	if !r.syncing {
+		r.applied(e)
+	}
+	r.mutex.Unlock()
+	return nil
+}
+
+// observe notes the last change of the primary, called with mutex held.
+func (r *Replica) observe(e Event) {
+	if e.Seq > r.status.PrimarySeq {
+		r.status.PrimarySeq = e.Seq
+	}
+	if r.status.PrimarySeq > r.status.AppliedSeq && r.behindSince.IsZero() {
+		r.behindSince = e.Time
+	}
+}
+
+// applied notes the applied change, called with mutex held.
+func (r *Replica) applied(e Event) {
+	r.status.AppliedSeq = e.Seq
+	r.observe(e)
+	if r.status.AppliedSeq >= r.status.PrimarySeq {
+		r.behindSince = time.Time{}
+	} else {
+		r.behindSince = e.Time
+	}
+}
+
+// reset deletes all tasks of the replica backend.
+func (r *Replica) reset(ctx context.Context) error {
+	var taskIDs []string
+	err := r.exporter.Export(ctx, func(task *backends.Task) error {
+		taskIDs = append(taskIDs, task.ID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, taskID := range taskIDs {
+		if err := r.deleter.Delete(ctx, taskID); err != nil && !errors.Is(err, backends.ErrTaskNotFound) {
+			return err
+		}
+	}
+	if r.pauser != nil {
+		// paused queues of the primary are sent with its tasks
+		stats, err := r.backend.Stats(ctx)
+		if err != nil {
+			return err
+		}
+		for queue, queueStats := range stats.Queues {
+			if !queueStats.Paused {
+				continue
+			}
+			if err := r.pauser.SetPaused(ctx, queue, false); err != nil {
+				return err
+			}
+		}
+	}
+	r.mutex.Lock()
+	r.status.AppliedSeq = 0
+	r.mutex.Unlock()
+	return nil
+}
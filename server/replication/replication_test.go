@@ -0,0 +1,317 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/export"
+	"github.com/alexio777/stq/server/backends/memory"
+	"github.com/alexio777/stq/server/backends/middleware"
+)
+
+func newPrimary(t *testing.T, logSize int) (*Primary, *httptest.Server) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, err := NewPrimary(backend, logSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the test server serves the stream on every path
+	server := httptest.NewServer(primary)
+	t.Cleanup(server.Close)
+	return primary, server
+}
+
+func newReplica(t *testing.T, primaryURL string) (*Replica, *Primary) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the replica records changes too, to be followed after promotion
+	local, err := NewPrimary(backend, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := NewReplica(primaryURL, "", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return replica, local
+}
+
+// tasks returns exported tasks by id.
+func tasks(t *testing.T, backend backends.Backend) map[string]export.Record {
+	var exporter backends.Exporter
+	if !backends.As(backend, &exporter) {
+		t.Fatal("backend has no export")
+	}
+	records := make(map[string]export.Record)
+	err := exporter.Export(context.TODO(), func(task *backends.Task) error {
+		records[task.ID] = export.NewRecord(task)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func waitSynced(t *testing.T, replica *Replica, primary *Primary) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		status := replica.Status()
+		if status.Connected && status.AppliedSeq == primary.Seq() && status.Lag == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("replica is not synced: %+v, primary seq %d", replica.Status(), primary.Seq())
+}
+
+func expectSameTasks(t *testing.T, replica backends.Backend, primary backends.Backend) {
+	t.Helper()
+	replicaTasks, primaryTasks := tasks(t, replica), tasks(t, primary)
+	if !reflect.DeepEqual(replicaTasks, primaryTasks) {
+		t.Fatalf("replica tasks are not equal to primary: %+v != %+v", replicaTasks, primaryTasks)
+	}
+}
+
+func Test_Replication(t *testing.T) {
+	ctx := context.TODO()
+	primary, server := newPrimary(t, 1000)
+	// tasks before the replica comes are sent with full sync
+	for i := 0; i < 3; i++ {
+		if _, err := primary.Put(ctx, "queue", "", []byte("payload"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	taskID, _, err := primary.GetNotReady(ctx, "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, local := newReplica(t, server.URL)
+	replicaCtx, stop := context.WithCancel(ctx)
+	go replica.Run(replicaCtx)
+	waitSynced(t, replica, primary)
+	expectSameTasks(t, local, primary)
+
+	// changes are streamed
+	if err := primary.TaskReady(ctx, taskID, []byte("result")); err != nil {
+		t.Fatal(err)
+	}
+	other, err := primary.Put(ctx, "other", "", []byte("payload"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitSynced(t, replica, primary)
+	expectSameTasks(t, local, primary)
+	if _, err := primary.GetReady(ctx, taskID); err != nil {
+		t.Fatal(err)
+	}
+	waitSynced(t, replica, primary)
+	expectSameTasks(t, local, primary)
+
+	// a reconnected replica gets the missed changes only
+	stop()
+	time.Sleep(10 * time.Millisecond)
+	if _, _, err := primary.GetNotReady(ctx, "other"); err != nil {
+		t.Fatal(err)
+	}
+	localSeq := local.Seq()
+	replicaCtx, stop = context.WithCancel(ctx)
+	defer stop()
+	go replica.Run(replicaCtx)
+	waitSynced(t, replica, primary)
+	expectSameTasks(t, local, primary)
+	if local.Seq() != localSeq+2 {
+		t.Fatalf("replica is synced in full: %d changes", local.Seq()-localSeq)
+	}
+
+	// promoted replica takes writes
+	replica.Promote()
+	if replica.Following() {
+		t.Fatal("promoted replica is following")
+	}
+	if err := local.TaskReady(ctx, other, []byte("result")); err != nil {
+		t.Fatal(err)
+	}
+	result, err := local.GetReady(ctx, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "result" {
+		t.Fatalf("result is not equal: %s != %s", result, "result")
+	}
+}
+
+func Test_ReplicationLogOverflow(t *testing.T) {
+	ctx := context.TODO()
+	primary, server := newPrimary(t, 2)
+	replica, local := newReplica(t, server.URL)
+	replicaCtx, stop := context.WithCancel(ctx)
+	go replica.Run(replicaCtx)
+	waitSynced(t, replica, primary)
+	stop()
+	time.Sleep(10 * time.Millisecond)
+	// more changes than the log keeps
+	for i := 0; i < 10; i++ {
+		if _, err := primary.Put(ctx, "queue", "", []byte("payload"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replicaCtx, stop = context.WithCancel(ctx)
+	defer stop()
+	go replica.Run(replicaCtx)
+	waitSynced(t, replica, primary)
+	expectSameTasks(t, local, primary)
+}
+
+func Test_ReplicationWaitingPoll(t *testing.T) {
+	ctx := context.TODO()
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate := middleware.Rate{Tasks: 3, Per: time.Minute}
+	primary, err := NewPrimary(middleware.DispatchRate(map[string]middleware.Rate{"rated": rate})(backend), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := primary.Put(ctx, "rated", "", []byte("payload"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := primary.GetNotReady(ctx, "rated"); err != nil {
+		t.Fatal(err)
+	}
+	// the poll waits for the next dispatch in 20 seconds
+	pollCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go primary.GetNotReady(pollCtx, "rated")
+	time.Sleep(10 * time.Millisecond)
+	putCtx, putCancel := context.WithTimeout(ctx, time.Second)
+	defer putCancel()
+	if _, err := primary.Put(putCtx, "queue", "", []byte("payload"), time.Minute); err != nil {
+		t.Fatalf("put waits for the poll: %v", err)
+	}
+}
+
+func Test_ReplicationDropOldest(t *testing.T) {
+	ctx := context.TODO()
+	backend, err := memory.New(memory.WithQueueLimit("queue", memory.QueueLimit{MaxLength: 2, Overflow: memory.OverflowDropOldest}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, err := NewPrimary(backend, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(primary)
+	defer server.Close()
+	replica, local := newReplica(t, server.URL)
+	replicaCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go replica.Run(replicaCtx)
+	waitSynced(t, replica, primary)
+	// the dropped tasks are deleted on the replica
+	for i := 0; i < 4; i++ {
+		if _, err := primary.Put(ctx, "queue", "", []byte("payload"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitSynced(t, replica, primary)
+	expectSameTasks(t, local, primary)
+	if replicaTasks := tasks(t, local); len(replicaTasks) != 2 {
+		t.Fatalf("replica tasks are not equal: %d != %d", len(replicaTasks), 2)
+	}
+}
+
+// paused returns the paused queues of the backend.
+func paused(t *testing.T, backend backends.Backend) map[string]bool {
+	t.Helper()
+	stats, err := backend.Stats(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queues := make(map[string]bool)
+	for queue, queueStats := range stats.Queues {
+		if queueStats.Paused {
+			queues[queue] = true
+		}
+	}
+	return queues
+}
+
+func Test_ReplicationPause(t *testing.T) {
+	ctx := context.TODO()
+	primary, server := newPrimary(t, 2)
+	// paused queues are sent with full sync
+	if err := primary.SetPaused(ctx, "paused", true); err != nil {
+		t.Fatal(err)
+	}
+	replica, local := newReplica(t, server.URL)
+	replicaCtx, stop := context.WithCancel(ctx)
+	go replica.Run(replicaCtx)
+	waitSynced(t, replica, primary)
+	if queues := paused(t, local); !reflect.DeepEqual(queues, map[string]bool{"paused": true}) {
+		t.Fatalf("paused queues are not equal: %v != %v", queues, []string{"paused"})
+	}
+
+	// pauses are streamed
+	if err := primary.SetPaused(ctx, "queue", true); err != nil {
+		t.Fatal(err)
+	}
+	waitSynced(t, replica, primary)
+	if queues := paused(t, local); !reflect.DeepEqual(queues, map[string]bool{"paused": true, "queue": true}) {
+		t.Fatalf("paused queues are not equal: %v != %v", queues, []string{"paused", "queue"})
+	}
+	if _, err := local.Put(ctx, "queue", "", []byte("payload"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := local.GetNotReady(ctx, "queue"); !errors.Is(err, backends.ErrQueueNotFound) {
+		t.Fatalf("replica queue is not paused: %v", err)
+	}
+
+	// full sync resumes queues resumed on the primary
+	stop()
+	time.Sleep(10 * time.Millisecond)
+	if err := primary.SetPaused(ctx, "queue", false); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := primary.Put(ctx, "other", "", []byte("payload"), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replicaCtx, stop = context.WithCancel(ctx)
+	defer stop()
+	go replica.Run(replicaCtx)
+	waitSynced(t, replica, primary)
+	if queues := paused(t, local); !reflect.DeepEqual(queues, map[string]bool{"paused": true}) {
+		t.Fatalf("paused queues are not equal: %v != %v", queues, []string{"paused"})
+	}
+}
+
+func Test_NotSupported(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPrimary(backends.FromV1(nil), 1); !errors.Is(err, backends.ErrNotSupported) {
+		t.Fatalf("backend without lookup is not detected: %v", err)
+	}
+	if _, err := NewReplica("http://localhost", "", backends.FromV1(nil)); !errors.Is(err, backends.ErrNotSupported) {
+		t.Fatalf("backend without import is not detected: %v", err)
+	}
+	if _, err := NewReplica("http://localhost", "", backend); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/client"
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/memory"
+	"github.com/alexio777/stq/server/replication"
+)
+
+func newReplicationServer(t *testing.T, primaryURL string) (*httptest.Server, *replication.Replica) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, err := replication.NewPrimary(backend, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replica *replication.Replica
+	if primaryURL != "" {
+		replica, err = replication.NewReplica(primaryURL, "d6MrLT7MwlhtaoQu2b5lWFr", primary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go replica.Run(ctx)
+	}
+	api := createAPI("d6MrLT7MwlhtaoQu2b5lWFr", primary)
+	server := httptest.NewServer(withReplication(api.Handler, "d6MrLT7MwlhtaoQu2b5lWFr", primary, replica))
+	t.Cleanup(server.Close)
+	return server, replica
+}
+
+func Test_Replication(t *testing.T) {
+	primaryServer, _ := newReplicationServer(t, "")
+	replicaServer, replica := newReplicationServer(t, primaryServer.URL)
+	c := client.New(primaryServer.URL, "d6MrLT7MwlhtaoQu2b5lWFr")
+	taskID, err := c.AddTask("queue", 15, []byte("payload_123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status replication.Status
+	for i := 0; i < 100; i++ {
+		code, data := adminRequest(t, "GET", replicaServer.URL+"/replication/status", nil)
+		if code != http.StatusOK {
+			t.Fatalf("unexpected status code: %d, body: %s", code, data)
+		}
+		if err := json.Unmarshal(data, &status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Connected && status.AppliedSeq == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Role != "replica" || status.AppliedSeq != 1 || status.Lag != 0 {
+		t.Fatalf("replica is not synced: %+v", status)
+	}
+	code, data := adminRequest(t, "GET", replicaServer.URL+"/task/status?taskid="+taskID, nil)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d, body: %s", code, data)
+	}
+	var task taskStatus
+	if err := json.Unmarshal(data, &task); err != nil {
+		t.Fatal(err)
+	}
+	if task.ID != taskID || task.Queue != "queue" || task.State != backends.TaskWaiting {
+		t.Fatalf("unexpected task status: %+v", task)
+	}
+	code, data = adminRequest(t, "GET", replicaServer.URL+"/stats", nil)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d, body: %s", code, data)
+	}
+	code, _ = adminRequest(t, "POST", replicaServer.URL+"/task?queue=queue&timeout=15", []byte("payload"))
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("replica takes writes: %d", code)
+	}
+	code, _ = adminRequest(t, "POST", primaryServer.URL+"/replication/promote", nil)
+	if code != http.StatusConflict {
+		t.Fatalf("primary is promoted: %d", code)
+	}
+	code, _ = adminRequest(t, "POST", replicaServer.URL+"/replication/promote", nil)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", code)
+	}
+	if replica.Following() {
+		t.Fatal("promoted replica is following")
+	}
+	replicaClient := client.New(replicaServer.URL, "d6MrLT7MwlhtaoQu2b5lWFr")
+	workerTaskID, payload, err := replicaClient.WaitWorkerTask("queue", 1, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workerTaskID != taskID || string(payload) != "payload_123" {
+		t.Fatalf("unexpected task: %s %s", workerTaskID, payload)
+	}
+}
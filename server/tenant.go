@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alexio777/stq/server/backends"
+)
+
+// tenantSeparator separates the tenant from the queue name in the backend,
+// queue "orders" of tenant "acme" is "acme/orders".
+const tenantSeparator = "/"
+
+var errTenantLimit = errors.New("tenant limit exceeded")
+
+// validTenant reports whether the name can be a tenant.
+func validTenant(name string) bool {
+	return name != "" && !strings.Contains(name, tenantSeparator)
+}
+
+// backendQueue returns the backend queue of the queue the client sees.
+func (g *grant) backendQueue(queue string) string {
+	if g.tenant == "" {
+		return queue
+	}
+	return g.tenant + tenantSeparator + queue
+}
+
+// clientQueue returns the queue the client sees, false if the backend queue
+// belongs to another tenant.
+func (g *grant) clientQueue(queue string) (string, bool) {
+	if g.tenant == "" {
+		return queue, true
+	}
+	prefix := g.tenant + tenantSeparator
+	if !strings.HasPrefix(queue, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(queue, prefix), true
+}
+
+// clientStats returns the stats of the tenant queues as the client sees
+// them.
+func (g *grant) clientStats(stats *backends.Stats) map[string]backends.QueueStats {
+	if g.tenant == "" {
+		return stats.Queues
+	}
+	queues := make(map[string]backends.QueueStats)
+	for queue, queueStats := range stats.Queues {
+		if name, ok := g.clientQueue(queue); ok {
+			queues[name] = queueStats
+		}
+	}
+	return queues
+}
+
+// tenantLimit limits a tenant, zero means no limit.
+type tenantLimit struct {
+	Queues       int
+	Waiting      uint64
+	PayloadBytes int64
+}
+
+// tenantLimits are limits of tenants loaded from a file, see
+// loadTenantLimits.
+type tenantLimits struct {
+	path   string
+	mutex  sync.RWMutex
+	limits map[string]tenantLimit
+}
+
+func newTenantLimits(path string) (*tenantLimits, error) {
+	l := &tenantLimits{path: path}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload reads the limits file again, the limits are kept if it fails.
+func (l *tenantLimits) Reload() error {
+	limits, err := loadTenantLimits(l.path)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	l.limits = limits
+	l.mutex.Unlock()
+	return nil
+}
+
+// get returns the limit of the tenant or the "*" one.
+func (l *tenantLimits) get(tenant string) tenantLimit {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if limit, ok := l.limits[tenant]; ok {
+		return limit
+	}
+	return l.limits["*"]
+}
+
+// check returns errTenantLimit if the tenant can not put a task to the
+// queue, or else the payload bytes the tenant may still add, zero if they
+// are not limited. Payload bytes are of the waiting tasks of all the tenant
+// queues, offloaded payloads by their blob size. The limits are checked by the backend stats before the put, so
+// concurrent puts may exceed them a little.
+func (l *tenantLimits) check(ctx context.Context, backend backends.Backend, g *grant, queue string) (int64, error) {
+	limit := l.get(g.tenant)
+	if limit.Queues == 0 && limit.Waiting == 0 && limit.PayloadBytes == 0 {
+		return 0, nil
+	}
+	stats, err := backend.Stats(ctx)
+	if err != nil {
+		return 0, err
+	}
+	queues := g.clientStats(stats)
+	_, exists := queues[queue]
+	if limit.Queues > 0 && !exists && len(queues) >= limit.Queues {
+		return 0, fmt.Errorf("%w: %d queues", errTenantLimit, limit.Queues)
+	}
+	var waiting, waitBytes uint64
+	for _, queueStats := range queues {
+		waiting += queueStats.WaitLength
+		waitBytes += queueStats.WaitBytes
+	}
+	if limit.Waiting > 0 && waiting >= limit.Waiting {
+		return 0, fmt.Errorf("%w: %d waiting tasks", errTenantLimit, limit.Waiting)
+	}
+	if limit.PayloadBytes <= 0 {
+		return 0, nil
+	}
+	if waitBytes >= uint64(limit.PayloadBytes) {
+		return 0, fmt.Errorf("%w: %d payload bytes", errTenantLimit, limit.PayloadBytes)
+	}
+	return limit.PayloadBytes - int64(waitBytes), nil
+}
+
+// loadTenantLimits reads a tenant per line, the tenant or "*" for tenants
+// not in the file, the queue count, waiting tasks and payload bytes limits:
+//
+//	# tenant  queues  waiting  payload_bytes
+//	*         100     100000   1048576
+//	acme      10      1000     0
+func loadTenantLimits(path string) (map[string]tenantLimit, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	limits := make(map[string]tenantLimit)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("%s:%d: expected tenant, queues, waiting and payload_bytes", path, line)
+		}
+		var limit tenantLimit
+		if limit.Queues, err = strconv.Atoi(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if limit.Waiting, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if limit.PayloadBytes, err = strconv.ParseInt(fields[3], 10, 64); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		limits[fields[0]] = limit
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+// withTenantLimits limits tenants of the credentials.
+func withTenantLimits(limits *tenantLimits) apiOption {
+	return func(o *apiOptions) {
+		o.limits = limits
+	}
+}
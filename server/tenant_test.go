@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alexio777/stq/server/backends"
+	"github.com/alexio777/stq/server/backends/memory"
+)
+
+func Test_Tenants(t *testing.T) {
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keysPath := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(keysPath, []byte(`# key roles queues tenant
+acme  enqueue,consume,read-results,admin  *  acme
+other enqueue,consume,read-results,admin  *  other
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	limitsPath := filepath.Join(dir, "limits")
+	if err := ioutil.WriteFile(limitsPath, []byte(`# tenant queues waiting payload_bytes
+*    0  0 0
+acme 2  4 20
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := newAPIKeys(keysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits, err := newTenantLimits(limitsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(createAPI("d6MrLT7MwlhtaoQu2b5lWFr", backend, withAPIKeys(keys), withTenantLimits(limits)).Handler)
+	defer server.Close()
+
+	call := func(key string, method string, path string, body []byte) (int, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-API-KEY", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, data
+	}
+
+	status, taskID := call("acme", "POST", "/task?queue=orders&timeout=15", []byte("payload"))
+	if status != http.StatusOK {
+		t.Fatalf("status code is not equal: %d != %d", status, http.StatusOK)
+	}
+
+	t.Run("Test namespace", func(t *testing.T) {
+		stats, err := backend.Stats(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := stats.Queues["acme/orders"]; !ok {
+			t.Fatalf("queue is not in the tenant namespace: %v", stats.Queues)
+		}
+		status, data := call("acme", "GET", "/task/status?taskid="+string(taskID), nil)
+		if status != http.StatusOK {
+			t.Fatalf("status code is not equal: %d != %d", status, http.StatusOK)
+		}
+		var task taskStatus
+		if err := json.Unmarshal(data, &task); err != nil {
+			t.Fatal(err)
+		}
+		if task.Queue != "orders" {
+			t.Fatalf("queue is not equal: %s != %s", task.Queue, "orders")
+		}
+	})
+
+	t.Run("Test isolation", func(t *testing.T) {
+		if status, _ := call("other", "GET", "/task/worker?queue=orders", nil); status != http.StatusNotFound {
+			t.Fatalf("status code is not equal: %d != %d", status, http.StatusNotFound)
+		}
+		for _, path := range []string{"/task/status?taskid=", "/task/result?taskid="} {
+			if status, _ := call("other", "GET", path+string(taskID), nil); status != http.StatusNotFound {
+				t.Fatalf("status code is not equal: %s %d != %d", path, status, http.StatusNotFound)
+			}
+		}
+		if status, _ := call("other", "POST", "/task/ready?taskid="+string(taskID), []byte("result")); status != http.StatusNotFound {
+			t.Fatalf("status code is not equal: %d != %d", status, http.StatusNotFound)
+		}
+		if status, _ := call("acme", "GET", "/admin/snapshot", nil); status != http.StatusForbidden {
+			t.Fatalf("status code is not equal: %d != %d", status, http.StatusForbidden)
+		}
+	})
+
+	t.Run("Test stats", func(t *testing.T) {
+		if status, _ := call("other", "POST", "/task?queue=mail&timeout=15", []byte("payload")); status != http.StatusOK {
+			t.Fatalf("status code is not equal: %d != %d", status, http.StatusOK)
+		}
+		status, data := call("acme", "GET", "/stats", nil)
+		if status != http.StatusOK {
+			t.Fatalf("status code is not equal: %d != %d", status, http.StatusOK)
+		}
+		var queues map[string]backends.QueueStats
+		if err := json.Unmarshal(data, &queues); err != nil {
+			t.Fatal(err)
+		}
+		if len(queues) != 1 || queues["orders"].WaitLength != 1 {
+			t.Fatalf("stats are not of the tenant: %v", queues)
+		}
+	})
+
+	t.Run("Test limits", func(t *testing.T) {
+		put := func(queue string, payload string, expected int) {
+			t.Helper()
+			if status, body := call("acme", "POST", "/task?queue="+queue+"&timeout=15", []byte(payload)); status != expected {
+				t.Fatalf("status code is not equal: %d != %d, body: %s", status, expected, body)
+			}
+		}
+		// payload bytes are of all waiting tasks of the tenant, 7 so far
+		put("orders", strings.Repeat("p", 17), http.StatusTooManyRequests)
+		put("mail", "payload", http.StatusOK)
+		put("reports", "payload", http.StatusTooManyRequests)
+		put("orders", "payload", http.StatusTooManyRequests)
+		put("orders", "p", http.StatusOK)
+		put("orders", "p", http.StatusOK)
+		// 4 waiting tasks
+		put("orders", "p", http.StatusTooManyRequests)
+		// limits of other tenants
+		if status, _ := call("other", "POST", "/task?queue=reports&timeout=15", bytes.Repeat([]byte("p"), 17)); status != http.StatusOK {
+			t.Fatalf("status code is not equal: %d != %d", status, http.StatusOK)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate of the files and loads it again when
+// the files change, so renewed certificates need no restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	// modification time of the loaded files
+	loaded time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := r.modTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modTime returns the latest modification time of the files.
+func (r *certReloader) modTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.loaded = modTime
+	return nil
+}
+
+// GetCertificate is tls.Config.GetCertificate. The old certificate is kept
+// while the new files are broken, for example half written.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	modTime, err := r.modTime()
+	if err == nil && !modTime.Equal(r.loaded) {
+		err = r.load(modTime)
+	}
+	if err != nil {
+		log.Println("TLS certificate reload:", err)
+	}
+	return r.cert, nil
+}
+
+// newTLSConfig returns the API listener config with the reloaded
+// certificate. Client certificates signed by the clientCAFile are verified
+// if clients send them, clients without certificates use API keys or
+// tokens.
+func newTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + clientCAFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// withClientCerts maps the subject common names of verified client
+// certificates to grants, the file has the API_KEYS format with common names
+// instead of keys.
+func withClientCerts(subjects *apiKeys) apiOption {
+	return func(o *apiOptions) {
+		o.certs = subjects
+	}
+}
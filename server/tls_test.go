@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexio777/stq/client"
+	"github.com/alexio777/stq/server/backends/memory"
+)
+
+// writeCert writes the certificate and key signed by the parent, self
+// signed if the parent is nil, and returns them.
+func writeCert(t *testing.T, dir string, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func Test_TLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "stq ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	serverTemplate := func(serial int64) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "stq"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+	}
+	writeCert(t, dir, "server", serverTemplate(2), ca, caKey)
+	writeCert(t, dir, "worker", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "worker"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	subjectsFile := filepath.Join(dir, "subjects")
+	if err := ioutil.WriteFile(subjectsFile, []byte("worker consume orders.*\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	subjects, err := newAPIKeys(subjectsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := memory.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := newTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := createAPI("d6MrLT7MwlhtaoQu2b5lWFr", backend, withClientCerts(subjects))
+	go api.Serve(tls.NewListener(listener, config))
+	defer api.Close()
+	url := "https://" + listener.Addr().String()
+
+	t.Run("Test API key over TLS", func(t *testing.T) {
+		config, err := client.LoadTLSConfig(filepath.Join(dir, "ca.crt"), "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := client.New(url, "d6MrLT7MwlhtaoQu2b5lWFr", client.WithTLSConfig(config))
+		if _, err := c.AddTask("orders.1", 15, []byte("payload")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.New(url, "d6MrLT7MwlhtaoQu2b5lWFr").AddTask("orders.1", 15, []byte("payload")); err == nil {
+			t.Fatal("unknown authority is not detected")
+		}
+	})
+	t.Run("Test client certificate", func(t *testing.T) {
+		config, err := client.LoadTLSConfig(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "worker.crt"), filepath.Join(dir, "worker.key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := client.New(url, "", client.WithTLSConfig(config))
+		_, payload, err := c.WaitWorkerTask("orders.1", 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(payload) != "payload" {
+			t.Fatalf("payload is not equal: %s != %s", payload, "payload")
+		}
+		if _, err := c.AddTask("orders.1", 15, []byte("payload")); err == nil || err.Error() != "403 Forbidden" {
+			t.Fatalf("role is not checked: %v", err)
+		}
+		// the worker is not known without the certificate
+		config.Certificates = nil
+		if _, _, err := client.New(url, "", client.WithTLSConfig(config)).WaitWorkerTask("orders.1", 1, 0); err == nil || err.Error() != "401 Unauthorized" {
+			t.Fatalf("missing certificate is not detected: %v", err)
+		}
+	})
+	t.Run("Test certificate reload", func(t *testing.T) {
+		writeCert(t, dir, "server", serverTemplate(4), ca, caKey)
+		later := time.Now().Add(time.Minute)
+		for _, name := range []string{"server.crt", "server.key"} {
+			if err := os.Chtimes(filepath.Join(dir, name), later, later); err != nil {
+				t.Fatal(err)
+			}
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber; serial.Int64() != 4 {
+			t.Fatalf("serial is not equal: %d != %d", serial, 4)
+		}
+	})
+}
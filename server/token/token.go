@@ -0,0 +1,201 @@
+// Package token signs and verifies short-lived bearer tokens in the JWT
+// compact format. Tokens are signed with HMAC-SHA256 (HS256) or Ed25519
+// (EdDSA) keys from a local file, no external service is involved.
+package token
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpired      = errors.New("token expired")
+	ErrUnknownKey   = errors.New("unknown token key")
+	ErrNoSigningKey = errors.New("no token signing key")
+)
+
+// Signing algorithms.
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+)
+
+// Claims are the token claims.
+type Claims struct {
+	Subject string   `json:"sub,omitempty"`
+	Roles   []string `json:"roles"`
+	// queue names and prefixes ending with "*", empty allows all queues
+	Queues []string `json:"queues,omitempty"`
+	// the token works in the tenant namespace
+	Tenant    string `json:"tenant,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type header struct {
+	Alg   string `json:"alg"`
+	KeyID string `json:"kid"`
+	Type  string `json:"typ"`
+}
+
+type key struct {
+	alg     string
+	secret  []byte
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+func (k *key) sign(data []byte) []byte {
+	if k.alg == HS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(k.private, data)
+}
+
+func (k *key) verify(data []byte, signature []byte) bool {
+	if k.alg == HS256 {
+		return hmac.Equal(k.sign(data), signature)
+	}
+	return ed25519.Verify(k.public, data, signature)
+}
+
+// Keys are the token keys by id. The signing key signs new tokens, all keys
+// verify them.
+type Keys struct {
+	keys    map[string]*key
+	signing string
+}
+
+// LoadKeys reads keys from the file with a key per line, the key id, the
+// algorithm and the base64 key separated by spaces:
+//
+//	# kid  alg    key
+//	2023-01 HS256 c2VjcmV0IG9mIGF0IGxlYXN0IDMyIGJ5dGVzIGxvbmcgISE=
+//	2023-07 EdDSA PLSdt/tRdPRyvBDX2KFPBWm5NFbS8znnapta2jmKyF8=
+//
+// HS256 keys are secrets of 32 bytes and more. EdDSA keys are 32 bytes
+// public keys verifying tokens only or 64 bytes private keys. The last key
+// able to sign is the signing key.
+func LoadKeys(path string) (*Keys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := &Keys{keys: make(map[string]*key)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected key id, algorithm and key", path, line)
+		}
+		raw, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		k := &key{alg: fields[1]}
+		switch {
+		case k.alg == HS256 && len(raw) >= 32:
+			k.secret = raw
+		case k.alg == EdDSA && len(raw) == ed25519.PublicKeySize:
+			k.public = ed25519.PublicKey(raw)
+		case k.alg == EdDSA && len(raw) == ed25519.PrivateKeySize:
+			k.private = ed25519.PrivateKey(raw)
+			k.public = k.private.Public().(ed25519.PublicKey)
+		default:
+			return nil, fmt.Errorf("%s:%d: invalid %s key of %d bytes", path, line, k.alg, len(raw))
+		}
+		keys.keys[fields[0]] = k
+		if k.secret != nil || k.private != nil {
+			keys.signing = fields[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys.keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return keys, nil
+}
+
+// Sign returns the token with the claims signed by the signing key.
+func (k *Keys) Sign(claims Claims) (string, error) {
+	if k.signing == "" {
+		return "", ErrNoSigningKey
+	}
+	signing := k.keys[k.signing]
+	headerJSON, err := json.Marshal(header{Alg: signing.alg, KeyID: k.signing, Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := encode(headerJSON) + "." + encode(claimsJSON)
+	return signed + "." + encode(signing.sign([]byte(signed))), nil
+}
+
+// Verify checks the token signature and expiry and returns its claims.
+func (k *Keys) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return nil, err
+	}
+	verifying, ok := k.keys[h.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, h.KeyID)
+	}
+	// the key decides the algorithm, not the token
+	if h.Alg != verifying.alg {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !verifying.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := decodeJSON(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims.ExpiresAt == 0 || now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+	return &claims, nil
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeJSON(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeKeys(t *testing.T, lines ...string) *Keys {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func Test_Token(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("s", 32)))
+	now := time.Now()
+	claims := Claims{Roles: []string{"consume"}, Queues: []string{"orders.*"}, Tenant: "acme", ExpiresAt: now.Add(time.Minute).Unix()}
+	for _, test := range []struct {
+		name    string
+		signer  []string
+		checker []string
+	}{
+		{"HS256", []string{"hmac HS256 " + secret}, []string{"hmac HS256 " + secret}},
+		{"EdDSA", []string{"ed EdDSA " + base64.StdEncoding.EncodeToString(private)}, []string{"ed EdDSA " + base64.StdEncoding.EncodeToString(public)}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := writeKeys(t, test.signer...).Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checker := writeKeys(t, test.checker...)
+			verified, err := checker.Verify(token, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if verified.Tenant != "acme" || len(verified.Roles) != 1 || verified.Roles[0] != "consume" {
+				t.Fatalf("claims is not equal: %+v != %+v", verified, claims)
+			}
+			if _, err := checker.Verify(token, now.Add(time.Hour)); !errors.Is(err, ErrExpired) {
+				t.Fatalf("expired token is not detected: %v", err)
+			}
+			parts := strings.Split(token, ".")
+			forged := parts[0] + "." + encode([]byte(`{"roles":["admin"],"exp":99999999999}`)) + "." + parts[2]
+			if _, err := checker.Verify(forged, now); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("forged token is not detected: %v", err)
+			}
+		})
+	}
+	t.Run("Keys", func(t *testing.T) {
+		verifyOnly := writeKeys(t, "ed EdDSA "+base64.StdEncoding.EncodeToString(public))
+		if _, err := verifyOnly.Sign(claims); !errors.Is(err, ErrNoSigningKey) {
+			t.Fatalf("missing signing key is not detected: %v", err)
+		}
+		token, err := writeKeys(t, "other HS256 "+secret).Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifyOnly.Verify(token, now); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("unknown key is not detected: %v", err)
+		}
+		// an HS256 token signed with the public key as the secret
+		confused, err := writeKeys(t, "ed HS256 "+base64.StdEncoding.EncodeToString(public)).Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifyOnly.Verify(confused, now); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("algorithm confusion is not detected: %v", err)
+		}
+	})
+}